@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// allocatedSize isn't known outside Unix.
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// placeCopy puts a copy of dl's completed file into dir, under the same
+// name, and returns its path and how it was made. The copy is a clone if
+// the file system supports it, as it is as cheap as a hard link but
+// can't change the original when written to; otherwise a hard link, and
+// failing that, as across file systems, a full copy. It appears at its
+// path complete or not at all.
+func (dl *download) placeCopy(dir string) (path, how string, err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", "", err
+	}
+	src := dl.outputPath()
+	path = filepath.Join(dir, filepath.Base(dl.filename))
+	if abs, err := filepath.Abs(path); err == nil && abs == src {
+		return "", "", fmt.Errorf("%s is the downloaded file itself", path)
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	_ = os.Remove(tmp)
+
+	how, err = cloneFile(tmp, src)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return "", "", err
+	}
+	return path, how, nil
+}
+
+// cloneFile makes dst, which must not exist, a copy of src: a clone, a
+// hard link, or a full copy, whichever the file systems allow first. It
+// returns which it made.
+func cloneFile(dst, src string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	if reflink(out, in) == nil {
+		return "cloned", out.Close()
+	}
+	out.Close()
+	_ = os.Remove(dst)
+	if os.Link(src, dst) == nil {
+		return "hard linked", nil
+	}
+
+	out, err = os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	// Kept as the original, as a clone or hard link would be
+	_ = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return "copied", nil
+}
+
+// placeCopies places a copy of dl's completed file into each of dirs, as
+// given with -also-to.
+func (dl *download) placeCopies(dirs []string) error {
+	for _, dir := range dirs {
+		path, how, err := dl.placeCopy(dir)
+		if err != nil {
+			return fmt.Errorf("cannot place a copy of %s in %s: %w", dl.filename, dir, err)
+		}
+		fmt.Printf("Also %s to %s\n", how, path)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// metadataWorkers is how many files of a batch have their metadata
+// fetched at once, ahead of the downloads.
+const metadataWorkers = 4
+
+// readURIList reads download URIs from the file at path, or standard
+// input for "-", one per line. Blank lines and lines starting with # are
+// skipped.
+func readURIList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open input file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var uris []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uris = append(uris, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read input file: %w", err)
+	}
+	return uris, nil
+}
+
+// prefetched is a download whose metadata is fetched in the background.
+// err and the metadata may only be read once done is closed.
+type prefetched struct {
+	dl   *download
+	err  error
+	done chan struct{}
+	// info is the metadata as fetched, for looking ahead at downloads
+	// the batch hasn't reached without racing the changes made to dl.
+	info fileInfo
+}
+
+// prefetchMetadata fetches the metadata of dls in the background, in
+// order and a few at a time, so the next file is ready to start as soon
+// as the current one finishes rather than waiting on a slow HEAD
+// request.
+func prefetchMetadata(dls []*download) []*prefetched {
+	items := make([]*prefetched, len(dls))
+	queue := make(chan *prefetched, len(dls))
+	for i, dl := range dls {
+		items[i] = &prefetched{dl: dl, done: make(chan struct{})}
+		queue <- items[i]
+	}
+	close(queue)
+
+	for range min(metadataWorkers, len(items)) {
+		go func() {
+			for item := range queue {
+				item.err = item.dl.FetchMetadata()
+				item.info = item.dl.info()
+				close(item.done)
+			}
+		}()
+	}
+	return items
+}
+
+// batchSize returns the combined size of the items whose metadata has
+// arrived, and how many are still unknown.
+func batchSize(items []*prefetched) (total uint64, unknown int) {
+	for _, item := range items {
+		select {
+		case <-item.done:
+			if item.err == nil {
+				total += item.dl.filesize
+			}
+		default:
+			unknown++
+		}
+	}
+	return total, unknown
+}
+
+// batchPosition places a download within its batch, for showing the
+// progress of the batch as a whole.
+type batchPosition struct {
+	items []*prefetched
+	index int
+}
+
+// describe summarizes the batch's progress with written bytes of the
+// current file done, arriving at speed bytes per second. The total only
+// counts the sizes known so far, and is marked with a "+" while others
+// are still being fetched.
+func (b *batchPosition) describe(written int64, speed float64) string {
+	// Every earlier file is complete, and its metadata long arrived
+	var done uint64
+	for _, item := range b.items[:b.index] {
+		done += item.dl.filesize
+	}
+	done += uint64(written)
+	total, unknown := batchSize(b.items)
+	more := ""
+	if unknown > 0 {
+		more = "+"
+	}
+
+	const width = 10
+	filled := 0
+	if total > 0 {
+		filled = int(min(done, total) * width / total)
+	}
+	eta := time.Duration(-1)
+	if speed > 0 && total >= done {
+		eta = time.Duration(float64(total-done) / speed * float64(time.Second))
+	}
+	return fmt.Sprintf("batch %d/%d [%s%s] %s/%s%s, ETA %s%s",
+		b.index+1, len(b.items), strings.Repeat("#", filled), strings.Repeat("-", width-filled),
+		formatBytes(float64(done)), formatBytes(float64(total)), more, formatETA(eta), more)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bearerTokenLifetime is how long a token without a stated lifetime is
+// used before it is fetched again. Cloud access tokens usually last an
+// hour.
+const bearerTokenLifetime = 45 * time.Minute
+
+// bearerCommand gets a bearer token from a command, such as
+// "gcloud auth print-access-token", and fetches a new one when it is
+// about to expire or is rejected, so long downloads outlast the tokens
+// they start with.
+type bearerCommand struct {
+	command string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newBearerCommand(command string) *bearerCommand {
+	return &bearerCommand{command: command}
+}
+
+// authorization returns the Authorization header with the current token,
+// fetching one first if there is none or it is about to expire. The same
+// token is sent to every server.
+func (b *bearerCommand) authorization(*url.URL) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token == "" || time.Until(b.expires) <= credentialRefreshMargin {
+		cmd := shellCommand(b.command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("token command %q failed: %w", b.command, err)
+		}
+		token, lifetime, err := parseBearerToken(out)
+		if err != nil {
+			return "", fmt.Errorf("token command %q: %w", b.command, err)
+		}
+		b.token, b.expires = token, time.Now().Add(lifetime)
+	}
+	return "Bearer " + b.token, nil
+}
+
+// reject drops the token, unless it has already been replaced, so the
+// next request fetches a new one.
+func (b *bearerCommand) reject(_ *url.URL, authorization string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if authorization == "Bearer "+b.token {
+		b.token = ""
+	}
+}
+
+// parseBearerToken parses the output of a token command: either the
+// token alone, or an OAuth 2.0 token response, as cloud metadata servers
+// return, with the token's lifetime in expires_in.
+func parseBearerToken(out []byte) (string, time.Duration, error) {
+	text := strings.TrimSpace(string(out))
+	if strings.HasPrefix(text, "{") {
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}
+		if err := json.Unmarshal([]byte(text), &resp); err != nil {
+			return "", 0, fmt.Errorf("invalid token response: %w", err)
+		}
+		if resp.AccessToken == "" {
+			return "", 0, errors.New("the token response has no access_token")
+		}
+		lifetime := bearerTokenLifetime
+		if resp.ExpiresIn > 0 {
+			lifetime = time.Duration(resp.ExpiresIn) * time.Second
+		}
+		return resp.AccessToken, lifetime, nil
+	}
+	if text == "" || strings.ContainsAny(text, " \t\r\n") {
+		return "", 0, errors.New("it should print a single token")
+	}
+	return text, bearerTokenLifetime, nil
+}
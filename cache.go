@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// downloadCache keeps completed downloads in a directory shared by every
+// user of a machine, such as a CI runner, so a file fetched once is
+// copied from there afterwards. Entries are keyed by the hash of their
+// URI, checked against the server's validators before being reused, and
+// carry the SHA-256 of their contents, which is verified on every use.
+type downloadCache struct {
+	dir string
+	// maxSize and maxAge, if set, bound the total size of the cache and
+	// how long an entry may go unused before it is evicted.
+	maxSize int64
+	maxAge  time.Duration
+}
+
+// cacheEntry describes a cached file. It is stored next to the data.
+type cacheEntry struct {
+	URI          string    `json:"uri"`
+	Size         uint64    `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	SHA256       string    `json:"sha256"`
+	Stored       time.Time `json:"stored"`
+}
+
+// openCache prepares dir for use as a cache. A directory it creates is
+// made group writable, whatever the umask, so members of its group can
+// share it; give it the group and the setgid bit to have new entries
+// inherit the group. It fails if dir can't be written to, as entries
+// could then neither be stored nor locked.
+func openCache(dir string, maxSize int64, maxAge time.Duration) (*downloadCache, error) {
+	_, err := os.Stat(dir)
+	created := errors.Is(err, os.ErrNotExist)
+	if err := os.MkdirAll(dir, 0o775); err != nil {
+		return nil, fmt.Errorf("cannot create cache directory: %w", err)
+	}
+	if created {
+		if info, err := os.Stat(dir); err == nil {
+			// Keeping the setgid bit it may have from its parent
+			_ = os.Chmod(dir, info.Mode()&os.ModeSetgid|0o775)
+		}
+	}
+	f, err := os.CreateTemp(dir, ".check-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("cannot write to cache directory: %w", err)
+	}
+	f.Close()
+	_ = os.Remove(f.Name())
+	return &downloadCache{dir: dir, maxSize: maxSize, maxAge: maxAge}, nil
+}
+
+// path returns where the part of the entry for uri with the given
+// extension is kept.
+func (c *downloadCache) path(uri, ext string) string {
+	key := sha256.Sum256([]byte(uri))
+	return filepath.Join(c.dir, hex.EncodeToString(key[:])+ext)
+}
+
+// lock takes a lock on the entry for uri, shared for reading or
+// exclusive for writing, and returns the function that releases it.
+func (c *downloadCache) lock(uri string, exclusive bool) (func(), error) {
+	f, err := openLock(c.path(uri, ".lock"))
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive, true); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// openLock opens the lock file at path, creating it group writable,
+// whatever the umask, for the other users of the cache. A lock file
+// another user created without that can still be locked through a
+// read-only handle.
+func openLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o664)
+	if err == nil {
+		_ = f.Chmod(0o664)
+		return f, nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	f, err = os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrPermission) {
+		f, err = os.Open(path)
+	}
+	return f, err
+}
+
+// current reports whether entry holds the file dl is about to download.
+// Without a validator, there is no telling whether the file changed.
+func (e *cacheEntry) current(dl *download) bool {
+	if e.URI != dl.uri || e.Size != dl.filesize {
+		return false
+	}
+	switch {
+	case dl.etag != "":
+		return e.ETag == dl.etag
+	case dl.lastModified != "":
+		return e.LastModified == dl.lastModified
+	}
+	return false
+}
+
+// restore copies the cached copy of dl's file, if there is a current
+// one, to the output file and verifies it like a download. It reports
+// whether it did. A copy that fails verification is evicted.
+func (c *downloadCache) restore(dl *download) bool {
+	unlock, err := c.lock(dl.uri, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot use the cache: %v\n", err)
+		return false
+	}
+	var entry cacheEntry
+	data, err := os.ReadFile(c.path(dl.uri, ".json"))
+	if err != nil || json.Unmarshal(data, &entry) != nil || !entry.current(dl) {
+		unlock()
+		return false
+	}
+
+	sum, err := copyFile(dl.outputPath(), c.path(dl.uri, ".data"), 0o666)
+	if err == nil && sum != entry.SHA256 {
+		err = errors.New("contents don't match their hash")
+	}
+	if err == nil {
+		err = dl.verify()
+	}
+	if err == nil {
+		// Record the use, so the entry is among the last to be evicted
+		now := time.Now()
+		_ = os.Chtimes(c.path(dl.uri, ".data"), now, now)
+	}
+	unlock()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot use the cached copy: %v\n", err)
+		_ = os.Remove(dl.outputPath())
+		c.evict(dl.uri)
+		return false
+	}
+	// Any partial download of the file is superseded
+	dl.removeProgress()
+	return true
+}
+
+// store adds dl's completed file to the cache, replacing any earlier
+// copy, and then evicts entries as needed to stay within the limits.
+func (c *downloadCache) store(dl *download) error {
+	if dl.etag == "" && dl.lastModified == "" {
+		// It could never be told apart from a changed file
+		return nil
+	}
+
+	unlock, err := c.lock(dl.uri, true)
+	if err != nil {
+		return err
+	}
+	tmp := c.path(dl.uri, fmt.Sprintf(".%d.tmp", os.Getpid()))
+	sum, err := copyFile(tmp, dl.outputPath(), 0o664)
+	if err == nil {
+		// Readable by the group whatever the umask, like the lock files
+		err = os.Chmod(tmp, 0o664)
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.path(dl.uri, ".data"))
+	}
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(cacheEntry{
+			URI:          dl.uri,
+			Size:         dl.filesize,
+			ETag:         dl.etag,
+			LastModified: dl.lastModified,
+			SHA256:       sum,
+			Stored:       time.Now(),
+		})
+		if err == nil {
+			err = writeFileAtomic(c.path(dl.uri, ".json"), data)
+		}
+		if err == nil {
+			err = os.Chmod(c.path(dl.uri, ".json"), 0o664)
+		}
+	}
+	_ = os.Remove(tmp)
+	unlock()
+	if err != nil {
+		return err
+	}
+	c.prune()
+	return nil
+}
+
+// evict removes the entry for uri, unless it is in use.
+func (c *downloadCache) evict(uri string) bool {
+	// Locking needs no more than reading, so this works on any lock file
+	f, err := os.Open(c.path(uri, ".lock"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if lockFile(f, true, false) != nil {
+		return false
+	}
+	// The lock file stays, as removing it would let two processes each
+	// lock a file of that name
+	_ = os.Remove(c.path(uri, ".json"))
+	_ = os.Remove(c.path(uri, ".data"))
+	return true
+}
+
+// cachedFile is an entry found in the cache.
+type cachedFile struct {
+	cacheEntry
+	size int64
+	// used is when the entry was last stored or copied out.
+	used time.Time
+}
+
+// files returns the entries in the cache, least recently used first.
+func (c *downloadCache) files() ([]cachedFile, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []cachedFile
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		var entry cacheEntry
+		data, err := os.ReadFile(filepath.Join(c.dir, e.Name()))
+		if err != nil || json.Unmarshal(data, &entry) != nil {
+			continue
+		}
+		info, err := os.Stat(c.path(entry.URI, ".data"))
+		if err != nil {
+			continue
+		}
+		files = append(files, cachedFile{cacheEntry: entry, size: info.Size(), used: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	return files, nil
+}
+
+// prune evicts entries unused for longer than the maximum age, then the
+// least recently used ones until the cache fits its maximum size. It
+// returns how many entries it evicted and their total size.
+func (c *downloadCache) prune() (int, int64) {
+	if c.maxSize <= 0 && c.maxAge <= 0 {
+		return 0, 0
+	}
+	files, err := c.files()
+	if err != nil {
+		return 0, 0
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	var evicted int
+	var freed int64
+	for _, f := range files {
+		expired := c.maxAge > 0 && time.Since(f.used) > c.maxAge
+		if !expired && (c.maxSize <= 0 || total <= c.maxSize) {
+			continue
+		}
+		if c.evict(f.URI) {
+			total -= f.size
+			evicted++
+			freed += f.size
+		}
+	}
+	return evicted, freed
+}
+
+// copyFile copies src to a new file at dst, created with perm, cloning
+// it when the file system supports it, and returns the hex SHA-256 of
+// the contents.
+func copyFile(dst, src string, perm os.FileMode) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	if reflink(out, in) == nil {
+		// The clone already holds the data; it only needs hashing
+		w = h
+	}
+	_, err = io.Copy(w, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never
+// see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0o664); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCache inspects and bounds the shared download cache, as
+// "dl cache ls", "dl cache rm URI...", or "dl cache prune".
+func runCache(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: dl cache ls|rm|prune [flags]")
+	}
+	action, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("cache "+action, flag.ContinueOnError)
+	dir := fs.String("dir", os.Getenv("DL_CACHE_DIR"), "the cache directory (default $DL_CACHE_DIR)")
+	var maxSize *string
+	var maxAge durationFlag
+	switch action {
+	case "ls", "rm":
+	case "prune":
+		maxSize = fs.String("max-size", os.Getenv("DL_CACHE_MAX_SIZE"), "evict the least recently used files until the cache fits this size, such as 50G (default $DL_CACHE_MAX_SIZE)")
+		fs.Var(&maxAge, "max-age", "evict files unused for this long, as a `duration` such as 720h")
+	default:
+		return fmt.Errorf("unknown cache action %q; use ls, rm, or prune", action)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("no cache directory; use -dir or set DL_CACHE_DIR")
+	}
+	// Don't create the directory, as openCache would; there is nothing to
+	// manage in one that doesn't exist
+	c := &downloadCache{dir: *dir}
+
+	switch action {
+	case "ls":
+		files, err := c.files()
+		if err != nil {
+			return err
+		}
+		var total int64
+		for i := len(files) - 1; i >= 0; i-- {
+			f := files[i]
+			fmt.Printf("%10s  %s  %s\n", formatBytes(float64(f.size)), f.used.Format("2006-01-02 15:04"), f.URI)
+			total += f.size
+		}
+		fmt.Printf("%d file(s), %s\n", len(files), formatBytes(float64(total)))
+
+	case "rm":
+		if fs.NArg() == 0 {
+			return errors.New("usage: dl cache rm URI...")
+		}
+		var failed bool
+		for _, uri := range fs.Args() {
+			if _, err := os.Stat(c.path(uri, ".json")); err != nil {
+				fmt.Fprintf(os.Stderr, "%s is not in the cache.\n", uri)
+				failed = true
+				continue
+			}
+			if !c.evict(uri) {
+				fmt.Fprintf(os.Stderr, "%s is in use; try again later.\n", uri)
+				failed = true
+			}
+		}
+		if failed {
+			return errors.New("not every file was removed")
+		}
+
+	case "prune":
+		if *maxSize != "" {
+			var err error
+			if c.maxSize, err = parseSize(*maxSize, displayUnits); err != nil {
+				return err
+			}
+		}
+		c.maxAge = time.Duration(maxAge)
+		if c.maxSize <= 0 && c.maxAge <= 0 {
+			return errors.New("nothing to prune by; use -max-size or -max-age")
+		}
+		if _, err := os.Stat(c.dir); err != nil {
+			return err
+		}
+		n, freed := c.prune()
+		fmt.Printf("Evicted %d file(s), freeing %s.\n", n, formatBytes(float64(freed)))
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix || solaris || aix
+
+package main
+
+import "os"
+
+// lockFile is a no-op where flock isn't available. Entries are still
+// replaced atomically, but eviction may remove one while it is copied.
+func lockFile(f *os.File, exclusive, wait bool) error {
+	return nil
+}
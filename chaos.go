@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+)
+
+// hiddenFlags are left out of the usage message and completions. They are
+// for working on dl itself rather than for downloading.
+var hiddenFlags = map[string]bool{"chaos": true}
+
+// chaosMaxDelay bounds the stalls -chaos injects.
+const chaosMaxDelay = 2 * time.Second
+
+// printUsage writes the usage message, without the hidden flags.
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", flag.CommandLine.Name())
+	visible := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// chaosFailure fails a part's request with probability dl.chaos, as a
+// server refusing it would, or returns nil.
+func (dl *download) chaosFailure(p *downloadPart) error {
+	if dl.chaos <= 0 || rand.Float64() >= dl.chaos {
+		return nil
+	}
+	return fmt.Errorf("chaos: injected failure of part %d", p.index)
+}
+
+// chaosReader makes reads from r stall for up to chaosMaxDelay, and ends
+// the response early, each with probability dl.chaos, so retrying and
+// resuming get exercised against any server. The response is cut off at
+// most once, somewhere in its first chaosCutoff reads.
+func (dl *download) chaosReader(r io.Reader) io.Reader {
+	if dl.chaos <= 0 {
+		return r
+	}
+	c := &chaosReader{r: r, p: dl.chaos}
+	if rand.Float64() < dl.chaos {
+		c.cutoff = 1 + rand.IntN(chaosCutoff)
+	}
+	return c
+}
+
+// chaosCutoff is how many reads into a response it may be cut off.
+const chaosCutoff = 64
+
+type chaosReader struct {
+	r io.Reader
+	p float64
+	// cutoff is the read the response ends at, counting down; zero is
+	// never.
+	cutoff int
+}
+
+func (c *chaosReader) Read(b []byte) (int, error) {
+	if c.cutoff > 0 {
+		c.cutoff--
+		if c.cutoff == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	if rand.Float64() < c.p/chaosCutoff {
+		// Stalls are rarer than the other faults, as there are many reads
+		// to each request
+		time.Sleep(rand.N(chaosMaxDelay))
+	}
+	// Short reads, of part of what is available, as a slow link gives
+	if rand.Float64() < c.p && len(b) > 1 {
+		b = b[:1+rand.IntN(len(b)-1)]
+	}
+	return c.r.Read(b)
+}
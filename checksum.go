@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// errChecksumMismatch is returned when a downloaded file doesn't match
+// its expected checksum.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// hashes maps the supported checksum algorithms to their constructors.
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// sriStrength ranks the algorithms Subresource Integrity allows, from
+// weakest to strongest.
+var sriStrength = []string{"sha256", "sha384", "sha512"}
+
+// checksum is the expected digest of a downloaded file.
+type checksum struct {
+	algo string
+	sum  []byte
+	// sri is set for checksums given as Subresource Integrity metadata,
+	// so they are shown the same way.
+	sri bool
+}
+
+// format shows sum in the form the checksum was given in.
+func (c *checksum) format(sum []byte) string {
+	if c.sri {
+		return c.algo + "-" + base64.StdEncoding.EncodeToString(sum)
+	}
+	return fmt.Sprintf("%s:%x", c.algo, sum)
+}
+
+// parseChecksum parses an "algo:hex" checksum such as "sha256:9f86d0...".
+func parseChecksum(s string) (*checksum, error) {
+	algo, digest, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("checksum %q must be in the form algo:hex", s)
+	}
+	algo = strings.ToLower(algo)
+	newHash, ok := hashes[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s checksum: %w", algo, err)
+	}
+	if len(sum) != newHash().Size() {
+		return nil, fmt.Errorf("%s checksum must be %d hex characters", algo, newHash().Size()*2)
+	}
+	return &checksum{algo: algo, sum: sum}, nil
+}
+
+// parseIntegrity parses Subresource Integrity metadata such as
+// "sha384-oqVuAfXRKap7fdgcCY5uykM6+R9GqQ8K/uxy9rx7HNQlGYl1kPzQho1wx4JwY8wC",
+// as found in lockfiles and HTML. Of several hashes, the strongest is
+// used, as browsers do; algorithms other than SHA-2 are ignored.
+func parseIntegrity(s string) (*checksum, error) {
+	var best *checksum
+	rank := -1
+	for _, token := range strings.Fields(s) {
+		// Options after a "?" have no defined meaning yet
+		token, _, _ = strings.Cut(token, "?")
+		algo, digest, ok := strings.Cut(token, "-")
+		if !ok {
+			return nil, fmt.Errorf("integrity %q must be in the form algo-base64", token)
+		}
+		r := slices.Index(sriStrength, strings.ToLower(algo))
+		if r < 0 {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s integrity: %w", algo, err)
+		}
+		c := &checksum{algo: sriStrength[r], sum: sum, sri: true}
+		if len(sum) != hashes[c.algo]().Size() {
+			return nil, fmt.Errorf("%s integrity must be %d bytes", c.algo, hashes[c.algo]().Size())
+		}
+		switch {
+		case r > rank:
+			best, rank = c, r
+		case r == rank:
+			return nil, fmt.Errorf("more than one %s hash in integrity %q isn't supported", c.algo, s)
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no sha256, sha384, or sha512 hash in integrity %q", s)
+	}
+	return best, nil
+}
+
+// algoForLength picks the algorithm of a hex digest of n characters, for
+// checksum files that don't name it.
+func algoForLength(n int) (string, bool) {
+	for algo, newHash := range hashes {
+		if newHash().Size()*2 == n {
+			return algo, true
+		}
+	}
+	return "", false
+}
+
+// checksumList holds the checksums of a checksum file, by filename.
+type checksumList map[string]*checksum
+
+// parseChecksumList parses a checksum file in the format of sha256sum and
+// friends ("<hex>  <name>", with "*" before the name in binary mode) or
+// of BSD tools ("SHA256 (<name>) = <hex>").
+func parseChecksumList(r io.Reader) (checksumList, error) {
+	list := make(checksumList)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var algo, name, digest string
+		if tag, rest, ok := strings.Cut(text, " ("); ok && strings.Contains(rest, ") = ") {
+			i := strings.LastIndex(rest, ") = ")
+			algo, name, digest = strings.ToLower(tag), rest[:i], rest[i+len(") = "):]
+		} else {
+			var ok bool
+			if digest, name, ok = strings.Cut(text, " "); !ok {
+				return nil, fmt.Errorf("line %d: expected a checksum and a filename", line)
+			}
+			name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+			if algo, ok = algoForLength(len(digest)); !ok {
+				return nil, fmt.Errorf("line %d: can't tell the algorithm of a %d character checksum", line, len(digest))
+			}
+		}
+
+		c, err := parseChecksum(algo + ":" + digest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		list[filepath.ToSlash(name)] = c
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// lookup returns the checksum for filename, falling back to an entry for
+// its base name, since checksum files often list names without the
+// directory they were generated in.
+func (l checksumList) lookup(filename string) (*checksum, bool) {
+	name := filepath.ToSlash(filename)
+	if c, ok := l[name]; ok {
+		return c, true
+	}
+	if c, ok := l["./"+name]; ok {
+		return c, true
+	}
+	// Only go by the base name when it's unambiguous
+	var found *checksum
+	for entry, c := range l {
+		if path.Base(entry) == path.Base(name) {
+			if found != nil {
+				return nil, false
+			}
+			found = c
+		}
+	}
+	return found, found != nil
+}
+
+// readChecksumList reads a checksum file from a local path or an HTTP(S)
+// URI.
+func readChecksumList(src string) (checksumList, error) {
+	var r io.Reader
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := httpClient.Get(src)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch checksum file: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("non-2xx status (%d) for checksum file %s", resp.StatusCode, src)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open checksum file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	list, err := parseChecksumList(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum file %s: %w", src, err)
+	}
+	return list, nil
+}
+
+// verify hashes the file at path and compares it to the checksum.
+func (c *checksum) verify(path string) error {
+	return c.verifyQuietly(path, "Verifying checksum")
+}
+
+// verifyQuietly is verify, showing progress in a bar labeled
+// description, or none if description is empty.
+func (c *checksum) verifyQuietly(path, description string) error {
+	h := hashes[c.algo]()
+	if err := hashFile(path, description, h); err != nil {
+		return err
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, c.sum) {
+		return fmt.Errorf("%w: expected %s, got %s", errChecksumMismatch, c.format(c.sum), c.format(got))
+	}
+	return nil
+}
+
+// fetchAndVerify fetches the download and checks it against the expected
+// checksum, if there is one. A mismatch is usually transient corruption
+// from a bad proxy, so the download starts over from scratch up to
+// retries times before giving up. A file that still doesn't match is
+// removed.
+func (dl *download) fetchAndVerify(ctx context.Context, retries int) error {
+	for attempt := 0; ; {
+		if err := dl.Fetch(ctx); err != nil {
+			return err
+		}
+		err := dl.verify()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errStalePieces) {
+			// Only the pieces reused are in doubt, and aren't again
+			fmt.Fprintf(os.Stderr, "%v\nDownloading it again from the start...\n", err)
+			dl.restart()
+			continue
+		}
+		if !errors.Is(err, errChecksumMismatch) {
+			return err
+		}
+
+		dl.restart()
+		if attempt >= retries {
+			return err
+		}
+		attempt++
+		fmt.Fprintf(os.Stderr, "%v\nRetrying download (%d of %d)...\n", err, attempt, retries)
+	}
+}
+
+// verify checks the downloaded file against the expected checksum or,
+// without one, the ETag of an S3 compatible server. A file made partly of
+// reused pieces is first checked against the Metalink they came from.
+func (dl *download) verify() error {
+	if sum := dl.pieceSum; sum != nil {
+		dl.pieceSum = nil
+		if err := sum.verifyQuietly(dl.outputPath(), "Verifying reused pieces"); err != nil {
+			return fmt.Errorf("%w: %v", errStalePieces, err)
+		}
+	}
+	switch {
+	case dl.checksum != nil:
+		if err := dl.checksum.verify(dl.outputPath()); err != nil {
+			return err
+		}
+		fmt.Println("Checksum verified.")
+	case dl.s3ETag != nil:
+		return dl.s3ETag.verify(dl.outputPath(), dl.filesize)
+	}
+	return nil
+}
+
+// restart discards the downloaded file and any progress, so the next
+// Fetch starts from the beginning.
+func (dl *download) restart() {
+	_ = os.Remove(dl.outputPath())
+	dl.removeProgress()
+	dl.reset()
+}
+
+// reset clears what a Fetch left behind in memory, so the download can
+// be fetched again.
+func (dl *download) reset() {
+	dl.parts = nil
+	dl.completed = nil
+	dl.resumed = 0
+	dl.written.Store(0)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// completionFlag describes a command line flag for completion scripts.
+type completionFlag struct {
+	name   string
+	usage  string
+	isBool bool
+	// isFile is set for flags taking a local path.
+	isFile bool
+	// values lists the valid values of the flag when they are known.
+	values []string
+}
+
+// runCompletion writes the completion script for the shell in args.
+func runCompletion(args []string) error {
+	const shells = "bash, fish, powershell, zsh"
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dl completion <shell> (one of %s)", shells)
+	}
+	var write func(w io.Writer, flags []completionFlag)
+	switch args[0] {
+	case "bash":
+		write = writeBashCompletion
+	case "zsh":
+		write = writeZshCompletion
+	case "fish":
+		write = writeFishCompletion
+	case "powershell":
+		write = writePowerShellCompletion
+	default:
+		return fmt.Errorf("unknown shell %q (valid: %s)", args[0], shells)
+	}
+	write(os.Stdout, completionFlags())
+	return nil
+}
+
+// completionFlags lists the flags defined on the command line, in
+// lexical order.
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		_, usage := flag.UnquoteUsage(f)
+		cf := completionFlag{name: f.Name, usage: usage}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			cf.isBool = true
+		}
+		if f.Name == "filename" || f.Name == "tls-keylog" {
+			cf.isFile = true
+		}
+		switch f.Name {
+		case "scheduler":
+			cf.values = strings.Split(schedulerNames(), ", ")
+		case "coalesce":
+			cf.values = coalesceModes
+		case "strategy":
+			cf.values = strategies
+		case "units":
+			cf.values = []string{"binary", "si"}
+		}
+		flags = append(flags, cf)
+	})
+	return flags
+}
+
+func subcommandNames() string {
+	var names []string
+	for _, cmd := range subcommands() {
+		names = append(names, cmd.name)
+	}
+	return strings.Join(names, " ")
+}
+
+func writeBashCompletion(w io.Writer, flags []completionFlag) {
+	var all, files, valued []string
+	for _, f := range flags {
+		all = append(all, "-"+f.name)
+		switch {
+		case f.isFile:
+			files = append(files, "-"+f.name)
+		case !f.isBool && f.values == nil:
+			valued = append(valued, "-"+f.name)
+		}
+	}
+
+	fmt.Fprintf(w, `# bash completion for dl
+_dl() {
+    local cur prev
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+    if [[ ${COMP_WORDS[1]} == completion ]]; then
+        [[ $COMP_CWORD -eq 2 ]] && COMPREPLY=($(compgen -W "bash fish powershell zsh" -- "$cur"))
+        return
+    fi
+
+    case "$prev" in
+`)
+	for _, f := range flags {
+		if f.values != nil {
+			fmt.Fprintf(w, "    -%s)\n        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n        return\n        ;;\n", f.name, strings.Join(f.values, " "))
+		}
+	}
+	fmt.Fprintf(w, `    %s)
+        COMPREPLY=($(compgen -f -- "$cur"))
+        return
+        ;;
+    %s)
+        return
+        ;;
+    esac
+
+    if [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    elif [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur") $(compgen -f -- "$cur"))
+    else
+        COMPREPLY=($(compgen -f -- "$cur"))
+    fi
+}
+complete -o filenames -F _dl dl
+`, strings.Join(files, "|"), strings.Join(valued, "|"), strings.Join(all, " "), subcommandNames())
+}
+
+func writeZshCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprint(w, "#compdef dl\n\n_dl() {\n    local state\n\n    if [[ $words[2] == completion ]]; then\n        _arguments '2:shell:(bash fish powershell zsh)'\n        return\n    fi\n\n    _arguments \\\n")
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, zshEscape(f.usage))
+		switch {
+		case f.values != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, strings.Join(f.values, " "))
+		case f.isFile:
+			spec += fmt.Sprintf(":%s:_files", f.name)
+		case !f.isBool:
+			spec += fmt.Sprintf(":%s: ", f.name)
+		}
+		fmt.Fprintf(w, "        '%s' \\\n", strings.ReplaceAll(spec, "'", `'\''`))
+	}
+	fmt.Fprintf(w, `        '1: :->first' \
+        '*:file or URI:_files'
+
+    if [[ $state == first ]]; then
+        _alternative 'commands:command:(%s)' 'files:file or URI:_files'
+    fi
+}
+
+if [[ $funcstack[1] == _dl ]]; then
+    _dl "$@"
+else
+    compdef _dl dl
+fi
+`, subcommandNames())
+}
+
+// zshEscape escapes the characters _arguments treats specially in a
+// description.
+func zshEscape(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+func writeFishCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "# fish completion for dl")
+	for _, cmd := range subcommands() {
+		fmt.Fprintf(w, "complete -c dl -n __fish_use_subcommand -a %s -d %s\n", cmd.name, fishQuote(cmd.summary))
+	}
+	fmt.Fprintln(w, "complete -c dl -n '__fish_seen_subcommand_from completion' -f -a 'bash fish powershell zsh'")
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c dl -o %s -d %s", f.name, fishQuote(f.usage))
+		switch {
+		case f.values != nil:
+			line += fmt.Sprintf(" -x -a %s", fishQuote(strings.Join(f.values, " ")))
+		case f.isFile:
+			line += " -r -F"
+		case !f.isBool:
+			line += " -x"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func writePowerShellCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprint(w, `# PowerShell completion for dl
+Register-ArgumentCompleter -Native -CommandName dl -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    $flags = @(
+`)
+	for _, f := range flags {
+		fmt.Fprintf(w, "        [pscustomobject]@{ Name = %s; Description = %s }\n", psQuote("-"+f.name), psQuote(f.usage))
+	}
+	fmt.Fprint(w, "    )\n    $commands = @(\n")
+	for _, cmd := range subcommands() {
+		fmt.Fprintf(w, "        [pscustomobject]@{ Name = %s; Description = %s }\n", psQuote(cmd.name), psQuote(cmd.summary))
+	}
+	fmt.Fprint(w, `    )
+
+    if ($words.Count -ge 2 -and $words[1] -eq 'completion') {
+        $candidates = @('bash', 'fish', 'powershell', 'zsh') | ForEach-Object { [pscustomobject]@{ Name = $_; Description = $_ } }
+    } elseif ($wordToComplete -like '-*') {
+        $candidates = $flags
+    } else {
+        $candidates = $commands
+    }
+    $candidates | Where-Object { $_.Name -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_.Name, $_.Name, 'ParameterValue', $_.Description)
+    }
+}
+`)
+}
+
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
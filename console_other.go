@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// enableANSI reports whether f is a terminal, which is taken to
+// understand ANSI escape sequences. Files and pipes would get them
+// literally.
+func enableANSI(f *os.File) bool {
+	return isTerminal(f)
+}
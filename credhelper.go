@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialRefreshMargin is how long before they expire credentials
+// are fetched again, so a request isn't sent with a token about to lapse.
+const credentialRefreshMargin = time.Minute
+
+// credentialSource supplies the Authorization header of requests, such
+// as a credential helper or a bearer token command.
+type credentialSource interface {
+	// authorization returns the Authorization header for a request to
+	// u, or an empty string if there is none to send.
+	authorization(u *url.URL) (string, error)
+	// reject reports that the server at u refused authorization, so the
+	// next request gets a new one.
+	reject(u *url.URL, authorization string)
+}
+
+// credentialHelper gets credentials for each origin from a command
+// speaking git's credential helper protocol, so secrets stay with the
+// helper rather than in dl's configuration. Credentials are kept until
+// they expire or a server rejects them.
+type credentialHelper struct {
+	command string
+
+	mu    sync.Mutex
+	cache map[string]*credential
+}
+
+// credential is what a helper returned for an origin.
+type credential struct {
+	// authorization is the Authorization header to send, or empty if
+	// the helper has nothing for the origin.
+	authorization string
+	// expires, if set, is when the credential stops working.
+	expires time.Time
+	// attrs are the helper's answer, passed back to it on rejection.
+	attrs []string
+}
+
+func newCredentialHelper(command string) *credentialHelper {
+	return &credentialHelper{command: command, cache: make(map[string]*credential)}
+}
+
+// authorization returns the Authorization header for a request to u, or
+// an empty string if the helper has no credentials for its origin.
+func (h *credentialHelper) authorization(u *url.URL) (string, error) {
+	origin := u.Scheme + "://" + u.Host
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.cache[origin]; ok && (c.expires.IsZero() || time.Until(c.expires) > credentialRefreshMargin) {
+		return c.authorization, nil
+	}
+	out, err := h.run("get", credentialQuery(u))
+	if err != nil {
+		return "", err
+	}
+	c, err := parseCredential(out)
+	if err != nil {
+		return "", err
+	}
+	h.cache[origin] = c
+	return c.authorization, nil
+}
+
+// reject tells the helper the credentials for u's origin didn't work, and
+// forgets them so the next request asks for new ones.
+func (h *credentialHelper) reject(u *url.URL, authorization string) {
+	origin := u.Scheme + "://" + u.Host
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.cache[origin]
+	if !ok || c.authorization != authorization {
+		// Already replaced by another request's rejection
+		return
+	}
+	delete(h.cache, origin)
+	// As with git, whether the helper could erase them doesn't matter
+	_, _ = h.run("erase", credentialQuery(u)+strings.Join(c.attrs, ""))
+}
+
+// run runs the helper for action with input, returning its output. The
+// command is run by the shell, so it may have arguments of its own.
+func (h *credentialHelper) run(action, input string) ([]byte, error) {
+	cmd := shellCommand(h.command + " " + action)
+	cmd.Stdin = strings.NewReader(input + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %q failed: %w", h.command, err)
+	}
+	return out, nil
+}
+
+// shellCommand returns a command that runs line with the shell.
+func shellCommand(line string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", line)
+	}
+	return exec.Command("/bin/sh", "-c", line)
+}
+
+// credentialQuery describes the origin of u to a helper.
+func credentialQuery(u *url.URL) string {
+	return fmt.Sprintf("capability[]=authtype\nprotocol=%s\nhost=%s\n", u.Scheme, u.Host)
+}
+
+// parseCredential parses a helper's answer: username and password for
+// basic authentication, or an authtype and credential, such as Bearer and
+// a token, with an optional password_expiry_utc in Unix seconds.
+func parseCredential(out []byte) (*credential, error) {
+	fields := make(map[string]string)
+	c := &credential{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("credential helper answered %q, which isn't key=value", line)
+		}
+		fields[key] = value
+		c.attrs = append(c.attrs, line+"\n")
+	}
+	if fields["quit"] == "1" || fields["quit"] == "true" {
+		return nil, errors.New("credential helper quit")
+	}
+	switch {
+	case fields["authtype"] != "" && fields["credential"] != "":
+		c.authorization = fields["authtype"] + " " + fields["credential"]
+	case fields["password"] != "":
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(fields["username"]+":"+fields["password"]))
+	}
+	if expiry := fields["password_expiry_utc"]; expiry != "" {
+		secs, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("credential helper answered an invalid password_expiry_utc %q", expiry)
+		}
+		c.expires = time.Unix(secs, 0)
+	}
+	return c, nil
+}
+
+// credentialTransport adds the credentials of a source to each request,
+// including those made while following redirects, that doesn't carry an
+// Authorization header already. A request the server rejects with 401 is
+// sent once more with new credentials.
+type credentialTransport struct {
+	source credentialSource
+	// sameOrigin keeps the credentials to the origin a request was first
+	// made to, not sending them where redirects lead, as with -header.
+	sameOrigin bool
+	next       http.RoundTripper
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+	if t.sameOrigin {
+		first := req
+		for first.Response != nil {
+			first = first.Response.Request
+		}
+		if !sameOrigin(first.URL, req.URL) {
+			return t.next.RoundTrip(req)
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		auth, err := t.source.authorization(req.URL)
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		if auth == "" {
+			return t.next.RoundTrip(req)
+		}
+		authed := req.Clone(req.Context())
+		authed.Header.Set("Authorization", auth)
+		resp, err := t.next.RoundTrip(authed)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		t.source.reject(req.URL, auth)
+		// Requests with a body can't be sent again
+		if attempt > 1 || req.Body != nil && req.Body != http.NoBody {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
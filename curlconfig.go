@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// curlConfig is what dl understands of a curl config file, as read by
+// curl -K: the URLs to fetch, where to save them, and request settings.
+type curlConfig struct {
+	urls []string
+	// outputs maps URLs to the name to save them under, from the output
+	// options paired with them in order, as curl pairs them.
+	outputs map[string]string
+	headers []string
+	user    string
+}
+
+// curlShort maps the short options dl understands to their long names.
+var curlShort = map[string]string{
+	"o": "output", "H": "header", "A": "user-agent", "u": "user",
+	"e": "referer", "L": "location", "O": "remote-name", "f": "fail",
+	"s": "silent", "S": "show-error", "#": "progress-bar",
+}
+
+// curlFlags are the options that take no value. They ask for what dl
+// does anyway or only change how curl reports, so they are ignored.
+var curlFlags = map[string]bool{
+	"location": true, "remote-name": true, "remote-name-all": true,
+	"create-dirs": true, "fail": true, "silent": true, "show-error": true,
+	"progress-bar": true, "compressed": true,
+}
+
+// readCurlConfig reads the curl config file at path, or standard input
+// for "-".
+func readCurlConfig(path string) (*curlConfig, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open curl config: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	cfg, err := parseCurlConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid curl config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// parseCurlConfig parses the subset of curl's config format covering
+// url, output, header, user-agent, referer, and user, along with options
+// that don't change what is downloaded. As in curl, long options may be
+// written with or without their dashes, short ones need a dash, and the
+// value follows after whitespace, "=", or ":", in double quotes if it
+// contains spaces.
+func parseCurlConfig(r io.Reader) (*curlConfig, error) {
+	cfg := &curlConfig{outputs: make(map[string]string)}
+	var outputs []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		end := strings.IndexAny(line, " \t=:")
+		if end < 0 {
+			end = len(line)
+		}
+		name, rest := line[:end], line[end:]
+		if long, ok := strings.CutPrefix(name, "--"); ok {
+			name = long
+		} else if short, ok := strings.CutPrefix(name, "-"); ok {
+			if name, ok = curlShort[short]; !ok {
+				return nil, fmt.Errorf("line %d: unsupported option -%s", n, short)
+			}
+		}
+		if curlFlags[name] {
+			continue
+		}
+
+		rest = strings.TrimLeft(rest, " \t")
+		if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+			rest = strings.TrimLeft(rest[1:], " \t")
+		}
+		value, err := curlValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		switch name {
+		case "url":
+			cfg.urls = append(cfg.urls, value)
+		case "output":
+			if value == "-" {
+				return nil, fmt.Errorf("line %d: dl can't write to standard output", n)
+			}
+			outputs = append(outputs, value)
+		case "header":
+			cfg.headers = append(cfg.headers, value)
+		case "user-agent":
+			cfg.headers = append(cfg.headers, "User-Agent: "+value)
+		case "referer":
+			cfg.headers = append(cfg.headers, "Referer: "+value)
+		case "user":
+			cfg.user = value
+		default:
+			return nil, fmt.Errorf("line %d: unsupported option %s", n, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(outputs) > len(cfg.urls) {
+		return nil, fmt.Errorf("%d outputs for %d URLs", len(outputs), len(cfg.urls))
+	}
+	for i, out := range outputs {
+		cfg.outputs[cfg.urls[i]] = out
+	}
+	return cfg, nil
+}
+
+// curlValue returns the value at the start of s: up to the first
+// whitespace or, in double quotes, with backslash escapes.
+func curlValue(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.IndexAny(s, " \t"); i >= 0 {
+			s = s[:i]
+		}
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 'v':
+				b.WriteByte('\v')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted value")
+}
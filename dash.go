@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mpd is the part of a DASH manifest (Media Presentation Description)
+// needed to list the segments of a stream.
+type mpd struct {
+	Type     string      `xml:"type,attr"`
+	Duration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL  string      `xml:"BaseURL"`
+	Periods  []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+}
+
+type mpdSegmentTemplate struct {
+	Initialization string `xml:"initialization,attr"`
+	Media          string `xml:"media,attr"`
+	StartNumber    *int64 `xml:"startNumber,attr"`
+	Timescale      int64  `xml:"timescale,attr"`
+	Duration       int64  `xml:"duration,attr"`
+	Timeline       []mpdS `xml:"SegmentTimeline>S"`
+}
+
+// mpdS is an entry of a segment timeline: r+1 segments of duration d,
+// the first starting at t if given.
+type mpdS struct {
+	T *int64 `xml:"t,attr"`
+	D int64  `xml:"d,attr"`
+	R int64  `xml:"r,attr"`
+}
+
+type mpdSegmentList struct {
+	Initialization *struct {
+		SourceURL string `xml:"sourceURL,attr"`
+		Range     string `xml:"range,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// dashExtensions picks the extension of a saved stream by its MIME type.
+var dashExtensions = map[string]string{
+	"video/mp4":  ".mp4",
+	"audio/mp4":  ".m4a",
+	"video/webm": ".webm",
+	"audio/webm": ".weba",
+}
+
+// templateVar matches the identifiers of a segment template, with their
+// optional printf width, and escaped dollar signs.
+var templateVar = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(?:%0(\d+)d)?\$|\$\$`)
+
+// parseDASH parses the DASH manifest data, fetched from base, into the
+// stream of its highest bandwidth video representation, or of its first
+// adaptation set if it has no video. Only static manifests with a single
+// period are supported.
+func parseDASH(base *url.URL, data []byte) (*streamManifest, error) {
+	var doc mpd
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Type == "dynamic" {
+		return nil, errors.New("live DASH streams aren't supported")
+	}
+	if len(doc.Periods) != 1 {
+		return nil, fmt.Errorf("manifests with %d periods aren't supported", len(doc.Periods))
+	}
+	period := doc.Periods[0]
+	if len(period.AdaptationSets) == 0 {
+		return nil, errors.New("no adaptation sets")
+	}
+	set := period.AdaptationSets[0]
+	for _, s := range period.AdaptationSets {
+		if s.ContentType == "video" || strings.HasPrefix(s.MimeType, "video/") {
+			set = s
+			break
+		}
+	}
+	if len(set.Representations) == 0 {
+		return nil, errors.New("no representations")
+	}
+	rep := set.Representations[0]
+	for _, r := range set.Representations[1:] {
+		if r.Bandwidth > rep.Bandwidth {
+			rep = r
+		}
+	}
+
+	// Each level's BaseURL is relative to the one above
+	for _, ref := range []string{doc.BaseURL, period.BaseURL, set.BaseURL, rep.BaseURL} {
+		if ref = strings.TrimSpace(ref); ref == "" {
+			continue
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return nil, err
+		}
+		base = u
+	}
+	durationAttr := period.Duration
+	if durationAttr == "" {
+		durationAttr = doc.Duration
+	}
+	var duration time.Duration
+	if durationAttr != "" {
+		var err error
+		if duration, err = parseISODuration(durationAttr); err != nil {
+			return nil, err
+		}
+	}
+
+	mime := rep.MimeType
+	if mime == "" {
+		mime = set.MimeType
+	}
+	m := &streamManifest{kind: "DASH", uri: base.String(), ext: dashExtensions[mime]}
+	if m.ext == "" {
+		if m.ext = extensionForType(mime); m.ext == "" {
+			m.ext = ".mp4"
+		}
+	}
+
+	tmpl, list := rep.SegmentTemplate, rep.SegmentList
+	if tmpl == nil && list == nil {
+		tmpl, list = set.SegmentTemplate, set.SegmentList
+	}
+	var err error
+	switch {
+	case tmpl != nil:
+		err = m.addTemplateSegments(base, tmpl, rep, duration)
+	case list != nil:
+		err = m.addListSegments(base, list)
+	default:
+		// The representation is a single file
+		m.segments = []segment{{uri: base.String()}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(m.segments) == 0 {
+		return nil, errors.New("no segments")
+	}
+	return m, nil
+}
+
+// addTemplateSegments lists the segments of a SegmentTemplate, from its
+// timeline or, without one, from the segment and period durations.
+func (m *streamManifest) addTemplateSegments(base *url.URL, tmpl *mpdSegmentTemplate, rep mpdRepresentation, duration time.Duration) error {
+	timescale := tmpl.Timescale
+	if timescale <= 0 {
+		timescale = 1
+	}
+	number := int64(1)
+	if tmpl.StartNumber != nil {
+		number = *tmpl.StartNumber
+	}
+	add := func(ref string, number, t int64) error {
+		u, err := base.Parse(expandTemplate(ref, rep, number, t))
+		if err != nil {
+			return err
+		}
+		if len(m.segments) >= maxSegments {
+			return errors.New("too many segments")
+		}
+		m.segments = append(m.segments, segment{uri: u.String(), seq: int64(len(m.segments))})
+		return nil
+	}
+
+	if tmpl.Initialization != "" {
+		u, err := base.Parse(expandTemplate(tmpl.Initialization, rep, 0, 0))
+		if err != nil {
+			return err
+		}
+		m.init = &segment{uri: u.String(), seq: -1}
+	}
+	if tmpl.Media == "" {
+		return errors.New("segment template without media")
+	}
+	periodEnd := int64(math.Round(duration.Seconds() * float64(timescale)))
+
+	if len(tmpl.Timeline) > 0 {
+		var t int64
+		for i, s := range tmpl.Timeline {
+			if s.T != nil {
+				t = *s.T
+			}
+			if s.D <= 0 {
+				return errors.New("segment timeline with an invalid duration")
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// Repeated until the next entry, or the end of the period
+				end := periodEnd
+				if i+1 < len(tmpl.Timeline) && tmpl.Timeline[i+1].T != nil {
+					end = *tmpl.Timeline[i+1].T
+				}
+				if end <= t {
+					return errors.New("segment timeline repeats without an end")
+				}
+				repeat = (end-t+s.D-1)/s.D - 1
+			}
+			for range repeat + 1 {
+				if err := add(tmpl.Media, number, t); err != nil {
+					return err
+				}
+				t += s.D
+				number++
+			}
+		}
+		return nil
+	}
+
+	if tmpl.Duration <= 0 || periodEnd <= 0 {
+		return errors.New("can't tell how many segments there are")
+	}
+	count := (periodEnd + tmpl.Duration - 1) / tmpl.Duration
+	for i := range count {
+		if err := add(tmpl.Media, number+i, i*tmpl.Duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addListSegments lists the segments of a SegmentList.
+func (m *streamManifest) addListSegments(base *url.URL, list *mpdSegmentList) error {
+	toSegment := func(ref, rng string, seq int64) (segment, error) {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return segment{}, err
+		}
+		s := segment{uri: u.String(), seq: seq}
+		if rng != "" {
+			first, last, ok := strings.Cut(rng, "-")
+			start, err1 := strconv.ParseUint(first, 10, 64)
+			end, err2 := strconv.ParseUint(last, 10, 64)
+			if !ok || err1 != nil || err2 != nil || end < start {
+				return segment{}, fmt.Errorf("invalid range %q", rng)
+			}
+			s.rng = &byteRange{Start: start, End: end}
+		}
+		return s, nil
+	}
+
+	if list.Initialization != nil {
+		s, err := toSegment(list.Initialization.SourceURL, list.Initialization.Range, -1)
+		if err != nil {
+			return err
+		}
+		m.init = &s
+	}
+	for i, su := range list.SegmentURLs {
+		s, err := toSegment(su.Media, su.MediaRange, int64(i))
+		if err != nil {
+			return err
+		}
+		m.segments = append(m.segments, s)
+	}
+	return nil
+}
+
+// expandTemplate fills in the identifiers of a segment template.
+func expandTemplate(tmpl string, rep mpdRepresentation, number, t int64) string {
+	return templateVar.ReplaceAllStringFunc(tmpl, func(v string) string {
+		if v == "$$" {
+			return "$"
+		}
+		match := templateVar.FindStringSubmatch(v)
+		var n int64
+		switch match[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			n = number
+		case "Bandwidth":
+			n = rep.Bandwidth
+		case "Time":
+			n = t
+		}
+		if match[2] != "" {
+			width, _ := strconv.Atoi(match[2])
+			return fmt.Sprintf("%0*d", width, n)
+		}
+		return strconv.FormatInt(n, 10)
+	})
+}
+
+// isoDuration matches the ISO 8601 durations of DASH manifests, such as
+// PT1H2M3.5S.
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses an ISO 8601 duration of days and less.
+func parseISODuration(s string) (time.Duration, error) {
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var secs float64
+	for i, unit := range []float64{24 * 3600, 3600, 60, 1} {
+		if m[i+1] != "" {
+			v, _ := strconv.ParseFloat(m[i+1], 64)
+			secs += v * unit
+		}
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// metalinkMaxSize bounds the Metalink documents read for piece hashes,
+// which for a large file list many thousands of them.
+const metalinkMaxSize = 16 << 20
+
+// metalinkType is the media type of Metalink 4 documents.
+const metalinkType = "application/metalink4+xml"
+
+// errStalePieces is returned when a file completed from reused pieces
+// doesn't match the Metalink they were checked against, which must then
+// describe an earlier version of the file.
+var errStalePieces = errors.New("the file doesn't match the Metalink its pieces were reused with")
+
+// reusePieces salvages the partial file of a download whose remote file
+// has changed since, using the hashes of the new file's pieces from a
+// Metalink, given with -piece-hashes or linked from the response as RFC
+// 6249 describes. The pieces already downloaded that still match, such
+// as all but those around a small edit, are kept, so only the rest is
+// downloaded. It reports whether there is anything to resume.
+func (dl *download) reusePieces(state progressState) bool {
+	src := dl.pieceHashes
+	if src == "" {
+		src = linkedMetalink(dl.header, dl.uri)
+	}
+	// Pieces are of the whole file, written into the output file
+	if src == "" || state.PartFiles || state.Offset != 0 || dl.remoteOffset() != 0 {
+		return false
+	}
+	file, err := dl.readPieces(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot reuse the partial file: %v\n", err)
+		return false
+	}
+	f, err := os.Open(dl.outputPath())
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	pieces := file.Pieces
+	downloaded := mergeRanges(state.Completed)
+	buf := make([]byte, pieces.Length)
+	var kept []byteRange
+	for i, want := range pieces.Hashes {
+		r := byteRange{Start: uint64(i) * uint64(pieces.Length)}
+		r.End = min(r.Start+uint64(pieces.Length), dl.filesize) - 1
+		if !rangeCovered(downloaded, r) {
+			continue
+		}
+		n, err := f.ReadAt(buf[:r.End-r.Start+1], int64(r.Start))
+		if err != nil && err != io.EOF || uint64(n) != r.End-r.Start+1 {
+			continue
+		}
+		h := hashes[pieces.Type]()
+		h.Write(buf[:n])
+		if hex.EncodeToString(h.Sum(nil)) == strings.ToLower(strings.TrimSpace(want)) {
+			kept = append(kept, r)
+		}
+	}
+	if len(kept) == 0 {
+		return false
+	}
+	dl.completed = mergeRanges(kept)
+	if algo := metalinkHashType(file.Hash.Type); dl.checksum == nil && hashes[algo] != nil {
+		if sum, err := hex.DecodeString(strings.TrimSpace(file.Hash.Value)); err == nil {
+			dl.pieceSum = &checksum{algo: algo, sum: sum}
+		}
+	}
+	fmt.Printf("Remote file changed since the last attempt; reusing the %d of its %d pieces already downloaded that still match.\n", len(kept), len(pieces.Hashes))
+	return true
+}
+
+// rangeCovered reports whether r lies within one of ranges, which are
+// merged.
+func rangeCovered(ranges []byteRange, r byteRange) bool {
+	for _, c := range ranges {
+		if c.Start <= r.Start && r.End <= c.End {
+			return true
+		}
+	}
+	return false
+}
+
+// readPieces reads the entry for dl's file from the Metalink at src, a
+// path or URI, checking that it has piece hashes for a file of its size.
+func (dl *download) readPieces(src string) (*metalinkFile, error) {
+	var r io.Reader
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		req, err := http.NewRequest("GET", src, nil)
+		if err != nil {
+			return nil, err
+		}
+		dl.setHeaders(req)
+		resp, err := dl.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch Metalink: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("non-2xx status (%d) for Metalink %s", resp.StatusCode, src)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open Metalink: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var doc metalink
+	if err := xml.NewDecoder(io.LimitReader(r, metalinkMaxSize)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid Metalink %s: %w", src, err)
+	}
+	// The file itself, if the Metalink describes several
+	var file *metalinkFile
+	for i, f := range doc.Files {
+		if len(doc.Files) == 1 || path.Base(f.Name) == filepath.Base(dl.filename) {
+			file = &doc.Files[i]
+			break
+		}
+	}
+	switch {
+	case file == nil:
+		return nil, fmt.Errorf("%s doesn't describe %s", src, filepath.Base(dl.filename))
+	case file.Pieces == nil:
+		return nil, fmt.Errorf("%s has no piece hashes", src)
+	case file.Size != 0 && file.Size != dl.filesize:
+		return nil, fmt.Errorf("%s describes a file of %d bytes, not %d", src, file.Size, dl.filesize)
+	}
+	pieces := file.Pieces
+	algo := metalinkHashType(pieces.Type)
+	if _, ok := hashes[algo]; !ok {
+		return nil, fmt.Errorf("unsupported piece hash %q in %s", pieces.Type, src)
+	}
+	pieces.Type = algo
+	if pieces.Length <= 0 || uint64(len(pieces.Hashes)) != (dl.filesize+uint64(pieces.Length)-1)/uint64(pieces.Length) {
+		return nil, fmt.Errorf("the pieces in %s don't cover a file of %d bytes", src, dl.filesize)
+	}
+	return file, nil
+}
+
+// metalinkHashType returns the checksum algorithm of a Metalink hash type:
+// Metalink names them as sha-256, where checksums say sha256.
+func metalinkHashType(typ string) string {
+	return strings.ReplaceAll(strings.ToLower(typ), "-", "")
+}
+
+// linkedMetalink returns the Metalink a response's Link header points to
+// as describing the file at uri, or "" if there is none.
+func linkedMetalink(header http.Header, uri string) string {
+	base, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			// The parameters read as those of a media type
+			_, attrs, err := mime.ParseMediaType("link;" + params)
+			if err != nil || attrs["type"] != metalinkType || !hasToken(attrs["rel"], "describedby") {
+				continue
+			}
+			u, err := base.Parse(target[1 : len(target)-1])
+			if err != nil {
+				continue
+			}
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// hasToken reports whether the space separated list s has token, ignoring
+// case.
+func hasToken(s, token string) bool {
+	for _, t := range strings.Fields(s) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
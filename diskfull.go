@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// exitDiskFull is the exit status when a download stops because the disk
+// is full, so scripts can tell it apart from other failures and resume
+// once they have freed up space.
+const exitDiskFull = 3
+
+// isDiskFull reports whether err comes from running out of disk space.
+func isDiskFull(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, e := range diskFullErrnos {
+		if errno == e {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForSpace asks the user to free up disk space and waits for them to
+// press Enter. It reports false if there is no one to ask, because
+// standard input is closed or isn't a terminal.
+func waitForSpace() bool {
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+	fmt.Fprint(os.Stderr, "Free up some space, then press Enter to continue.")
+	_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return err == nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// diskFullErrnos are the errors for a full disk.
+var diskFullErrnos = []syscall.Errno{syscall.ENOSPC, syscall.EDQUOT}
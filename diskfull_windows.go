@@ -0,0 +1,7 @@
+package main
+
+import "syscall"
+
+// diskFullErrnos are the errors for a full disk: ERROR_HANDLE_DISK_FULL
+// and ERROR_DISK_FULL.
+var diskFullErrnos = []syscall.Errno{39, 112}
@@ -0,0 +1,213 @@
+// Package dltest serves files the way the servers dl meets in the wild
+// do, with or without range support, slowly, cutting connections off
+// partway, misreporting their size, or behind redirects, so resuming and
+// retrying can be exercised against a known origin rather than ad hoc
+// handlers.
+package dltest
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Options sets how a Server behaves. The zero value serves the whole file
+// on every request, as a server without range support does.
+type Options struct {
+	// Ranges honors single Range requests, and advertises that it does.
+	Ranges bool
+	// Rate limits each response to this many bytes per second. Zero is
+	// unlimited.
+	Rate int64
+	// ResetAfter cuts the connection off after this many bytes of a
+	// response's body. Zero never does.
+	ResetAfter int64
+	// Resets is how many responses are cut off by ResetAfter, after which
+	// they are served in full. Zero cuts off every one.
+	Resets int
+	// ContentLength, if not zero, is sent as the size of the file in
+	// place of the real one. The body is still the real file.
+	ContentLength int64
+	// Redirects is how many redirects lead to the file.
+	Redirects int
+	// ETag is sent with every response, if set.
+	ETag string
+}
+
+// Server is an origin serving Data at any path, as set by its Options.
+type Server struct {
+	*httptest.Server
+	Data []byte
+
+	opts     Options
+	requests atomic.Int64
+	resets   atomic.Int64
+}
+
+// NewServer starts a Server for data. Close it when done.
+func NewServer(data []byte, opts Options) *Server {
+	s := &Server{Data: data, opts: opts}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// RandomData returns size bytes generated from seed, the same for the same
+// seed, so a failing run can be repeated.
+func RandomData(size int, seed int64) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// FileURL returns the URL to fetch the file as name from, through the
+// redirects the Server is set to make.
+func (s *Server) FileURL(name string) string {
+	if s.opts.Redirects > 0 {
+		return fmt.Sprintf("%s/redirect/%d/%s", s.URL, s.opts.Redirects, name)
+	}
+	return s.URL + "/" + name
+}
+
+// Requests returns how many requests the Server has had, redirects
+// included.
+func (s *Server) Requests() int {
+	return int(s.requests.Load())
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+
+	// /redirect/n/name redirects to /redirect/n-1/name, and so on to /name
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/redirect/"); ok {
+		n, name, _ := strings.Cut(rest, "/")
+		left, err := strconv.Atoi(n)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		next := "/" + name
+		if left > 1 {
+			next = fmt.Sprintf("/redirect/%d/%s", left-1, name)
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	size := int64(len(s.Data))
+	reported := size
+	if s.opts.ContentLength != 0 {
+		reported = s.opts.ContentLength
+	}
+	if s.opts.ETag != "" {
+		w.Header().Set("ETag", s.opts.ETag)
+	}
+
+	start, end := int64(0), size-1
+	status := http.StatusOK
+	if s.opts.Ranges {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if spec := r.Header.Get("Range"); spec != "" {
+			var ok bool
+			start, end, ok = parseRange(spec, size)
+			if !ok {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", reported))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, reported))
+			reported = end - start + 1
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(reported, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	body := s.Data[start : end+1]
+	limit := int64(len(body))
+	reset := false
+	if s.opts.ResetAfter > 0 && s.opts.ResetAfter < limit {
+		if s.opts.Resets == 0 || s.resets.Add(1) <= int64(s.opts.Resets) {
+			limit = s.opts.ResetAfter
+			reset = true
+		}
+	}
+	s.write(w, body[:limit])
+	if reset {
+		// Aborting the handler closes the connection without ending the
+		// response, as a dropped connection does
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// write writes body to w, at the Server's rate if it has one.
+func (s *Server) write(w http.ResponseWriter, body []byte) {
+	if s.opts.Rate <= 0 {
+		_, _ = w.Write(body)
+		return
+	}
+	// Writes are paced by the time since the start rather than by sleeps
+	// alone, so the rate holds however long each write takes
+	chunk := max(s.opts.Rate/20, 1)
+	flusher, _ := w.(http.Flusher)
+	start := time.Now()
+	var sent int64
+	for sent < int64(len(body)) {
+		n := min(chunk, int64(len(body))-sent)
+		if _, err := w.Write(body[sent : sent+n]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		sent += n
+		due := time.Duration(float64(sent) / float64(s.opts.Rate) * float64(time.Second))
+		time.Sleep(due - time.Since(start))
+	}
+}
+
+// parseRange parses a single range of a Range header for a file of size
+// bytes, returning its first and last byte.
+func parseRange(spec string, size int64) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(spec, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
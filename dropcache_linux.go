@@ -0,0 +1,17 @@
+//go:build amd64 || arm64 || loong64 || riscv64
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fadvDontneed is POSIX_FADV_DONTNEED.
+const fadvDontneed = 4
+
+// dropCache asks the kernel to forget the cached pages of n bytes at off
+// in f, so they are read from the device again.
+func dropCache(f *os.File, off, n int64) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(off), uintptr(n), fadvDontneed, 0, 0)
+}
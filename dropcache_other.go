@@ -0,0 +1,9 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || riscv64)
+
+package main
+
+import "os"
+
+// dropCache is only supported on 64-bit Linux; elsewhere data may be read
+// back from the page cache.
+func dropCache(f *os.File, off, n int64) {}
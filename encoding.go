@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// acceptEncoding lists the content codings -compressed asks for, those
+// the standard library can decode.
+const acceptEncoding = "gzip, deflate"
+
+// encoded reports whether the response with Content-Encoding coding has
+// to be decoded.
+func encoded(coding string) bool {
+	return coding != "" && !strings.EqualFold(coding, "identity")
+}
+
+// decoder returns a reader of the decoded content of r, sent with
+// Content-Encoding coding.
+func decoder(coding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(coding) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Meant to be zlib, but some servers send raw deflate data
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deflate data: %w", err)
+		}
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", coding)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+const (
+	// readAheadSize and readAheadDepth bound how far a response is read
+	// ahead of its decoding: readAheadDepth reads of up to readAheadSize
+	// bytes each.
+	readAheadSize  = 64 << 10
+	readAheadDepth = 64
+)
+
+// readAhead reads r on a goroutine of its own, ahead of its reader, so
+// that decoding a response and receiving it overlap: the network keeps
+// being read while the decoder, which is CPU bound, works through what
+// has arrived.
+type readAhead struct {
+	chunks chan readChunk
+	free   chan []byte
+	done   chan struct{}
+	exited chan struct{}
+	// cur is the unread part of buf, the chunk being read, and err what
+	// ended r.
+	cur, buf []byte
+	err      error
+}
+
+// readChunk is the result of a read of the underlying reader.
+type readChunk struct {
+	data []byte
+	err  error
+}
+
+func newReadAhead(r io.Reader) *readAhead {
+	ra := &readAhead{
+		chunks: make(chan readChunk, readAheadDepth),
+		free:   make(chan []byte, readAheadDepth+1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	for range readAheadDepth + 1 {
+		ra.free <- make([]byte, readAheadSize)
+	}
+	go ra.fill(r)
+	return ra
+}
+
+func (ra *readAhead) fill(r io.Reader) {
+	defer close(ra.exited)
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		case <-ra.done:
+			return
+		}
+		n, err := r.Read(buf)
+		if n == 0 && err == nil {
+			ra.free <- buf
+			continue
+		}
+		select {
+		case ra.chunks <- readChunk{data: buf[:n], err: err}:
+		case <-ra.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		if ra.buf != nil {
+			ra.free <- ra.buf[:cap(ra.buf)]
+			ra.buf = nil
+		}
+		if ra.err != nil {
+			return 0, ra.err
+		}
+		c := <-ra.chunks
+		ra.cur, ra.buf, ra.err = c.data, c.data, c.err
+	}
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+// Close stops reading ahead, waiting for the goroutine reading r to
+// finish. If it may be blocked reading r, r must be closed first.
+func (ra *readAhead) Close() error {
+	close(ra.done)
+	<-ra.exited
+	return nil
+}
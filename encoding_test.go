@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+// compressingServer sends data compressed with coding and without a
+// Content-Length, as servers compressing on the fly do, over about a
+// second so the download's speed is sampled while it runs.
+func compressingServer(t *testing.T, data []byte, coding string) *httptest.Server {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	w.Write(data)
+	w.Close()
+	body := buf.Bytes()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") == "" {
+			t.Errorf("%s request without Accept-Encoding", r.Method)
+		}
+		w.Header().Set("Content-Encoding", coding)
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Method == "HEAD" {
+			return
+		}
+		const chunks = 8
+		for i := 0; i < chunks; i++ {
+			w.Write(body[len(body)*i/chunks : len(body)*(i+1)/chunks])
+			w.(http.Flusher).Flush()
+			time.Sleep(150 * time.Millisecond)
+		}
+	}))
+}
+
+func TestCompressedSingleStream(t *testing.T) {
+	data := bytes.Repeat(dltest.RandomData(64<<10, 14), 16)
+	for _, coding := range []string{"gzip", "deflate"} {
+		t.Run(coding, func(t *testing.T) {
+			srv := compressingServer(t, data, coding)
+			defer srv.Close()
+
+			dl := &download{
+				uri:          srv.URL + "/file.bin",
+				boost:        4,
+				scheduler:    "tail-split",
+				strategy:     "writeat",
+				progressFile: defaultProgressFile,
+				sweeps:       1,
+				workingDir:   t.TempDir(),
+				conns:        &connTracker{},
+				compressed:   true,
+				verifyWrites: true,
+			}
+			dl.client = newHTTPClient(clientOptions{maxRedirects: defaultMaxRedirects, conns: dl.conns})
+			if err := dl.FetchMetadata(); err != nil {
+				t.Fatalf("FetchMetadata: %v", err)
+			}
+			if dl.supportsRange {
+				t.Fatal("ranges of a compressed response would be fetched")
+			}
+			if err := dl.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch: %v", err)
+			}
+			checkOutput(t, dl, data)
+			if dl.filesize != uint64(len(data)) {
+				t.Errorf("filesize is %d after decoding, want %d", dl.filesize, len(data))
+			}
+		})
+	}
+}
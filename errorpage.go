@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// errorPageMaxSize is the largest response taken for an error page when
+// a bigger file was expected. Error pages are a few kilobytes at most.
+const errorPageMaxSize = 256 << 10
+
+// errorPageReason returns why a response to uri with contentType and size
+// looks like an error page, such as the "not found" page of a broken
+// mirror sent with a 200 status, rather than the file. It returns an
+// empty string if the response looks like the file. expected is the size
+// the file should be, or -1 if unknown.
+func errorPageReason(uri, contentType string, size uint64, expected int64) string {
+	html := strings.HasPrefix(contentType, "text/html") || strings.HasPrefix(contentType, "application/xhtml+xml")
+	if ext := fileExtension(uri); html && ext != "" && !strings.HasPrefix(mime.TypeByExtension(ext), "text/") {
+		return fmt.Sprintf("it is an HTML page, not a %s file", ext)
+	}
+	if expected > 0 && size < uint64(expected) && size <= errorPageMaxSize {
+		kind := "a response"
+		if html {
+			kind = "an HTML page"
+		}
+		return fmt.Sprintf("it is %s of %s where %s was expected", kind, formatBytes(float64(size)), formatBytes(float64(expected)))
+	}
+	return ""
+}
+
+// fileExtension returns the extension of the file uri names, or an empty
+// string if it names a page or has none.
+func fileExtension(uri string) string {
+	if looksLikePage(uri) {
+		return ""
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(path.Ext(u.Path))
+}
+
+// avoidErrorPage makes sure dl's source isn't sending an error page in
+// place of the file. If it is, the first mirror sending the file takes
+// its place; with none, the error says why the response was refused.
+func (dl *download) avoidErrorPage(expected int64) error {
+	if !dl.checkPages || dl.localPath != "" {
+		return nil
+	}
+	reason := errorPageReason(dl.uri, dl.contentType, dl.filesize, expected)
+	if reason == "" {
+		return nil
+	}
+	bad := dl.uri
+	for len(dl.mirrors) > 0 {
+		mirror := dl.mirrors[0]
+		dl.mirrors = dl.mirrors[1:]
+		dl.uri = mirror
+		dl.redirects = nil
+		dl.unwraps = 0
+		if err := dl.FetchMetadata(); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping mirror %s: %v\n", mirror, err)
+			continue
+		}
+		if why := errorPageReason(dl.uri, dl.contentType, dl.filesize, expected); why != "" {
+			fmt.Fprintf(os.Stderr, "Skipping mirror %s: %s.\n", mirror, why)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s looks like an error page (%s); downloading from %s instead.\n", bad, reason, mirror)
+		return nil
+	}
+	return fmt.Errorf("%s looks like an error page, not the file: %s. Use -no-page-check to download it anyway", bad, reason)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxPartSizeGuesses is how many part sizes are tried when verifying a
+// multipart ETag, since each one means hashing the whole file again.
+const maxPartSizeGuesses = 4
+
+// commonPartSizes are the part sizes popular S3 clients upload with, in
+// MiB, most common first.
+var commonPartSizes = []uint64{8, 16, 5, 64, 100, 15, 10, 50, 128, 256, 512}
+
+// s3ETag is an ETag as S3 computes it: the MD5 of the object, or for a
+// multipart upload the MD5 of the concatenated MD5s of its parts, along
+// with the number of parts.
+type s3ETag struct {
+	sum   []byte
+	parts int
+}
+
+// s3ETagFor returns the ETag of a response from an S3 compatible server,
+// or nil if there is none or it isn't derived from the content alone, as
+// for objects encrypted with KMS or customer-provided keys.
+func s3ETagFor(h http.Header) *s3ETag {
+	s3 := false
+	for name := range h {
+		if strings.HasPrefix(name, "X-Amz-") {
+			s3 = true
+			break
+		}
+	}
+	if !s3 || strings.HasPrefix(h.Get("X-Amz-Server-Side-Encryption"), "aws:kms") ||
+		h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return nil
+	}
+	return parseS3ETag(h.Get("ETag"))
+}
+
+// parseS3ETag parses an ETag of the form "<md5 hex>" or "<md5 hex>-<parts>".
+func parseS3ETag(etag string) *s3ETag {
+	digest, count, multipart := strings.Cut(strings.Trim(etag, `"`), "-")
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != md5.Size {
+		return nil
+	}
+	e := &s3ETag{sum: sum}
+	if multipart {
+		if e.parts, err = strconv.Atoi(count); err != nil || e.parts < 1 {
+			return nil
+		}
+	}
+	return e
+}
+
+func (e *s3ETag) String() string {
+	if e.parts > 0 {
+		return fmt.Sprintf("%x-%d", e.sum, e.parts)
+	}
+	return fmt.Sprintf("%x", e.sum)
+}
+
+// verify checks the file at path, of the given size, against the ETag.
+// The part size of a multipart upload isn't recorded anywhere, so the
+// likeliest ones are tried; if none match, the file can't be verified
+// but isn't known to be wrong either, and only a warning is printed.
+func (e *s3ETag) verify(path string, size uint64) error {
+	var partSizes []uint64
+	if e.parts > 0 {
+		if partSizes = guessPartSizes(size, e.parts); len(partSizes) == 0 {
+			return fmt.Errorf("%w: %d bytes can't be split into the %d parts of ETag %s", errChecksumMismatch, size, e.parts, e)
+		}
+	}
+
+	whole := md5.New()
+	writers := []io.Writer{whole}
+	hashers := make([]*partHasher, len(partSizes))
+	for i, ps := range partSizes {
+		hashers[i] = &partHasher{partSize: ps, part: md5.New()}
+		writers = append(writers, hashers[i])
+	}
+	if err := hashFile(path, "Verifying ETag", writers...); err != nil {
+		return err
+	}
+
+	if e.parts == 0 {
+		if got := whole.Sum(nil); !bytes.Equal(got, e.sum) {
+			return fmt.Errorf("%w: expected ETag %s, got %x", errChecksumMismatch, e, got)
+		}
+		fmt.Println("ETag verified.")
+		return nil
+	}
+	for _, h := range hashers {
+		if bytes.Equal(h.sum(), e.sum) {
+			fmt.Printf("ETag verified (%s parts).\n", formatBytes(float64(h.partSize)))
+			return nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Warning: couldn't verify multipart ETag %s, which may use an unusual part size.\n", e)
+	return nil
+}
+
+// guessPartSizes returns the part sizes that split size bytes into
+// exactly parts parts, likeliest first: those of popular clients, then
+// other whole MiB, then the smallest possible.
+func guessPartSizes(size uint64, parts int) []uint64 {
+	n := uint64(parts)
+	lo := (size + n - 1) / n
+	hi := size
+	if n > 1 {
+		hi = (size+n-2)/(n-1) - 1
+	}
+	if lo == 0 || lo > hi {
+		return nil
+	}
+
+	const mib = 1 << 20
+	var sizes []uint64
+	add := func(ps uint64) {
+		if ps >= lo && ps <= hi && len(sizes) < maxPartSizeGuesses && !slices.Contains(sizes, ps) {
+			sizes = append(sizes, ps)
+		}
+	}
+	for _, ps := range commonPartSizes {
+		add(ps * mib)
+	}
+	for ps := (lo + mib - 1) / mib * mib; ps <= hi && len(sizes) < maxPartSizeGuesses; ps += mib {
+		add(ps)
+	}
+	add(lo)
+	return sizes
+}
+
+// partHasher computes a multipart ETag for one part size.
+type partHasher struct {
+	partSize uint64
+	written  uint64
+	part     hash.Hash
+	// digests are the MD5s of the parts completed so far.
+	digests []byte
+}
+
+func (h *partHasher) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		room := h.partSize - h.written%h.partSize
+		chunk := b[:min(uint64(len(b)), room)]
+		h.part.Write(chunk)
+		h.written += uint64(len(chunk))
+		b = b[len(chunk):]
+		if h.written%h.partSize == 0 {
+			h.digests = h.part.Sum(h.digests)
+			h.part.Reset()
+		}
+	}
+	return n, nil
+}
+
+// sum returns the MD5 of the part MD5s, including the last, short part.
+func (h *partHasher) sum() []byte {
+	digests := h.digests
+	if h.written%h.partSize != 0 {
+		digests = h.part.Sum(slices.Clip(digests))
+	}
+	sum := md5.Sum(digests)
+	return sum[:]
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// sessionReporter receives the progress of every download in a session,
+// each identified by its position in the batch, so one source of events
+// can drive any number of displays and integrations at once.
+type sessionReporter interface {
+	downloadStarted(id int, info fileInfo)
+	downloadUpdated(id int, u progressUpdate)
+	downloadFinished(id int, err error)
+}
+
+// progressUpdate is the progress of a running download.
+type progressUpdate struct {
+	written int64
+	total   int64
+	// speed is in bytes per second, and eta negative when unknown.
+	speed float64
+	eta   time.Duration
+}
+
+// multiReporter passes every event on to each of its reporters.
+type multiReporter []sessionReporter
+
+func (m multiReporter) downloadStarted(id int, info fileInfo) {
+	for _, r := range m {
+		r.downloadStarted(id, info)
+	}
+}
+
+func (m multiReporter) downloadUpdated(id int, u progressUpdate) {
+	for _, r := range m {
+		r.downloadUpdated(id, u)
+	}
+}
+
+func (m multiReporter) downloadFinished(id int, err error) {
+	for _, r := range m {
+		r.downloadFinished(id, err)
+	}
+}
+
+// sessionProgress reports the progress of one download to the session's
+// reporters as well as to its own progress display.
+type sessionProgress struct {
+	progressReporter
+	session sessionReporter
+	id      int
+	total   int64
+
+	mu      sync.Mutex
+	written int64
+}
+
+func (p *sessionProgress) Add(n int64) {
+	p.progressReporter.Add(n)
+	p.mu.Lock()
+	p.written += n
+	p.mu.Unlock()
+}
+
+func (p *sessionProgress) Speed(s speedSample) {
+	p.progressReporter.Speed(s)
+	p.mu.Lock()
+	written := p.written
+	p.mu.Unlock()
+	p.session.downloadUpdated(p.id, progressUpdate{written: written, total: p.total, speed: s.total, eta: s.eta})
+}
+
+// eventLog writes session events as JSON, one object per line, for
+// scripts and dashboards to follow a session with -events.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// event is a line of the event log. Fields not relevant to the event are
+// left out.
+type event struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	ID       int       `json:"id"`
+	URI      string    `json:"uri,omitempty"`
+	Filename string    `json:"filename,omitempty"`
+	Size     *int64    `json:"size,omitempty"`
+	Written  *int64    `json:"written,omitempty"`
+	Speed    *float64  `json:"speed,omitempty"`
+	ETA      *float64  `json:"eta_seconds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// openEventLog creates the event log at path, which may also be a named
+// pipe for another program to read events from as they happen.
+func openEventLog(path string) (*eventLog, error) {
+	// Left open until dl exits. Nothing is buffered, so each event is
+	// there to read as soon as it happens.
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create event log: %w", err)
+	}
+	return &eventLog{enc: json.NewEncoder(f)}, nil
+}
+
+func (l *eventLog) write(e event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Time = time.Now().UTC()
+	// The log is a side channel; failing to write it doesn't fail the
+	// downloads
+	_ = l.enc.Encode(e)
+}
+
+func (l *eventLog) downloadStarted(id int, info fileInfo) {
+	e := event{Event: "started", ID: id, URI: info.uri, Filename: info.filename}
+	if info.size > 0 {
+		size := int64(info.size)
+		e.Size = &size
+	}
+	l.write(e)
+}
+
+func (l *eventLog) downloadUpdated(id int, u progressUpdate) {
+	e := event{Event: "progress", ID: id, Written: &u.written, Speed: &u.speed}
+	if u.total > 0 {
+		e.Size = &u.total
+	}
+	if u.eta >= 0 {
+		eta := u.eta.Seconds()
+		e.ETA = &eta
+	}
+	l.write(e)
+}
+
+func (l *eventLog) downloadFinished(id int, err error) {
+	e := event{Event: "finished", ID: id}
+	if err != nil {
+		e.Event = "failed"
+		e.Error = err.Error()
+	}
+	l.write(e)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// headerExpectation is a header the server's response must have, as
+// given to -expect-header. An empty value only requires the header to
+// be there.
+type headerExpectation struct {
+	name, value string
+}
+
+// parseExpectation parses an -expect-header value, "Name: value".
+func parseExpectation(s string) (headerExpectation, error) {
+	name, value, err := parseHeader(s)
+	if err != nil {
+		return headerExpectation{}, err
+	}
+	return headerExpectation{name: http.CanonicalHeaderKey(name), value: value}, nil
+}
+
+// matches reports whether got, a value of the header, is the one
+// expected. Values are compared ignoring case, a trailing * matches any
+// rest, and a Content-Type's parameters, such as its charset, are
+// ignored unless expected.
+func (e headerExpectation) matches(got string) bool {
+	want := e.value
+	if e.name == "Content-Type" && !strings.Contains(want, ";") {
+		if mediaType, _, err := mime.ParseMediaType(got); err == nil {
+			got = mediaType
+		}
+	}
+	if prefix, ok := strings.CutSuffix(want, "*"); ok {
+		return len(got) >= len(prefix) && strings.EqualFold(got[:len(prefix)], prefix)
+	}
+	return strings.EqualFold(strings.TrimSpace(got), want)
+}
+
+// checkExpectations checks the metadata fetched for dl against the
+// headers and size it is expected to have, so that a server sending
+// something else, such as an error page, is caught before any of it is
+// downloaded. A negative size isn't checked.
+func (dl *download) checkExpectations(headers []headerExpectation, size int64) error {
+	var problems []string
+	if len(headers) > 0 && dl.header == nil {
+		return fmt.Errorf("%s has no response headers to check", dl.uri)
+	}
+	for _, e := range headers {
+		got, ok := dl.header[e.name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("no %s header", e.name))
+		case e.value == "":
+		case !e.matches(strings.Join(got, ", ")):
+			problems = append(problems, fmt.Sprintf("%s is %q, not %q", e.name, strings.Join(got, ", "), e.value))
+		}
+	}
+	if size >= 0 {
+		switch {
+		case dl.filesize == 0 && dl.localPath == "" && (dl.manifest != nil || encoded(dl.contentEncoding)):
+			problems = append(problems, "its size isn't known up front")
+		case dl.filesize != uint64(size):
+			problems = append(problems, fmt.Sprintf("it is %s (%d bytes), not %s (%d bytes)", formatBytes(float64(dl.filesize)), dl.filesize, formatBytes(float64(size)), size))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%s isn't what was expected: %s", dl.uri, strings.Join(problems, "; "))
+	if strings.HasPrefix(dl.contentType, "text/html") {
+		msg += ". The server sent an HTML page, perhaps an error page in place of the file"
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// exportFormats are the valid -export values: a Metalink 4 file (.meta4)
+// listing the URIs the file was downloaded from with its SHA-256, or a
+// .torrent with those URIs as web seeds.
+var exportFormats = []string{"metalink", "torrent"}
+
+const (
+	// minPieceLength and maxPieceLength bound the piece length of an
+	// exported torrent or Metalink, which grows with the file to keep the
+	// number of pieces near targetPieces.
+	minPieceLength = 256 << 10
+	maxPieceLength = 16 << 20
+	targetPieces   = 1500
+)
+
+// metalink is a Metalink 4 document, as defined by RFC 5854.
+type metalink struct {
+	XMLName   xml.Name       `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+	Generator string         `xml:"generator"`
+	Published string         `xml:"published"`
+	Files     []metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string          `xml:"name,attr"`
+	Size   uint64          `xml:"size"`
+	Hash   metalinkHash    `xml:"hash"`
+	Pieces *metalinkPieces `xml:"pieces,omitempty"`
+	URLs   []metalinkURL   `xml:"url"`
+}
+
+// metalinkPieces are the hashes of each piece of a file, all of length
+// bytes but the last, so that a damaged or changed part can be told from
+// the rest.
+type metalinkPieces struct {
+	Length int64    `xml:"length,attr"`
+	Type   string   `xml:"type,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkURL struct {
+	Priority int    `xml:"priority,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// export writes a descriptor of dl's completed file in format next to
+// it, so others can fetch the same file and verify it, and returns its
+// path.
+func (dl *download) export(format string) (string, error) {
+	f, err := os.Open(dl.outputPath())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The source first, then its mirrors, in the order they were given
+	urls := append([]string{dl.uri}, dl.mirrors...)
+	name := filepath.Base(dl.filename)
+
+	var path string
+	var data []byte
+	switch format {
+	case "metalink":
+		h := sha256.New()
+		pieces := &metalinkPieces{Length: pieceLength(dl.filesize), Type: "sha-256"}
+		buf := make([]byte, pieces.Length)
+		for {
+			n, err := io.ReadFull(f, buf)
+			if n > 0 {
+				h.Write(buf[:n])
+				sum := sha256.Sum256(buf[:n])
+				pieces.Hashes = append(pieces.Hashes, hex.EncodeToString(sum[:]))
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("error reading %s: %w", dl.outputPath(), err)
+			}
+		}
+		doc := metalink{
+			Generator: "dl/" + version,
+			Published: time.Now().UTC().Format(time.RFC3339),
+			Files: []metalinkFile{{
+				Name:   name,
+				Size:   dl.filesize,
+				Hash:   metalinkHash{Type: "sha-256", Value: hex.EncodeToString(h.Sum(nil))},
+				Pieces: pieces,
+			}},
+		}
+		for i, u := range urls {
+			doc.Files[0].URLs = append(doc.Files[0].URLs, metalinkURL{Priority: i + 1, Value: u})
+		}
+		out, err := xml.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		path = dl.outputPath() + ".meta4"
+		data = append([]byte(xml.Header), append(out, '\n')...)
+
+	case "torrent":
+		length := pieceLength(dl.filesize)
+		var pieces []byte
+		buf := make([]byte, length)
+		for {
+			n, err := io.ReadFull(f, buf)
+			if n > 0 {
+				sum := sha1.Sum(buf[:n])
+				pieces = append(pieces, sum[:]...)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("error reading %s: %w", dl.outputPath(), err)
+			}
+		}
+		// Without a tracker, clients find the file through the web
+		// seeds of BEP 19 alone
+		var b bytes.Buffer
+		bencode(&b, map[string]any{
+			"created by":    "dl/" + version,
+			"creation date": time.Now().Unix(),
+			"url-list":      urls,
+			"info": map[string]any{
+				"name":         name,
+				"length":       int64(dl.filesize),
+				"piece length": length,
+				"pieces":       pieces,
+			},
+		})
+		path = dl.outputPath() + ".torrent"
+		data = b.Bytes()
+
+	default:
+		return "", fmt.Errorf("unknown export format %q", format)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// pieceLength returns the length of the pieces a file of size bytes is
+// hashed in for export.
+func pieceLength(size uint64) int64 {
+	length := int64(minPieceLength)
+	for length < maxPieceLength && int64(size)/length > targetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// bencode writes v to b in the bencoding of BitTorrent. v may be a
+// string, []byte, int64, []string, or a map[string]any of those, whose
+// keys are written sorted as the encoding requires.
+func bencode(b *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		bencode(b, []byte(v))
+	case []byte:
+		b.WriteString(strconv.Itoa(len(v)))
+		b.WriteByte(':')
+		b.Write(v)
+	case int64:
+		fmt.Fprintf(b, "i%de", v)
+	case []string:
+		b.WriteByte('l')
+		for _, s := range v {
+			bencode(b, s)
+		}
+		b.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('d')
+		for _, k := range keys {
+			bencode(b, k)
+			bencode(b, v[k])
+		}
+		b.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// extractRange is a portion of a remote file to download, as given with
+// -range. Offsets are in bytes, with end the first byte past the portion.
+type extractRange struct {
+	start, end int64
+	// toEnd goes on to the end of the file, and suffix takes the last
+	// start bytes of it instead.
+	toEnd, suffix bool
+}
+
+// parseExtractRange parses a -range value: "start-end", "start-" for the
+// rest of the file, or "-length" for the last length bytes. Sizes take
+// units as -limit does, so 100MB-200MB is the 100 MB after the first 100.
+func parseExtractRange(s string, units byteUnits) (extractRange, error) {
+	first, last, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return extractRange{}, fmt.Errorf("invalid range %q: use start-end, start-, or -length", s)
+	}
+	var r extractRange
+	var err error
+	switch {
+	case first == "" && last == "":
+		return extractRange{}, fmt.Errorf("invalid range %q", s)
+	case first == "":
+		r.suffix = true
+		if r.start, err = parseSize(last, units); err != nil {
+			return extractRange{}, err
+		}
+		if r.start <= 0 {
+			return extractRange{}, fmt.Errorf("invalid range %q: the length must be positive", s)
+		}
+		return r, nil
+	}
+	if r.start, err = parseOffset(first, units); err != nil {
+		return extractRange{}, err
+	}
+	if last == "" {
+		r.toEnd = true
+		return r, nil
+	}
+	if r.end, err = parseOffset(last, units); err != nil {
+		return extractRange{}, err
+	}
+	if r.end <= r.start {
+		return extractRange{}, fmt.Errorf("invalid range %q: it ends before it starts", s)
+	}
+	return r, nil
+}
+
+// parseOffset parses an offset in a file as parseSize does, but also
+// takes the start of the file, which isn't a size.
+func parseOffset(s string, units byteUnits) (int64, error) {
+	if n, err := parseDecimal(strings.TrimSpace(s)); err == nil && n == 0 {
+		return 0, nil
+	}
+	return parseSize(s, units)
+}
+
+// applyRange limits dl to portion r of the remote file, which then stands
+// for the file in everything that follows: its size, the ranges fetched,
+// and the progress saved. A range past the end of the file is cut short
+// at the end, as HTTP does.
+func (dl *download) applyRange(r extractRange) error {
+	if dl.localPath != "" {
+		return errors.New("-range only applies to remote files")
+	}
+	if !dl.supportsRange {
+		return fmt.Errorf("the server of %s doesn't support ranges", dl.uri)
+	}
+	size := int64(dl.filesize)
+	start, end := r.start, min(r.end, size)
+	switch {
+	case r.suffix:
+		start, end = max(size-r.start, 0), size
+	case r.toEnd:
+		end = size
+	}
+	if start >= size {
+		return fmt.Errorf("the range starts past the end of %s, which is %s", dl.filename, formatBytes(float64(size)))
+	}
+	dl.extract = &byteRange{Start: uint64(start), End: uint64(end) - 1}
+	dl.filesize = uint64(end - start)
+	// The ETag is of the whole file
+	dl.s3ETag = nil
+	return nil
+}
+
+// remoteOffset returns where in the remote file the output starts.
+func (dl *download) remoteOffset() uint64 {
+	if dl.extract == nil {
+		return 0
+	}
+	return dl.extract.Start
+}
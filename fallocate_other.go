@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// fallocate is only supported on Linux.
+func fallocate(f *os.File, size int64) error {
+	return errors.New("fallocate not supported")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+func TestMain(m *testing.M) {
+	progressOutput.style = "none"
+	os.Exit(m.Run())
+}
+
+// newTestDownload returns a download of uri into dir with the settings
+// dl runs with by default, its metadata fetched.
+func newTestDownload(t *testing.T, uri, dir string) *download {
+	t.Helper()
+	dl := &download{
+		uri:          uri,
+		boost:        4,
+		scheduler:    "tail-split",
+		strategy:     "writeat",
+		progressFile: defaultProgressFile,
+		sweeps:       1,
+		workingDir:   dir,
+		conns:        &connTracker{},
+	}
+	dl.client = newHTTPClient(clientOptions{maxRedirects: defaultMaxRedirects, conns: dl.conns})
+	if err := dl.FetchMetadata(); err != nil {
+		t.Fatalf("FetchMetadata: %v", err)
+	}
+	return dl
+}
+
+// checkOutput fails the test unless dl's output file holds want.
+func checkOutput(t *testing.T, dl *download, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(dl.outputPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("output is %d bytes with SHA-256 %x, want %d bytes with SHA-256 %x", len(got), sha256.Sum256(got), len(want), sha256.Sum256(want))
+	}
+}
+
+func TestResumeAfterInterruption(t *testing.T) {
+	data := dltest.RandomData(4<<20, 1)
+	srv := dltest.NewServer(data, dltest.Options{Ranges: true, Rate: 1 << 20, ETag: `"v1"`})
+	defer srv.Close()
+	dir := t.TempDir()
+
+	dl := newTestDownload(t, srv.FileURL("file.bin"), dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := dl.Fetch(ctx); err == nil {
+		t.Fatal("Fetch finished before it was interrupted")
+	}
+	dl.abort()
+	if _, err := os.Stat(filepath.Join(dir, ".file.bin.dl")); err != nil {
+		t.Fatalf("no progress saved: %v", err)
+	}
+
+	dl = newTestDownload(t, srv.FileURL("file.bin"), dir)
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatalf("resumed Fetch: %v", err)
+	}
+	if dl.resumed == 0 {
+		t.Error("the download started over instead of resuming")
+	}
+	checkOutput(t, dl, data)
+	if _, err := os.Stat(filepath.Join(dir, ".file.bin.dl")); err == nil {
+		t.Error("progress file left behind after the download completed")
+	}
+}
+
+func TestReconnectAfterReset(t *testing.T) {
+	data := dltest.RandomData(2<<20, 2)
+	srv := dltest.NewServer(data, dltest.Options{Ranges: true, ResetAfter: 100 << 10, Resets: 3})
+	defer srv.Close()
+
+	dl := newTestDownload(t, srv.FileURL("file.bin"), t.TempDir())
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	checkOutput(t, dl, data)
+	if n := dl.stats.reconnects.Load(); n != 3 {
+		t.Errorf("reconnected %d times, want 3", n)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	data := dltest.RandomData(1<<20, 3)
+	srv := dltest.NewServer(data, dltest.Options{Ranges: true, Redirects: 3})
+	defer srv.Close()
+
+	dl := newTestDownload(t, srv.FileURL("file.bin"), t.TempDir())
+	if len(dl.redirects) != 3 {
+		t.Errorf("followed %d redirects, want 3", len(dl.redirects))
+	}
+	if dl.filename != "file.bin" {
+		t.Errorf("filename is %q, want file.bin", dl.filename)
+	}
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	checkOutput(t, dl, data)
+}
+
+func TestWrongContentLength(t *testing.T) {
+	data := dltest.RandomData(1<<20, 4)
+	for _, ranges := range []bool{false, true} {
+		srv := dltest.NewServer(data, dltest.Options{Ranges: ranges, ContentLength: int64(len(data)) + 1000})
+		dl := newTestDownload(t, srv.FileURL("file.bin"), t.TempDir())
+		err := dl.Fetch(context.Background())
+		srv.Close()
+		if err == nil {
+			t.Errorf("with ranges %v, Fetch of a file shorter than its Content-Length succeeded", ranges)
+		}
+	}
+}
+
+// TestChaos downloads under injected failures, stalls, and responses
+// cut short, as -chaos does, which must all be recovered from.
+func TestChaos(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+	data := dltest.RandomData(4<<20, 5)
+	srv := dltest.NewServer(data, dltest.Options{Ranges: true})
+	defer srv.Close()
+
+	dl := newTestDownload(t, srv.FileURL("file.bin"), t.TempDir())
+	dl.boost = 8
+	dl.chaos = 0.2
+	dl.keepGoing = true
+	dl.sweeps = 100
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	checkOutput(t, dl, data)
+}
+
+// pacedServer serves data with ranges, as file.bin, shaping each response
+// as shape says from its request: ttfb before the body starts, and rate
+// bytes a second, unlimited if zero. It counts the requests with a range,
+// and the most GET requests open at once.
+type pacedServer struct {
+	*httptest.Server
+	data   []byte
+	shape  func(r *http.Request, start int64) (ttfb time.Duration, rate int64)
+	ranged atomic.Int32
+
+	mu            sync.Mutex
+	open, busiest int
+}
+
+func newPacedServer(data []byte, shape func(r *http.Request, start int64) (time.Duration, int64)) *pacedServer {
+	s := &pacedServer{data: data, shape: shape}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *pacedServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		s.open++
+		s.busiest = max(s.busiest, s.open)
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.open--
+			s.mu.Unlock()
+		}()
+	}
+
+	start, end := int64(0), int64(len(s.data))-1
+	status := http.StatusOK
+	if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+		first, last, _ := strings.Cut(spec, "-")
+		start, _ = strconv.ParseInt(first, 10, 64)
+		if last != "" {
+			end, _ = strconv.ParseInt(last, 10, 64)
+		}
+		end = min(end, int64(len(s.data))-1)
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.data)))
+		s.ranged.Add(1)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	var ttfb time.Duration
+	var rate int64
+	if s.shape != nil {
+		ttfb, rate = s.shape(r, start)
+	}
+	time.Sleep(ttfb)
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	body := s.data[start : end+1]
+	chunk := 32 << 10
+	began := time.Now()
+	for sent := 0; sent < len(body); {
+		n := min(chunk, len(body)-sent)
+		if _, err := w.Write(body[sent : sent+n]); err != nil {
+			return
+		}
+		sent += n
+		if rate > 0 {
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Until(began.Add(time.Duration(float64(sent) / float64(rate) * float64(time.Second)))))
+		}
+	}
+}
+
+// TestTailSplit checks that a worker left idle takes over half of a slow
+// part, over a new connection, and that the file comes out whole.
+func TestTailSplit(t *testing.T) {
+	data := dltest.RandomData(16<<20, 9)
+	// The first part crawls; the rest of the file is fast
+	srv := newPacedServer(data, func(r *http.Request, start int64) (time.Duration, int64) {
+		if start == 0 && r.Method == http.MethodGet {
+			return 0, 4 << 20
+		}
+		return 0, 0
+	})
+	defer srv.Close()
+
+	dl := newTestDownload(t, srv.URL+"/file.bin", t.TempDir())
+	dl.boost = 2
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkOutput(t, dl, data)
+	if dl.stats.splits.Load() == 0 {
+		t.Error("the slow part wasn't split")
+	}
+	if n := srv.ranged.Load(); n < 3 {
+		t.Errorf("made %d range requests, want one more for the split", n)
+	}
+}
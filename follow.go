@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// followMinPoll and followMaxPoll bound how often a growing file is
+// checked for new data.
+const (
+	followMinPoll = time.Second
+	followMaxPoll = 10 * time.Second
+)
+
+// follow keeps appending to the completed file what is added to it on
+// the server, as for a log still being written, until no more has been
+// added for stable, or until limit has passed since following began if
+// limit isn't zero.
+func (dl *download) follow(stable, limit time.Duration) error {
+	if !dl.supportsRange {
+		return errors.New("the server doesn't support ranges, so new data can't be fetched on its own")
+	}
+	out, err := os.OpenFile(dl.outputPath(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	poll := min(max(stable/4, followMinPoll), followMaxPoll)
+	start := time.Now()
+	lastGrowth := start
+	fmt.Printf("Following %s for new data, until it stops growing for %s.\n", dl.filename, stable)
+	for {
+		if time.Since(lastGrowth) >= stable {
+			return nil
+		}
+		if limit > 0 && time.Since(start) >= limit {
+			fmt.Printf("Stopped following %s after %s.\n", dl.filename, limit)
+			return nil
+		}
+		time.Sleep(poll)
+
+		n, err := dl.fetchAppended(out)
+		if n > 0 {
+			lastGrowth = time.Now()
+			dl.filesize += uint64(n)
+			fmt.Printf("%s grew by %s to %s.\n", dl.filename, formatBytes(float64(n)), formatBytes(float64(dl.filesize)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fetchAppended fetches whatever the server has past the end of the
+// local file and appends it to out, returning how many bytes that was.
+func (dl *download) fetchAppended(out *os.File) (int64, error) {
+	ctx := context.Background()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", dl.filesize))
+	dl.setHeaders(req)
+	resp, err := dl.do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error checking for new data: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing past the end yet, unless the file was replaced by a
+		// shorter one
+		var size uint64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err == nil && size < dl.filesize {
+			return 0, fmt.Errorf("the file shrank on the server from %s to %s, as when a log is rotated", formatBytes(float64(dl.filesize)), formatBytes(float64(size)))
+		}
+		return 0, nil
+	case http.StatusPartialContent:
+	default:
+		return 0, fmt.Errorf("error checking for new data: status %d", resp.StatusCode)
+	}
+
+	n, err := io.Copy(io.NewOffsetWriter(out, int64(dl.filesize)), dl.limitReader(ctx, resp.Body))
+	if err != nil {
+		// What did arrive is kept; the next check starts after it
+		return n, fmt.Errorf("error fetching new data: %w", err)
+	}
+	return n, nil
+}
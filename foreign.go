@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// foreignCheckSize is how much of the end of a partial download left by
+// another tool is compared with the server before it is trusted.
+const foreignCheckSize = 64 << 10
+
+// foreignPartial is a partial download of the output file left by
+// another tool.
+type foreignPartial struct {
+	tool string
+	// path is the partial file, which is moved to the output path if it
+	// is elsewhere.
+	path      string
+	completed []byteRange
+	// control is the tool's own record of its progress, removed once
+	// the partial file is taken over.
+	control string
+}
+
+// importPartial looks for a partial download of the output file left by
+// aria2, by wget or a browser as a .part file, or by curl -C in place,
+// and offers to take it over, converting the other tool's state into
+// dl's progress. It returns the progress, or nil if there is none to
+// take over.
+func (dl *download) importPartial() []byte {
+	p := dl.findForeignPartial()
+	if p == nil {
+		return nil
+	}
+	var done uint64
+	for _, r := range p.completed {
+		done += r.End - r.Start + 1
+	}
+	if !confirm(fmt.Sprintf("%s is a partial download of %s by %s, with %s of %s done. Resume it?", p.path, dl.filename, p.tool, formatBytes(float64(done)), formatBytes(float64(dl.filesize)))) {
+		return nil
+	}
+
+	// What the other tool wrote must be of the same remote file, so its
+	// last bytes must match the server's
+	if err := dl.matchesRemote(p.path, p.completed[len(p.completed)-1]); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't resume %s: %v; starting over.\n", p.path, err)
+		return nil
+	}
+
+	if p.path != dl.outputPath() {
+		if err := os.Rename(p.path, dl.outputPath()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error taking over %s: %v\n", p.path, err)
+			return nil
+		}
+	}
+	// dl keeps partial files at their full size
+	if err := os.Truncate(dl.outputPath(), int64(dl.filesize)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error taking over %s: %v\n", p.path, err)
+		return nil
+	}
+	if p.control != "" {
+		_ = os.Remove(p.control)
+	}
+
+	data, err := json.Marshal(progressState{
+		URI:          dl.uri,
+		Size:         dl.filesize,
+		ETag:         dl.etag,
+		LastModified: dl.lastModified,
+		Completed:    p.completed,
+		Path:         dl.outputPath(),
+	})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// findForeignPartial returns the partial download of the output file
+// left by another tool, or nil if there is none.
+func (dl *download) findForeignPartial() *foreignPartial {
+	out := dl.outputPath()
+
+	// aria2 writes into the output file, keeping which pieces are done
+	// in a control file next to it
+	control := out + ".aria2"
+	if data, err := os.ReadFile(control); err == nil {
+		completed, err := parseAria2Control(data, dl.filesize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring %s: %v\n", control, err)
+			return nil
+		}
+		if len(completed) == 0 {
+			return nil
+		}
+		return &foreignPartial{tool: "aria2", path: out, completed: completed, control: control}
+	}
+
+	// wget and browsers write the start of the file to a .part file, and
+	// curl -C to the output file itself
+	for _, p := range []foreignPartial{{tool: "wget or a browser", path: out + ".part"}, {tool: "curl", path: out}} {
+		info, err := os.Stat(p.path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if info.Size() == 0 || uint64(info.Size()) >= dl.filesize {
+			// Empty, or not partial at all
+			return nil
+		}
+		if p.path != out {
+			if _, err := os.Stat(out); err == nil {
+				// Don't overwrite the output file with it
+				return nil
+			}
+		}
+		p.completed = []byteRange{{Start: 0, End: uint64(info.Size()) - 1}}
+		return &p
+	}
+	return nil
+}
+
+// matchesRemote checks that the end of range r of the file at path has
+// the same bytes as the remote file.
+func (dl *download) matchesRemote(path string, r byteRange) error {
+	start := r.Start
+	if r.End-r.Start+1 > foreignCheckSize {
+		start = r.End + 1 - foreignCheckSize
+	}
+	local := make([]byte, r.End-start+1)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(local, int64(start)); err != nil {
+		return fmt.Errorf("error reading partial file: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, r.End))
+	dl.setHeaders(req)
+	resp, err := dl.do(req)
+	if err != nil {
+		return fmt.Errorf("error checking partial file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("error checking partial file: status %d", resp.StatusCode)
+	}
+	remote := make([]byte, len(local))
+	if _, err := io.ReadFull(resp.Body, remote); err != nil {
+		return fmt.Errorf("error checking partial file: %w", err)
+	}
+	if !bytes.Equal(local, remote) {
+		return errors.New("it doesn't match the remote file")
+	}
+	return nil
+}
+
+// parseAria2Control returns the completed ranges recorded in an aria2
+// control file for a download of size bytes. Pieces aria2 was still
+// working on are left out, to be fetched again.
+func parseAria2Control(data []byte, size uint64) ([]byteRange, error) {
+	if len(data) < 2 {
+		return nil, errors.New("truncated control file")
+	}
+	// Version 1 is big-endian; version 0 is in the byte order of the
+	// machine that wrote it, taken to be little-endian as nearly all are
+	var order binary.ByteOrder
+	switch binary.BigEndian.Uint16(data) {
+	case 0:
+		order = binary.LittleEndian
+	case 1:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("unknown control file version")
+	}
+
+	rest := data[2:]
+	next := func(n int) ([]byte, error) {
+		if len(rest) < n {
+			return nil, errors.New("truncated control file")
+		}
+		b := rest[:n]
+		rest = rest[n:]
+		return b, nil
+	}
+	// Skip the extension, and the info hash, which only torrents have
+	if _, err := next(4); err != nil {
+		return nil, err
+	}
+	b, err := next(4)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := next(int(order.Uint32(b))); err != nil {
+		return nil, err
+	}
+
+	if b, err = next(4); err != nil {
+		return nil, err
+	}
+	pieceLength := uint64(order.Uint32(b))
+	if b, err = next(8); err != nil {
+		return nil, err
+	}
+	if total := order.Uint64(b); total != size {
+		return nil, fmt.Errorf("it is for a file of %d bytes, not %d", total, size)
+	}
+	if pieceLength == 0 {
+		return nil, errors.New("invalid piece length")
+	}
+	if _, err := next(8); err != nil { // uploaded, only for torrents
+		return nil, err
+	}
+	if b, err = next(4); err != nil {
+		return nil, err
+	}
+	pieces := (size + pieceLength - 1) / pieceLength
+	if uint64(order.Uint32(b)) != (pieces+7)/8 {
+		return nil, errors.New("bitfield doesn't match the file size")
+	}
+	bitfield, err := next(int((pieces + 7) / 8))
+	if err != nil {
+		return nil, err
+	}
+
+	var completed []byteRange
+	for i := range pieces {
+		if bitfield[i/8]&(0x80>>(i%8)) == 0 {
+			continue
+		}
+		start := i * pieceLength
+		completed = append(completed, byteRange{Start: start, End: min(start+pieceLength, size) - 1})
+	}
+	return mergeRanges(completed), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const (
+	// hashChunkSize is how much of a file is read at a time for hashing.
+	hashChunkSize = 4 << 20
+	// hashReadAhead is how many chunks may be read ahead of the slowest
+	// hash.
+	hashReadAhead = 4
+)
+
+// hashChunk is a chunk of a file being hashed, returned to the pool
+// once every hash is done with it.
+type hashChunk struct {
+	buf  []byte
+	refs atomic.Int32
+}
+
+// hashFile writes the contents of the file at path to each of hashes,
+// showing its progress in a bar labeled description, or none if it is
+// empty. The next chunks are read while the last ones are hashed, and
+// each hash runs on a core of its own, so verifying a large file takes
+// about as long as reading it or computing its slowest hash, rather than
+// the sum of them all.
+func hashFile(path, description string, hashes ...io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	opts := barOptions(description)
+	if description == "" {
+		opts = append(opts, progressbar.OptionSetVisibility(false))
+	}
+	bar := progressbar.NewOptions64(info.Size(), opts...)
+
+	free := make(chan []byte, hashReadAhead)
+	for range hashReadAhead {
+		free <- make([]byte, hashChunkSize)
+	}
+	var wg sync.WaitGroup
+	queues := make([]chan *hashChunk, len(hashes))
+	for i, h := range hashes {
+		queues[i] = make(chan *hashChunk, hashReadAhead)
+		wg.Add(1)
+		go func(queue <-chan *hashChunk) {
+			defer wg.Done()
+			for c := range queue {
+				h.Write(c.buf)
+				if c.refs.Add(-1) == 0 {
+					free <- c.buf[:cap(c.buf)]
+				}
+			}
+		}(queues[i])
+	}
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		buf := <-free
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			c := &hashChunk{buf: buf[:n]}
+			c.refs.Store(int32(len(queues)))
+			for _, q := range queues {
+				q <- c
+			}
+			bar.Add64(int64(n))
+		} else {
+			free <- buf
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", path, err)
+		}
+	}
+}
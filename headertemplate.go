@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestVars are the values of the variables a -header value may
+// contain, which are expanded for each request: the part it is for,
+// numbered from 0 as in messages, how many times the part has been
+// requested including this time, and the bytes requested. Requests that
+// aren't for a part, such as the first HEAD, have part 0, attempt 1, and
+// an empty range.
+type requestVars struct {
+	part, attempt int
+	// start and end are the bytes of the remote file requested, if
+	// hasRange is set.
+	start, end uint64
+	hasRange   bool
+}
+
+// expand replaces the variables in header value v.
+func (rv requestVars) expand(v string) string {
+	if !strings.Contains(v, "{") {
+		return v
+	}
+	var start, end, rng string
+	if rv.hasRange {
+		start = strconv.FormatUint(rv.start, 10)
+		end = strconv.FormatUint(rv.end, 10)
+		rng = start + "-" + end
+	}
+	return strings.NewReplacer(
+		"{part}", strconv.Itoa(rv.part),
+		"{attempt}", strconv.Itoa(max(rv.attempt, 1)),
+		"{start}", start,
+		"{end}", end,
+		"{range}", rng,
+	).Replace(v)
+}
+
+// setHeadersFor sets the -header headers and the like on req, with their
+// variables expanded for rv.
+func (dl *download) setHeadersFor(req *http.Request, rv requestVars) {
+	for name, values := range dl.headers {
+		expanded := make([]string, len(values))
+		for i, v := range values {
+			expanded[i] = rv.expand(v)
+		}
+		req.Header[name] = expanded
+	}
+	// Go sends req.Host, ignoring a Host header
+	if host := rv.expand(dl.headers.Get("Host")); host != "" {
+		req.Host = host
+	}
+}
+
+// bustCache adds dl.retryParam to the query of req, a request made again
+// after an earlier one failed, with a value no cache has seen, so a CDN
+// that cached a bad response can't serve it again.
+func (dl *download) bustCache(req *http.Request) {
+	q := req.URL.Query()
+	q.Set(dl.retryParam, strconv.FormatInt(time.Now().UnixNano(), 36))
+	req.URL.RawQuery = q.Encode()
+}
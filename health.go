@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// healthInterval is how often a download's speed is checked by
+	// default.
+	healthInterval = time.Minute
+	// degradedRatio is how many times slower than its best a connection
+	// must have become for the download to count as degraded.
+	degradedRatio = 3
+)
+
+// connTracker records the open connections of a download's client, so
+// they can all be dropped at once, including those busy with a request.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+type trackedConn struct {
+	net.Conn
+	t    *connTracker
+	once sync.Once
+}
+
+// NetConn returns the underlying connection, as tls.Conn's does.
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		delete(c.t.conns, c)
+		c.t.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// dial wraps dial so the connections it opens are tracked.
+func (t *connTracker) dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &trackedConn{Conn: conn, t: t}
+		t.mu.Lock()
+		if t.conns == nil {
+			t.conns = make(map[*trackedConn]struct{})
+		}
+		t.conns[c] = struct{}{}
+		t.mu.Unlock()
+		return c, nil
+	}
+}
+
+// closeAll closes every open connection and returns how many there were.
+func (t *connTracker) closeAll() int {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// watchHealth checks the speed of each connection every health interval
+// until stop is closed. When it has fallen to a fraction of the best seen,
+// the connections may be pinned to a struggling server or CDN node, so
+// all of them are dropped. Parts then reconnect where they left off, and
+// since Go doesn't cache DNS answers, the new connections look the host
+// up again and may well reach a healthier node.
+func (dl *download) watchHealth(stop <-chan struct{}) {
+	ticker := time.NewTicker(dl.healthInterval)
+	defer ticker.Stop()
+
+	last := dl.written.Load()
+	var best float64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			written := dl.written.Load()
+			running := dl.runningParts()
+			if running == 0 {
+				last = written
+				continue
+			}
+			// Compare per connection, since fewer parts are left
+			// running toward the end of the download
+			speed := float64(written-last) / dl.healthInterval.Seconds() / float64(running)
+			last = written
+			if speed*degradedRatio >= best {
+				best = max(best, speed)
+				continue
+			}
+			if dl.conns == nil {
+				continue
+			}
+			dl.stats.resets.Add(1)
+			if n := dl.conns.closeAll(); n > 0 {
+				dl.warn("Transfer slowed to %s/s per connection from %s/s; reconnecting %d connection(s).",
+					formatBytes(speed), formatBytes(best), n)
+			}
+			// Measure the new connections afresh
+			best = 0
+		}
+	}
+}
+
+// runningParts returns how many parts are still being fetched.
+func (dl *download) runningParts() int {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	n := 0
+	for _, p := range dl.parts {
+		if p.offset <= p.endByte {
+			n++
+		}
+	}
+	return n
+}
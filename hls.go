@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hlsVariant is a variant stream listed by an HLS master playlist.
+type hlsVariant struct {
+	uri       string
+	bandwidth int64
+}
+
+// parseHLS parses the HLS playlist data, fetched from base. A master
+// playlist returns its variants; a media playlist returns its stream.
+// Encrypted streams aren't supported.
+func parseHLS(base *url.URL, data []byte) ([]hlsVariant, *streamManifest, error) {
+	m := &streamManifest{kind: "HLS", uri: base.String(), live: true, refresh: 5 * time.Second, ext: ".ts"}
+	var variants []hlsVariant
+	var variant *hlsVariant
+	var rng *byteRange
+	var seq int64
+	// next is where a byte range without an offset starts: right after
+	// the previous segment's
+	var next uint64
+
+	resolve := func(ref string) (string, error) {
+		u, err := base.Parse(ref)
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			attrs := parseAttributes(value)
+			bandwidth, _ := strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			variant = &hlsVariant{bandwidth: bandwidth}
+		case tag == "#EXT-X-TARGETDURATION":
+			secs, err := strconv.ParseFloat(value, 64)
+			if err != nil || secs <= 0 {
+				return nil, nil, fmt.Errorf("invalid target duration %q", value)
+			}
+			m.refresh = time.Duration(secs * float64(time.Second))
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid media sequence %q", value)
+			}
+			seq = n
+		case tag == "#EXT-X-ENDLIST":
+			m.live = false
+		case tag == "#EXT-X-KEY":
+			if method := parseAttributes(value)["METHOD"]; method != "NONE" {
+				return nil, nil, fmt.Errorf("encrypted streams (%s) aren't supported", method)
+			}
+		case tag == "#EXT-X-MAP":
+			attrs := parseAttributes(value)
+			uri, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, nil, err
+			}
+			m.init = &segment{uri: uri, seq: -1}
+			if attrs["BYTERANGE"] != "" {
+				r, err := parseHLSByteRange(attrs["BYTERANGE"], 0)
+				if err != nil {
+					return nil, nil, err
+				}
+				m.init.rng = &r
+			}
+			// Segments with an initialization section are fragmented MP4
+			m.ext = ".mp4"
+		case tag == "#EXT-X-BYTERANGE":
+			r, err := parseHLSByteRange(value, next)
+			if err != nil {
+				return nil, nil, err
+			}
+			rng = &r
+		case strings.HasPrefix(line, "#"):
+			// Durations, discontinuities, and other tags don't change
+			// what is saved
+		default:
+			uri, err := resolve(line)
+			if err != nil {
+				return nil, nil, err
+			}
+			if variant != nil {
+				variant.uri = uri
+				variants = append(variants, *variant)
+				variant = nil
+				continue
+			}
+			if len(m.segments) >= maxSegments {
+				return nil, nil, errors.New("too many segments")
+			}
+			m.segments = append(m.segments, segment{uri: uri, rng: rng, seq: seq})
+			if rng != nil {
+				next = rng.End + 1
+			}
+			rng = nil
+			seq++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(variants) > 0 {
+		return variants, nil, nil
+	}
+	if len(m.segments) == 0 && !m.live {
+		return nil, nil, errors.New("no segments")
+	}
+	return nil, m, nil
+}
+
+// parseAttributes parses an HLS attribute list: NAME=value pairs
+// separated by commas, where quoted values may contain commas.
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(name)] = value
+		s = strings.TrimPrefix(rest, ",")
+	}
+	return attrs
+}
+
+// parseHLSByteRange parses a byte range as "length[@offset]", starting at
+// next when the offset is left out.
+func parseHLSByteRange(s string, next uint64) (byteRange, error) {
+	length, offset, hasOffset := strings.Cut(s, "@")
+	n, err := strconv.ParseUint(length, 10, 64)
+	if err != nil || n == 0 {
+		return byteRange{}, fmt.Errorf("invalid byte range %q", s)
+	}
+	start := next
+	if hasOffset {
+		if start, err = strconv.ParseUint(offset, 10, 64); err != nil {
+			return byteRange{}, fmt.Errorf("invalid byte range %q", s)
+		}
+	}
+	return byteRange{Start: start, End: start + n - 1}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// hostUsage is the traffic received from one host.
+type hostUsage struct {
+	bytes int64
+	// time is how long responses from the host took to arrive, summed
+	// over connections, so bytes/time is the speed of one connection.
+	time time.Duration
+}
+
+// hostReport breaks the traffic of a session down by host, to tell
+// which servers and mirrors are slow.
+type hostReport map[string]*hostUsage
+
+// add records n bytes received from host over d.
+func (r hostReport) add(host string, n int64, d time.Duration) {
+	u := r[host]
+	if u == nil {
+		u = &hostUsage{}
+		r[host] = u
+	}
+	u.bytes += n
+	u.time += d
+}
+
+// merge adds the traffic in other to r.
+func (r hostReport) merge(other hostReport) {
+	for host, o := range other {
+		u := r[host]
+		if u == nil {
+			u = &hostUsage{}
+			r[host] = u
+		}
+		u.bytes += o.bytes
+		u.time += o.time
+	}
+}
+
+// print writes the report to w, the most used host first.
+func (r hostReport) print(w io.Writer) {
+	hosts := make([]string, 0, len(r))
+	width := len("Host")
+	for host := range r {
+		hosts = append(hosts, host)
+		width = max(width, len(host))
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if r[hosts[i]].bytes != r[hosts[j]].bytes {
+			return r[hosts[i]].bytes > r[hosts[j]].bytes
+		}
+		return hosts[i] < hosts[j]
+	})
+
+	fmt.Fprintf(w, "%-*s  %10s  %10s  %14s\n", width, "Host", "Received", "Time", "Per connection")
+	for _, host := range hosts {
+		u := r[host]
+		speed := "-"
+		if s := u.time.Seconds(); s > 0 {
+			speed = formatBytes(float64(u.bytes)/s) + "/s"
+		}
+		fmt.Fprintf(w, "%-*s  %10s  %10s  %14s\n", width, host, formatBytes(float64(u.bytes)), u.time.Round(time.Second/10), speed)
+	}
+}
+
+// recordHost adds n bytes of resp received over d to the download's
+// traffic by host. The host is the one that answered, after redirects.
+func (dl *download) recordHost(resp *http.Response, n int64, d time.Duration) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.hosts == nil {
+		dl.hosts = make(hostReport)
+	}
+	dl.hosts.add(resp.Request.URL.Host, n, d)
+}
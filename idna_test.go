@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestHostToASCII(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"MÜNCHEN.DE", "xn--mnchen-3ya.de"},
+		{"xn--mnchen-3ya.de", "xn--mnchen-3ya.de"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"☃.net", "xn--n3h.net"},
+		{"faß.de", "xn--fa-hia.de"},
+		{"ñ", "xn--ida"},
+	}
+	for _, tt := range tests {
+		if got := hostToASCII(tt.host); got != tt.want {
+			t.Errorf("hostToASCII(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// niceWriteback is how much a nice writer writes before it has the
+	// data written back to the device.
+	niceWriteback = 4 << 20
+	// niceSlowdown is how many times longer than usual a write must
+	// take for the disk to count as busy with other work.
+	niceSlowdown = 4
+)
+
+// niceWriter keeps a download from hogging the disk, for -io-nice. It
+// lets one part write at a time, has the data written back to the
+// device little and often rather than in large bursts, and when a write
+// takes much longer than usual, because the disk is busy with other
+// work, holds off further writes for as long again.
+type niceWriter struct {
+	out io.WriterAt
+
+	mu sync.Mutex
+	// latency is the smoothed time a write takes.
+	latency time.Duration
+	// dirty counts the bytes written since writeback was last started.
+	dirty int64
+}
+
+func (nw *niceWriter) WriteAt(b []byte, off int64) (int, error) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	start := time.Now()
+	n, err := nw.out.WriteAt(b, off)
+	nw.dirty += int64(n)
+	if nw.dirty >= niceWriteback {
+		if f, _ := backingFile(nw.out, off); f != nil {
+			startWriteback(f)
+		}
+		nw.dirty = 0
+	}
+	took := time.Since(start)
+
+	if nw.latency > 0 && took > niceSlowdown*nw.latency {
+		time.Sleep(took)
+	}
+	nw.latency = time.Duration(smooth(float64(nw.latency), float64(took)))
+	return n, err
+}
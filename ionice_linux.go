@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// ioprioWhoProcess has ioprio_set apply to a single thread.
+	ioprioWhoProcess = 1
+	// ioprioClassIdle is the idle I/O scheduling class, shifted into
+	// place.
+	ioprioClassIdle = 3 << 13
+)
+
+// lowerIOPriority puts every thread of the process in the idle I/O
+// scheduling class, so its disk access only gets time no other process
+// wants. Threads started later inherit the class.
+func lowerIOPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
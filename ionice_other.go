@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// lowerIOPriority is only supported on Linux.
+func lowerIOPriority() error {
+	return errors.New("not supported on this system")
+}
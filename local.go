@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localCopyChunk is how much of a local file is copied between progress
+// updates. Copying file to file lets the kernel move the data directly
+// (copy_file_range on Linux) without passing through dl.
+const localCopyChunk = 64 << 20
+
+// localPath returns the file system path for a file: URI or a path, or
+// "" if source refers to a remote file. Anything else without a scheme
+// only counts as a path if it starts like one, such as with / or ./, or
+// names a file that exists, so a URI missing its scheme, such as
+// example.com/file.iso, is reported as that rather than as a missing
+// file.
+func localPath(source string) string {
+	if filepath.VolumeName(source) != "" {
+		// A Windows path such as C:\\data\\file.iso
+		return source
+	}
+	if strings.HasPrefix(source, "file:") {
+		u, err := url.Parse(source)
+		if err != nil {
+			return ""
+		}
+		if u.Opaque != "" {
+			// file:data/file.iso, relative to the current directory
+			return filepath.FromSlash(u.Opaque)
+		}
+		return filepath.FromSlash(u.Path)
+	}
+	if strings.Contains(source, "://") {
+		return ""
+	}
+	if filepath.IsAbs(source) || strings.HasPrefix(source, "/") {
+		return source
+	}
+	for _, prefix := range []string{"./", "../", "." + string(filepath.Separator), ".." + string(filepath.Separator)} {
+		if strings.HasPrefix(source, prefix) {
+			return source
+		}
+	}
+	if _, err := os.Stat(source); err == nil {
+		return source
+	}
+	return ""
+}
+
+// statLocal fills in the metadata of a local source.
+func (dl *download) statLocal() error {
+	info, err := os.Stat(dl.localPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", dl.localPath)
+	}
+	dl.filesize = uint64(info.Size())
+	dl.filename = filepath.Base(dl.localPath)
+	return nil
+}
+
+// checkLocalOutput refuses to copy a local source onto itself, which
+// would truncate it.
+func (dl *download) checkLocalOutput() error {
+	srcInfo, err := os.Stat(dl.localPath)
+	if err != nil {
+		return err
+	}
+	if dstInfo, err := os.Stat(dl.outputPath()); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return fmt.Errorf("%s is the same file as the output", dl.localPath)
+	}
+	return nil
+}
+
+// copyLocal copies a local source to the output file, cloning it when
+// the file system supports it.
+func (dl *download) copyLocal(ctx context.Context) error {
+	src, err := os.Open(dl.localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	outFile, err := os.Create(dl.outputPath())
+	if err != nil {
+		return fmt.Errorf("cannot create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	dl.progress = dl.newReporter()
+	if reflink(outFile, src) == nil {
+		dl.addProgress(int64(dl.filesize))
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.CopyN(outFile, src, localCopyChunk)
+		dl.addProgress(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error copying %s: %w", dl.localPath, err)
+		}
+	}
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
-
-	"github.com/schollz/progressbar/v3"
+	"time"
 )
 
 // offsetWriter implements io.Writer by writing to an io.WriterAt
@@ -32,49 +40,1247 @@ func (ow *offsetWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// minSplitSize is the smallest remaining range worth splitting off to an
+// idle worker. Below this, setting up a new connection costs more than
+// it saves.
+const minSplitSize = 4 << 20
+
+// errRangeSplit stops a part's transfer once another worker has taken
+// over the rest of its range.
+var errRangeSplit = errors.New("range split off to another worker")
+
 type downloadPart struct {
 	index     int
 	uri       string
 	startByte uint64
 	endByte   uint64
+
+	// offset is the next byte of the part to write. Once the part is
+	// running, offset and endByte are guarded by download.mu because an
+	// idle worker may split off the tail of the range.
+	offset uint64
+	// committed is the next byte not yet on disk. It trails offset
+	// while a write is in flight and is what progress is saved from.
+	committed uint64
+
+	// resp, if set, answers the part's first request, which was sent
+	// ahead of time. Only the worker fetching the part touches it.
+	resp *http.Response
+	// nearEnd, if set, is called once when the part is about to finish,
+	// so the worker can request its next part.
+	nearEnd func()
+	// conns records how the part's requests got their connections. It
+	// is guarded by download.mu.
+	conns connTrace
+	// attempts counts the requests made for the part. Only the worker
+	// fetching the part touches it, or the one requesting it ahead.
+	attempts int
+}
+
+// partWriter writes a part's response body at the part's offset in the
+// output file, stopping once the part's (possibly shrunk) end is reached.
+type partWriter struct {
+	dl   *download
+	part *downloadPart
+	w    io.WriterAt
+	// start is when the response arrived and got how much of it was
+	// written, to tell when the part is about to finish.
+	start time.Time
+	got   int64
+	// sum, if set, checksums everything written, for -verify-writes.
+	sum hash.Hash32
+}
+
+func (pw *partWriter) Write(b []byte) (int, error) {
+	pw.dl.mu.Lock()
+	offset, end := pw.part.offset, pw.part.endByte
+	var room uint64
+	if offset <= end {
+		room = end - offset + 1
+	}
+	split := uint64(len(b)) > room
+	if split {
+		b = b[:room]
+	}
+	pw.part.offset += uint64(len(b))
+	pw.dl.mu.Unlock()
+
+	n, err := pw.w.WriteAt(b, int64(offset))
+	pw.dl.mu.Lock()
+	pw.part.committed = offset + uint64(n)
+	pw.dl.mu.Unlock()
+	pw.dl.addProgress(int64(n))
+	if pw.sum != nil {
+		pw.sum.Write(b[:n])
+	}
+	if err != nil {
+		return n, err
+	}
+	pw.got += int64(n)
+	if pw.part.nearEnd != nil && !split && pw.dl.nearEnd(end-offset+1-uint64(n), pw.got, pw.start) {
+		pw.part.nearEnd()
+		pw.part.nearEnd = nil
+	}
+	if split {
+		return n, errRangeSplit
+	}
+	return n, nil
 }
 
 type download struct {
 	uri           string
+	localPath     string
 	filesize      uint64
 	filename      string
 	workingDir    string
 	boost         int
-	parts         []downloadPart
+	parts         []*downloadPart
 	supportsRange bool
+	etag          string
+	lastModified  string
+	contentType   string
+	header        http.Header
+	mirrors       []string
+	headers       http.Header
+	retryParam    string
+	redirects     []string
+	scheduler     string
+	webdav        bool
+	// stream treats the URI as an HLS or DASH manifest, and manifest is
+	// the stream it lists.
+	stream   bool
+	manifest *streamManifest
+	// compressed accepts compressed responses, and contentEncoding is
+	// the coding the server answered the HEAD request with.
+	compressed      bool
+	contentEncoding string
+	unwrapPages     bool
+	checkPages      bool
+	unwraps         int
+	modTime         time.Time
+	speedLimit      int64
+	limiter         *rateLimiter
+	ttfb            time.Duration
+	coalesce        bool
+	warmConns       bool
+	speedTime       time.Duration
+	saveInterval    time.Duration
+	progressFile    string
+	pieceHashes     string
+	checksum        *checksum
+	strategy        string
+	verifyWrites    bool
+	// trustNames keeps the directories in filenames servers suggest,
+	// and unsafeName is one that was refused as unsafe.
+	trustNames bool
+	unsafeName string
+	// chaos is the probability of each fault injected with -chaos.
+	chaos     float64
+	keepGoing bool
+	sweeps    int
+	batch     *batchPosition
+	// extract, if set, is the part of the remote file downloaded with
+	// -range; filesize is then its length.
+	extract *byteRange
+	// s3ETag, if set, is the ETag of an S3 compatible server, which
+	// the file is verified against when there is no checksum.
+	s3ETag *s3ETag
+	// pieceSum, if set, is the hash of the whole file from the Metalink
+	// whose pieces were reused, checked once it is complete in case the
+	// Metalink was out of date.
+	pieceSum *checksum
+	// client makes the download's requests, pooling connections within
+	// the download only. If nil, the shared httpClient is used.
+	client *http.Client
+	// healthInterval is how often the speed is checked for the
+	// connections to be dropped if it has fallen off; zero disables it.
+	healthInterval time.Duration
+	// conns tracks the connections client opens.
+	conns *connTracker
+	// ioNice keeps the download's disk writes from getting in the way
+	// of other work.
+	ioNice bool
+	// reorderWindow, if set, is how much of what parts receive is held
+	// to be written in ascending order, by reorder while a Fetch runs.
+	reorderWindow int64
+	reorder       *orderedWriter
+	// pause, if set, is a daily window during which the download is
+	// stopped, to be resumed once it is over.
+	pause *pauseWindow
+	// multipath, if set, spreads client's connections over several
+	// network interfaces.
+	multipath *multipath
+	// mptcp is set when client asks for Multipath TCP.
+	mptcp bool
+
+	// completed holds the ranges finished by earlier runs when resuming.
+	completed []byteRange
+	resumed   uint64
+
+	// mu guards parts and the progress of running parts, and hosts,
+	// and filesize while it changes during a transfer.
+	mu    sync.Mutex
+	sched scheduler
+	hosts hostReport
+
+	progress progressReporter
+	// session, if set, receives the progress of every download of the
+	// session, which tells them apart by id.
+	session sessionReporter
+	id      int
+	// written counts bytes written to the output file.
+	written atomic.Int64
+	stats   downloadStats
+}
+
+// downloadStats are counters collected while fetching, so the behavior of
+// the schedulers can be compared against a given server.
+type downloadStats struct {
+	// requests counts every ranged or single-stream GET issued.
+	requests atomic.Int64
+	// reconnects counts ranged requests re-issued after a server closed
+	// a connection before delivering the full range.
+	reconnects atomic.Int64
+	// splits counts parts whose remaining range was handed to an idle worker.
+	splits atomic.Int64
+	// resets counts the times every connection was dropped because the
+	// transfer had slowed down.
+	resets atomic.Int64
+	// newConns and reusedConns count requests that opened a connection
+	// and that took one from the pool. resumedTLS counts TLS handshakes
+	// that resumed an earlier session.
+	newConns    atomic.Int64
+	reusedConns atomic.Int64
+	resumedTLS  atomic.Int64
+	// mptcpConns counts new connections that use Multipath TCP.
+	mptcpConns atomic.Int64
+}
+
+// stringSliceFlag is a flag.Value that collects every occurrence of a
+// repeatable flag.
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringSliceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// durationFlag is a flag.Value for Go-style durations such as "90s" or
+// "1m30s". Unlike flag.Duration, it reports why a value is invalid, for
+// example that a bare "30" is missing its unit.
+type durationFlag time.Duration
+
+func (d *durationFlag) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationFlag) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("duration must not be negative")
+	}
+	*d = durationFlag(v)
+	return nil
 }
 
-func main() {
-	filenamePtr := flag.String("filename", "", "custom filename")
-	boostPtr := flag.Int("boost", 8, "number of concurrent downloads")
+// subcommand is run as "dl <name> [args]" in place of a download.
+type subcommand struct {
+	name    string
+	summary string
+	// run is nil for subcommands that take the flags of a download, which
+	// main handles itself.
+	run func(args []string) error
+}
+
+func subcommands() []subcommand {
+	return []subcommand{
+		{name: "cache", summary: "list, remove, or prune cached downloads", run: runCache},
+		{name: "completion", summary: "print a shell completion script", run: runCompletion},
+		{name: "mirror", summary: "bring a local directory up to date with a remote one"},
+		{name: "usage", summary: "show how much has been downloaded per month", run: runUsage},
+		{name: "version", summary: "print the version and build details", run: runVersion},
+	}
+}
+
+func main() {
+	profilePtr := flag.String("profile", "", "apply this profile from the config file; by default, the first profile whose rules match the Wi-Fi network or hostname (none to use no profile)")
+	inputPtr := flag.String("i", "", "read download URIs from this file, one per line (- for standard input)")
+	curlCompatPtr := flag.String("curl-compat", "", "read URLs, output names, and headers from this curl config file, as used with curl -K (- for standard input)")
+	filenamePtr := flag.String("filename", "", "custom filename, or path to save the file at; a directory, ending in /, keeps the file's own name")
+	boostPtr := flag.Int("boost", 8, "number of concurrent downloads")
+	poolSizePtr := flag.Int("pool-size", 0, "idle connections kept open for reuse per host (default twice -boost)")
+	schedulerPtr := flag.String("scheduler", "tail-split", "how parts are assigned to connections: "+schedulerNames())
+	noPreconnectPtr := flag.Bool("no-preconnect", false, "don't set up the connections for all parts before the transfer starts")
+	strategyPtr := flag.String("strategy", "writeat", "how parts are written: writeat (into the output file) or partfiles (to separate files joined at the end)")
+	coalescePtr := flag.String("coalesce", "auto", "use fewer, larger ranges requested ahead of time: auto (when the server is slow to respond), on, or off")
+	dryRunPtr := flag.Bool("dry-run", false, "print what the server reports about each file, such as its size and name, without downloading it")
+	keepGoingPtr := flag.Bool("keep-going", false, "when a part fails, let the other parts finish before retrying its range, instead of stopping them at once")
+	sweepsPtr := flag.Int("sweeps", 1, "times to retry the ranges failed parts left incomplete before giving up")
+	waitForNetworkPtr := flag.Bool("wait-for-network", false, "when the network goes down, wait for it to come back and carry on instead of failing")
+	portalCheckPtr := flag.String("portal-check", defaultPortalCheck, "URI answering 204 No Content, requested when a download fails to tell whether a captive portal is in the way (empty to never check)")
+	noPortalCheckPtr := flag.Bool("no-portal-check", false, "never check for a captive portal when a download fails")
+	waitForSpacePtr := flag.Bool("wait-for-space", false, "when the disk fills up, wait for you to free up space instead of exiting")
+	quarantinePtr := flag.Bool("quarantine", false, "when a download fails, move what was downloaded so far into .dl-partial, from where the next run resumes it")
+	statsPtr := flag.Bool("stats", false, "print transfer statistics after each download")
+	speedLimitPtr := flag.Int64("speed-limit", 0, "abort if the speed stays below this many bytes per second for -speed-time")
+	speedTime := durationFlag(30 * time.Second)
+	flag.Var(&speedTime, "speed-time", "how long the speed may stay below -speed-limit, as a `duration` such as 30s")
+	healthCheck := durationFlag(healthInterval)
+	flag.Var(&healthCheck, "health-check", "how often to check whether the transfer has slowed down, reconnecting if so, as a `duration` (0 to never check)")
+	saveInterval := durationFlag(progressInterval)
+	flag.Var(&saveInterval, "save-interval", "how often to save the progress of a download, as a `duration` (0 to only save when interrupted)")
+	pieceHashesPtr := flag.String("piece-hashes", "", "Metalink file or URI with the hashes of the file's pieces, so that when it changes, the parts of a partial download that still match are kept (by default, the Metalink the server links to, if any)")
+	progressFilePtr := flag.String("progress-file", defaultProgressFile, "where to save the progress of a download, with {dir}, {name}, {state}, and {id} filled in")
+	connectTimeout := durationFlag(30 * time.Second)
+	flag.Var(&connectTimeout, "connect-timeout", "maximum `duration` to establish a connection, such as 10s or 1m30s")
+	var responseTimeout durationFlag
+	flag.Var(&responseTimeout, "response-timeout", "maximum `duration` to wait for a server to start responding (0 for no limit)")
+	streamPtr := flag.Bool("stream", false, "treat URIs as HLS playlists (.m3u8) or DASH manifests (.mpd), saving the stream they list as a single file")
+	rangePtr := flag.String("range", "", "download only this part of each file, as start-end (end excluded), start-, or -length, with sizes such as 100MB-200MB")
+	var expectHeaders stringSliceFlag
+	flag.Var(&expectHeaders, "expect-header", "fail before downloading unless the server's response has this header, as \"Name: value\", where a value ending in * matches any rest (repeatable)")
+	expectSizePtr := flag.String("expect-size", "", "fail before downloading unless the file is this size, such as 4700000000 or 4.7GB")
+	var members stringSliceFlag
+	flag.Var(&members, "extract-member", "treat URIs as zip archives and extract only this member, a path in the archive or a pattern such as 'docs/*.pdf', fetching just its compressed data (repeatable)")
+	compressedPtr := flag.Bool("compressed", false, "accept gzip or deflate compressed responses, decoding them as they arrive; compressed responses are fetched in a single stream")
+	http1Ptr := flag.Bool("http1.1", false, "only use HTTP/1.1, so each part gets its own connection rather than sharing one over HTTP/2")
+	tlsKeylogPtr := flag.String("tls-keylog", "", "append TLS session secrets to this file for decrypting captures, as SSLKEYLOGFILE does (default $SSLKEYLOGFILE)")
+	limitPtr := flag.String("limit", "", "maximum combined download rate, such as 500K or 2MiB (per second)")
+	limitBurstPtr := flag.String("limit-burst", "", "how far ahead of -limit a transfer may get after a pause, such as 64K (default one second's worth)")
+	var resolveFlags stringSliceFlag
+	flag.Var(&resolveFlags, "resolve", "connect to this address for a host and port, as `host:port:address`, keeping the URL's host for the Host header and TLS (repeatable)")
+	sniPtr := flag.String("sni", "", "send this TLS server name, and check the server's certificate against it, instead of the URL's host")
+	mptcpPtr := flag.Bool("mptcp", false, "use Multipath TCP where the kernel and server support it, so connections can use several paths at once (Linux)")
+	multipathPtr := flag.String("multipath", "", "experimental: spread connections over these network interfaces, such as eth0,wwan0, to add up their bandwidth (implies -http1.1)")
+	limitModePtr := flag.String("limit-mode", "bucket", "how -limit is enforced: bucket (sleep after reading) or pace (space reads evenly, letting TCP slow the sender)")
+	limitChunkPtr := flag.String("limit-chunk", "", "the most read at once under -limit, such as 4K; smaller is smoother (default 16K)")
+	unitsPtr := flag.String("units", "binary", "units for sizes and speeds: binary (KiB, MiB) or si (kB, MB)")
+	fixExtensionPtr := flag.Bool("fix-extension", false, "append the extension matching the Content-Type when the filename has none")
+	checksumPtr := flag.String("checksum", "", "expected checksum of the file as algo:hex (md5, sha1, sha256, sha384, sha512)")
+	integrityPtr := flag.String("integrity", "", "expected checksum of the file as Subresource Integrity metadata, such as sha384-<base64>")
+	ioNicePtr := flag.Bool("io-nice", false, "go easy on the disk, so other work on it stays responsive: lowest I/O priority (Linux) and paced writes")
+	chaosPtr := flag.Float64("chaos", 0, "inject part failures, responses ended early, short reads, and stalls, each with this probability, to test recovery")
+	reorderWindowPtr := flag.String("reorder-window", "", "hold up to this much of what parts receive, such as 256MB, and write it in ascending order, for shingled (SMR) and USB drives that slow down under scattered writes")
+	verifyWritesPtr := flag.Bool("verify-writes", false, "read everything back from disk after writing it, to catch storage that silently corrupts data")
+	exportPtr := flag.String("export", "", "after each download, write a descriptor to share it with: metalink (a .meta4 file with its URIs and SHA-256) or torrent (a .torrent with its URIs as web seeds)")
+	eventsPtr := flag.String("events", "", "write the start, progress, and end of every download to this file as JSON lines")
+	reportPtr := flag.String("report", "", "write the outcome of every download to this file, as CSV if it ends in .csv and JSON otherwise")
+	manifestPtr := flag.String("manifest", "", "record the URI, size, validators, and SHA-256 of every file downloaded in this JSON file")
+	fromManifestPtr := flag.String("from-manifest", "", "download exactly the files recorded by -manifest in this file, verifying their size and SHA-256")
+	checksumFilePtr := flag.String("checksum-file", "", "file or URI listing checksums in sha256sum or BSD format, such as SHA256SUMS, to verify every download against")
+	verifyRetriesPtr := flag.Int("verify-retries", 0, "times to download again if the checksum doesn't match")
+	allowSchemesPtr := flag.String("allow-schemes", "", "comma separated list of the only URI schemes allowed")
+	denySchemesPtr := flag.String("deny-schemes", "", "comma separated list of URI schemes to refuse")
+	denyPrivatePtr := flag.Bool("deny-private", false, "refuse to connect to loopback, private, and link-local addresses")
+	maxRedirectsPtr := flag.Int("max-redirects", defaultMaxRedirects, "maximum number of redirects to follow")
+	locationTrustedPtr := flag.Bool("location-trusted", false, "keep sending Authorization and Cookie headers when redirected to another host")
+	noProgressPtr := flag.Bool("no-progress", false, "don't show download progress")
+	progressEveryPtr := flag.String("progress-every", "", "instead of a progress bar, print a line of progress every `interval`, as a duration such as 30s or a percentage such as 10% (default 10% when standard error isn't a terminal)")
+	verbosePtr := flag.Bool("verbose", false, "print details such as the redirects followed")
+	webdavPtr := flag.Bool("webdav", false, "treat URIs as WebDAV resources, downloading collections recursively")
+	userPtr := flag.String("user", "", "credentials for HTTP basic authentication as user:password")
+	bearerCommandPtr := flag.String("bearer-command", "", "`command` printing a bearer token to send, such as \"gcloud auth print-access-token\"; it is run again for a new token before the last expires or when a server rejects it")
+	awsSigV4Ptr := flag.String("aws-sigv4", "", "sign requests with AWS Signature Version 4 for this `region/service`, such as us-east-1/s3, with credentials from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY or ~/.aws/credentials")
+	credentialHelperPtr := flag.String("credential-helper", "", "`command` to get credentials for each host from when requests are made, speaking git's credential helper protocol")
+	noResolvePtr := flag.Bool("no-resolve", false, "download share links and mirror redirect pages as-is")
+	trustServerNamesPtr := flag.Bool("trust-server-names", false, "keep the directories in filenames the server suggests, as long as they stay within the download directory")
+	noPageCheckPtr := flag.Bool("no-page-check", false, "download responses that look like error pages, such as HTML in place of an .iso")
+	scrapePtr := flag.String("scrape", "", "treat URIs as HTML pages and download the links on them matching this glob, or /regexp/")
+	sitemapPtr := flag.Bool("sitemap", false, "treat URIs as sitemaps and download the URLs they list")
+	matchPtr := flag.String("match", "", "only download sitemap URLs matching this glob, or /regexp/")
+	startAtPtr := flag.String("start-at", "", "wait until this time to start, as HH:MM (the next occurrence) or RFC 3339")
+	refetchPtr := flag.Bool("refetch", false, "download files again even when the server says they haven't changed since dl last saved them")
+	skipExistingPtr := flag.Bool("skip-existing", false, "skip files already downloaded in full, checking them against their checksums, if any, in the background")
+	cacheDirPtr := flag.String("cache-dir", os.Getenv("DL_CACHE_DIR"), "keep completed downloads in this directory, which may be shared between users, and copy them from there when downloaded again (default $DL_CACHE_DIR)")
+	monthlyQuotaPtr := flag.String("monthly-quota", os.Getenv("DL_MONTHLY_QUOTA"), "refuse to start downloads that would take this month's total past this size, such as 50G (default $DL_MONTHLY_QUOTA)")
+	cacheMaxSizePtr := flag.String("cache-max-size", os.Getenv("DL_CACHE_MAX_SIZE"), "evict the least recently used files once the cache grows past this size, such as 20G (default $DL_CACHE_MAX_SIZE)")
+	var followGrowing, followFor durationFlag
+	flag.Var(&followGrowing, "follow-growing", "after downloading, keep fetching what is appended to the file on the server, until it stops growing for this `duration`")
+	flag.Var(&followFor, "follow-for", "with -follow-growing, stop following after this `duration` even if the file is still growing")
+	cacheMaxAge := durationFlag(0)
+	flag.Var(&cacheMaxAge, "cache-max-age", "evict cached files unused for this long, as a `duration` such as 720h")
+	pauseBetweenPtr := flag.String("pause-between", "", "pause downloads every day between these times, as HH:MM-HH:MM")
+	noRobotsPtr := flag.Bool("no-robots", false, "ignore robots.txt when using -scrape or -sitemap")
+	var headerFlags stringSliceFlag
+	flag.Var(&headerFlags, "header", "extra request header as \"Name: value\" (repeatable); the value may contain {part}, {attempt}, {start}, {end}, and {range}, expanded for each request")
+	retryParamPtr := flag.String("retry-param", "", "add this query parameter, with a value unique to the request, when a part is requested again, so a CDN can't answer from its cache")
+	proxyPtr := flag.String("proxy", "", "proxy for all requests, as http://, https://, socks5://, or socks5h://host:port")
+	torPtr := flag.Bool("tor", false, "route everything through the local Tor daemon at "+torSOCKSAddr+", on a separate circuit for each download")
+	var proxyRules stringSliceFlag
+	flag.Var(&proxyRules, "proxy-rule", "proxy for hosts matching a glob, as \"*.example.com=http://proxy:3128\" or \"host=DIRECT\" (repeatable)")
+	var mirrors stringSliceFlag
+	flag.Var(&mirrors, "mirror", "additional URI serving the same file (repeatable)")
+	deletePtr := flag.Bool("delete", false, "with dl mirror, delete local files that are gone from the remote directory")
+	var alsoTo stringSliceFlag
+	flag.Var(&alsoTo, "also-to", "after each download, also place the file in this directory, cloned or hard linked where possible (repeatable)")
+
+	if len(os.Args) > 1 {
+		for _, cmd := range subcommands() {
+			if os.Args[1] != cmd.name {
+				continue
+			}
+			if cmd.run == nil {
+				break
+			}
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	flag.Usage = printUsage
+	// dl mirror URL_DIR local_dir takes the flags of a download
+	mirrorMode := len(os.Args) > 1 && os.Args[1] == "mirror"
+	if mirrorMode {
+		_ = flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+
+	// Settings from a profile apply as if given on the command line,
+	// unless they actually were
+	profiles, err := readProfiles(configPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	prof, reason, err := selectProfile(profiles, *profilePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if prof != nil {
+		if err := prof.apply(flag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if reason != "" {
+			fmt.Printf("Using profile %s for %s.\n", prof.name, reason)
+		}
+	}
+
+	fileURIs := flag.Args()
+	var mirrorURI, mirrorDir string
+	if mirrorMode {
+		if len(fileURIs) != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: dl mirror [flags] URL_DIR local_dir")
+			os.Exit(1)
+		}
+		if *inputPtr != "" || *curlCompatPtr != "" || *fromManifestPtr != "" || len(mirrors) > 0 || *filenamePtr != "" || *scrapePtr != "" || *sitemapPtr || *webdavPtr || *rangePtr != "" || len(members) > 0 || *streamPtr {
+			fmt.Fprintln(os.Stderr, "dl mirror can't be used with -i, -curl-compat, -from-manifest, -mirror, -filename, -scrape, -sitemap, -webdav, -range, -extract-member, or -stream.")
+			os.Exit(1)
+		}
+		mirrorURI, mirrorDir = fileURIs[0], fileURIs[1]
+		fileURIs = nil
+	} else if *deletePtr {
+		fmt.Fprintln(os.Stderr, "-delete only applies to dl mirror.")
+		os.Exit(1)
+	}
+	if *inputPtr != "" {
+		listed, err := readURIList(*inputPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fileURIs = append(fileURIs, listed...)
+	}
+	var outputs map[string]string
+	if *curlCompatPtr != "" {
+		cfg, err := readCurlConfig(*curlCompatPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fileURIs = append(fileURIs, cfg.urls...)
+		outputs = cfg.outputs
+		headerFlags = append(headerFlags, cfg.headers...)
+		if *userPtr == "" {
+			*userPtr = cfg.user
+		}
+	}
+	var locked *manifest
+	if *fromManifestPtr != "" {
+		if len(fileURIs) > 0 || len(mirrors) > 0 || *filenamePtr != "" || *scrapePtr != "" || *sitemapPtr || *webdavPtr {
+			fmt.Fprintln(os.Stderr, "-from-manifest can't be used with download URIs, -i, -curl-compat, -mirror, -filename, -scrape, -sitemap, or -webdav.")
+			os.Exit(1)
+		}
+		if *checksumPtr != "" || *integrityPtr != "" || *checksumFilePtr != "" {
+			fmt.Fprintln(os.Stderr, "-from-manifest already verifies checksums; it can't be used with -checksum, -integrity, or -checksum-file.")
+			os.Exit(1)
+		}
+		var err error
+		if locked, err = readManifest(*fromManifestPtr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(locked.Files) == 0 {
+			fmt.Fprintln(os.Stderr, "No files in", *fromManifestPtr)
+			os.Exit(1)
+		}
+	} else if len(fileURIs) == 0 && !mirrorMode {
+		fmt.Fprintln(os.Stderr, "No download URI(s) provided.")
+		os.Exit(1)
+	}
+	if len(mirrors) > 0 && len(fileURIs) > 1 {
+		fmt.Fprintln(os.Stderr, "Mirrors can only be used with a single download URI.")
+		os.Exit(1)
+	}
+	for i, uri := range mirrors {
+		normalized, err := normalizeURI(uri)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid mirror URI: %v\n", err)
+			os.Exit(1)
+		}
+		mirrors[i] = normalized
+	}
+
+	var sum *checksum
+	if *checksumPtr != "" || *integrityPtr != "" {
+		if len(fileURIs) > 1 {
+			fmt.Fprintln(os.Stderr, "A checksum can only be used with a single download URI.")
+			os.Exit(1)
+		}
+		if *checksumPtr != "" && *integrityPtr != "" {
+			fmt.Fprintln(os.Stderr, "-checksum and -integrity can't be used together.")
+			os.Exit(1)
+		}
+		var err error
+		if *integrityPtr != "" {
+			sum, err = parseIntegrity(*integrityPtr)
+		} else {
+			sum, err = parseChecksum(*checksumPtr)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing checksum: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *scrapePtr != "" && *sitemapPtr {
+		fmt.Fprintln(os.Stderr, "-scrape and -sitemap can't be used together.")
+		os.Exit(1)
+	}
+	if (*scrapePtr != "" || *sitemapPtr) && (len(mirrors) > 0 || sum != nil) {
+		fmt.Fprintln(os.Stderr, "Mirrors and checksums can't be used with -scrape or -sitemap.")
+		os.Exit(1)
+	}
+	var scrape, match *linkPattern
+	if *scrapePtr != "" {
+		var err error
+		if scrape, err = parseLinkPattern(*scrapePtr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing -scrape pattern: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	portalCheck := *portalCheckPtr
+	if *noPortalCheckPtr {
+		portalCheck = ""
+	}
+	var robots *robotsChecker
+	if (scrape != nil || *sitemapPtr) && !*noRobotsPtr {
+		robots = newRobotsChecker()
+	}
+	if *matchPtr != "" {
+		if !*sitemapPtr {
+			fmt.Fprintln(os.Stderr, "-match can only be used with -sitemap.")
+			os.Exit(1)
+		}
+		var err error
+		if match, err = parseLinkPattern(*matchPtr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing -match pattern: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	units, err := parseUnits(*unitsPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	displayUnits = units
+	var expected []headerExpectation
+	for _, h := range expectHeaders {
+		e, err := parseExpectation(h)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -expect-header: %v\n", err)
+			os.Exit(1)
+		}
+		expected = append(expected, e)
+	}
+	expectSize := int64(-1)
+	if *expectSizePtr != "" {
+		if expectSize, err = parseOffset(*expectSizePtr, units); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -expect-size: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var extract *extractRange
+	if *rangePtr != "" {
+		switch {
+		case *streamPtr:
+			fmt.Fprintln(os.Stderr, "-range can't be used with -stream.")
+			os.Exit(1)
+		case *compressedPtr:
+			fmt.Fprintln(os.Stderr, "-range can't be used with -compressed, as ranges of compressed responses aren't fetched.")
+			os.Exit(1)
+		case followGrowing > 0:
+			fmt.Fprintln(os.Stderr, "-range can't be used with -follow-growing.")
+			os.Exit(1)
+		case *exportPtr != "":
+			fmt.Fprintln(os.Stderr, "-range can't be used with -export, which describes whole files.")
+			os.Exit(1)
+		}
+		r, err := parseExtractRange(*rangePtr, units)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing -range: %v\n", err)
+			os.Exit(1)
+		}
+		extract = &r
+	}
+	if len(members) > 0 {
+		var conflict string
+		switch {
+		case *streamPtr:
+			conflict = "-stream"
+		case *compressedPtr:
+			conflict = "-compressed"
+		case extract != nil:
+			conflict = "-range"
+		case followGrowing > 0:
+			conflict = "-follow-growing"
+		case *exportPtr != "":
+			conflict = "-export"
+		case len(alsoTo) > 0:
+			conflict = "-also-to"
+		}
+		if conflict != "" {
+			fmt.Fprintf(os.Stderr, "-extract-member can't be used with %s.\n", conflict)
+			os.Exit(1)
+		}
+	}
+	var limiter *rateLimiter
+	if *limitPtr != "" {
+		limit, err := parseBandwidthLimit(*limitPtr, units)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		var burst, chunk int64
+		if *limitBurstPtr != "" {
+			if burst, err = parseSize(*limitBurstPtr, units); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -limit-burst: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if *limitChunkPtr != "" {
+			if chunk, err = parseSize(*limitChunkPtr, units); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -limit-chunk: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if !slices.Contains(limitModes, *limitModePtr) {
+			fmt.Fprintf(os.Stderr, "Unknown -limit-mode %q (valid: %s)\n", *limitModePtr, strings.Join(limitModes, ", "))
+			os.Exit(1)
+		}
+		limiter = newRateLimiter(limit, burst, chunk, *limitModePtr)
+	} else if *limitBurstPtr != "" || *limitChunkPtr != "" {
+		fmt.Fprintln(os.Stderr, "-limit-burst and -limit-chunk can only be used with -limit.")
+		os.Exit(1)
+	}
+
+	var startAt time.Time
+	if *startAtPtr != "" {
+		var err error
+		if startAt, err = parseStartAt(*startAtPtr, time.Now()); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -start-at time: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var reorderWindow int64
+	if *reorderWindowPtr != "" {
+		var err error
+		if reorderWindow, err = parseSize(*reorderWindowPtr, units); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -reorder-window: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *ioNicePtr {
+		if err := lowerIOPriority(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot lower I/O priority: %v\n", err)
+		}
+	}
+
+	// Everything downloaded is counted toward the month's usage
+	var meter *usageMeter
+	if path := usagePath(); path != "" {
+		meter = &usageMeter{path: path}
+		go meter.savePeriodically()
+	}
+	var quota int64
+	if *monthlyQuotaPtr != "" {
+		var err error
+		if quota, err = parseSize(*monthlyQuotaPtr, units); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -monthly-quota: %v\n", err)
+			os.Exit(1)
+		}
+		if meter == nil {
+			fmt.Fprintln(os.Stderr, "-monthly-quota needs somewhere to record usage; set DL_USAGE_FILE.")
+			os.Exit(1)
+		}
+	}
+
+	var cache *downloadCache
+	if *cacheDirPtr != "" {
+		var maxSize int64
+		var err error
+		if *cacheMaxSizePtr != "" {
+			if maxSize, err = parseSize(*cacheMaxSizePtr, units); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if cache, err = openCache(*cacheDirPtr, maxSize, time.Duration(cacheMaxAge)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := checkProgressPattern(*progressFilePtr); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -progress-file: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Files downloaded before are skipped while they are unchanged
+	var validators *validatorStore
+	if path := validatorsPath(); path != "" {
+		validators = &validatorStore{path: path}
+	}
+
+	var pause *pauseWindow
+	if *pauseBetweenPtr != "" {
+		var err error
+		if pause, err = parsePauseWindow(*pauseBetweenPtr); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -pause-between window: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	switch {
+	case *noProgressPtr && *progressEveryPtr != "":
+		fmt.Fprintln(os.Stderr, "-no-progress and -progress-every can't be used together.")
+		os.Exit(1)
+	case *noProgressPtr:
+		progressOutput.style = "none"
+	case *progressEveryPtr != "":
+		var err error
+		if progressOutput, err = parseProgressEvery(*progressEveryPtr); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -progress-every: %v\n", err)
+			os.Exit(1)
+		}
+	case !isTerminal(os.Stderr):
+		// Bar redraws would pile up in logs and cron mail
+		progressOutput = progressSettings{style: "lines", percent: 10}
+	}
+	progressOutput.verbose = *verbosePtr
+	if *exportPtr != "" && !slices.Contains(exportFormats, *exportPtr) {
+		fmt.Fprintf(os.Stderr, "Unknown -export %q (valid: %s)\n", *exportPtr, strings.Join(exportFormats, ", "))
+		os.Exit(1)
+	}
+	if !slices.Contains(strategies, *strategyPtr) {
+		fmt.Fprintf(os.Stderr, "Unknown -strategy %q (valid: %s)\n", *strategyPtr, strings.Join(strategies, ", "))
+		os.Exit(1)
+	}
+	if !slices.Contains(coalesceModes, *coalescePtr) {
+		fmt.Fprintf(os.Stderr, "Unknown -coalesce mode %q (valid: %s)\n", *coalescePtr, strings.Join(coalesceModes, ", "))
+		os.Exit(1)
+	}
+	if *chaosPtr < 0 || *chaosPtr > 1 {
+		fmt.Fprintln(os.Stderr, "-chaos must be between 0 and 1")
+		os.Exit(1)
+	}
+	if _, ok := schedulers[*schedulerPtr]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown scheduler %q (valid: %s)\n", *schedulerPtr, schedulerNames())
+		os.Exit(1)
+	}
+
+	headers := make(http.Header)
+	for _, h := range headerFlags {
+		name, value, err := parseHeader(h)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid header: %v\n", err)
+			os.Exit(1)
+		}
+		headers.Add(name, value)
+	}
+	if *userPtr != "" {
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(*userPtr)))
+	}
+
+	clientOpts := clientOptions{
+		maxRedirects:    *maxRedirectsPtr,
+		locationTrusted: *locationTrustedPtr,
+		connectTimeout:  time.Duration(connectTimeout),
+		responseTimeout: time.Duration(responseTimeout),
+		http1:           *http1Ptr,
+	}
+	var paths *multipath
+	if *multipathPtr != "" {
+		if paths, err = parseMultipath(*multipathPtr); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -multipath: %v\n", err)
+			os.Exit(1)
+		}
+		// HTTP/2 would carry every part over a single connection
+		clientOpts.http1 = true
+	}
+	clientOpts.mptcp = *mptcpPtr
+	if clientOpts.resolve, err = parseResolve(resolveFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -resolve: %v\n", err)
+		os.Exit(1)
+	}
+	clientOpts.sni = *sniPtr
+	switch {
+	case *credentialHelperPtr != "" && *bearerCommandPtr != "":
+		fmt.Fprintln(os.Stderr, "-bearer-command can't be used with -credential-helper.")
+		os.Exit(1)
+	case *credentialHelperPtr != "":
+		clientOpts.credentials = newCredentialHelper(*credentialHelperPtr)
+	case *bearerCommandPtr != "":
+		clientOpts.credentials = newBearerCommand(*bearerCommandPtr)
+	}
+	if *awsSigV4Ptr != "" {
+		if clientOpts.credentials != nil {
+			fmt.Fprintln(os.Stderr, "-aws-sigv4 can't be used with -credential-helper or -bearer-command.")
+			os.Exit(1)
+		}
+		if clientOpts.signer, err = newSigV4Signer(*awsSigV4Ptr); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -aws-sigv4: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if limiter != nil && limiter.pace {
+		clientOpts.readBuffer = limiter.readBuffer()
+	}
+	// Each part holds a connection, and may open another to request its
+	// next range before finishing, so keep room for both
+	switch {
+	case *poolSizePtr < 0:
+		fmt.Fprintln(os.Stderr, "-pool-size can't be negative.")
+		os.Exit(1)
+	case *poolSizePtr > 0:
+		clientOpts.idleConnsPerHost = *poolSizePtr
+	default:
+		clientOpts.idleConnsPerHost = 2 * *boostPtr
+	}
+	keyLogPath := *tlsKeylogPtr
+	if keyLogPath == "" {
+		keyLogPath = os.Getenv("SSLKEYLOGFILE")
+	}
+	if keyLogPath != "" {
+		keyLog, err := openKeyLog(keyLogPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		clientOpts.keyLog = keyLog
+	}
+	if *torPtr {
+		if *proxyPtr != "" || len(proxyRules) > 0 {
+			fmt.Fprintln(os.Stderr, "-tor can't be combined with -proxy or -proxy-rule.")
+			os.Exit(1)
+		}
+		userAgent = torUserAgent
+		clientOpts.proxy = proxyFunc(torProxy(), nil)
+	}
+	if *proxyPtr != "" || len(proxyRules) > 0 {
+		var defaultProxy *url.URL
+		if *proxyPtr != "" {
+			if defaultProxy, err = parseProxyURL(*proxyPtr); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		var rules []proxyRule
+		for _, r := range proxyRules {
+			rule, err := parseProxyRule(r)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			rules = append(rules, rule)
+		}
+		clientOpts.proxy = proxyFunc(defaultProxy, rules)
+	}
+	if *allowSchemesPtr != "" || *denySchemesPtr != "" || *denyPrivatePtr {
+		clientOpts.policy = &urlPolicy{
+			allowSchemes: parseSchemes(*allowSchemesPtr),
+			denySchemes:  parseSchemes(*denySchemesPtr),
+			denyPrivate:  *denyPrivatePtr,
+		}
+	}
+	clientOpts.robots = robots
+	httpClient = newHTTPClient(clientOpts)
+
+	var sums checksumList
+	if *checksumFilePtr != "" {
+		if sum != nil {
+			fmt.Fprintln(os.Stderr, "-checksum-file can't be used with -checksum or -integrity.")
+			os.Exit(1)
+		}
+		if sums, err = readChecksumList(*checksumFilePtr); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Handle signals, saving the progress of the download in flight so
+	// it can be resumed. On Windows, Ctrl+C and Ctrl+Break arrive as
+	// SIGINT, and closing the console window as SIGTERM.
+	var current atomic.Pointer[download]
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		sig := <-sigc
+		fmt.Printf("\nReceived signal %s; aborting download...\n", sig)
+		if dl := current.Load(); dl != nil {
+			dl.abort()
+		}
+		meter.save()
+		os.Exit(1)
+	}()
+
+	if wait := time.Until(startAt); wait > 0 {
+		fmt.Printf("Waiting until %s to start.\n", startAt.Format("2006-01-02 15:04 MST"))
+		time.Sleep(wait)
+	}
+
+	var sources []source
+	if locked != nil {
+		sources = locked.sources()
+	}
+	for _, uri := range fileURIs {
+		if path := localPath(uri); path != "" {
+			sources = append(sources, source{uri: uri})
+			continue
+		}
+		normalized, err := normalizeURI(uri)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid download URI: %v\n", err)
+			os.Exit(1)
+		}
+		if scrape != nil {
+			// Download the matching links of the page instead
+			if robots != nil {
+				ok, err := robots.allowed(normalized)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error checking robots.txt: %v\n", err)
+					os.Exit(1)
+				}
+				if !ok {
+					fmt.Fprintln(os.Stderr, "robots.txt doesn't allow scraping", normalized, "- use -no-robots to ignore it.")
+					os.Exit(1)
+				}
+			}
+			scraper := download{headers: headers}
+			found, err := scraper.scrapeLinks(normalized, scrape)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error scraping %s: %v\n", normalized, err)
+				os.Exit(1)
+			}
+			if len(found) == 0 {
+				fmt.Fprintln(os.Stderr, "No links matching", *scrapePtr, "on", normalized)
+			}
+			sources = append(sources, found...)
+			continue
+		}
+		if *sitemapPtr {
+			lister := download{headers: headers}
+			found, err := lister.listSitemap(normalized, match, robots)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading sitemap %s: %v\n", normalized, err)
+				os.Exit(1)
+			}
+			if len(found) == 0 {
+				fmt.Fprintln(os.Stderr, "No matching URLs in", normalized)
+			}
+			sources = append(sources, found...)
+			continue
+		}
+		if !*noResolvePtr {
+			resolver := download{headers: headers}
+			if normalized, err = resolver.resolveShareLink(normalized); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if !*webdavPtr {
+			sources = append(sources, source{uri: normalized, filename: outputs[uri]})
+			continue
+		}
+
+		// Expand WebDAV collections into the files they contain
+		lister := download{headers: headers}
+		found, err := lister.listWebDAV(normalized)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing %s: %v\n", normalized, err)
+			os.Exit(1)
+		}
+		sources = append(sources, found...)
+	}
+	if mirrorMode {
+		normalized, err := normalizeURI(mirrorURI)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid download URI: %v\n", err)
+			os.Exit(1)
+		}
+		lister := download{headers: headers}
+		plan, err := lister.planMirror(normalized, mirrorDir, sums, *progressFilePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing %s: %v\n", normalized, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d new, %d changed, and %d unchanged files", plan.added, plan.changed, plan.unchanged)
+		if len(plan.remove) > 0 {
+			fmt.Printf("; %d local files are gone from the remote directory", len(plan.remove))
+		}
+		fmt.Println(".")
+		switch {
+		case !*deletePtr:
+		case *dryRunPtr:
+			for _, path := range plan.remove {
+				fmt.Println("Would delete:", path)
+			}
+		case plan.removesEverything() && !confirmNo(fmt.Sprintf("None of the %d files in %s are in the remote directory. Delete them all?", len(plan.remove), mirrorDir)):
+			fmt.Fprintf(os.Stderr, "Refusing to delete every file in %s; delete them yourself if the remote directory really was emptied.\n", mirrorDir)
+			os.Exit(1)
+		default:
+			if err := plan.prune(mirrorDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Error deleting: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		sources = plan.fetch
+	}
+
+	if robots != nil {
+		allowed := sources[:0]
+		for _, src := range sources {
+			ok, err := robots.allowed(src.uri)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error checking robots.txt: %v\n", err)
+				os.Exit(1)
+			}
+			if !ok {
+				fmt.Println("Skipping (disallowed by robots.txt):", src.uri)
+				continue
+			}
+			allowed = append(allowed, src)
+		}
+		sources = allowed
+	}
 
-	flag.Parse()
+	dls := make([]*download, len(sources))
+	for i, src := range sources {
+		if *torPtr {
+			// New credentials get a new circuit, so downloads can't be
+			// linked to each other
+			clientOpts.proxy = proxyFunc(torProxy(), nil)
+		}
 
-	fileURIs := flag.Args()
-	if len(fileURIs) == 0 {
-		fmt.Fprintln(os.Stderr, "No download URI(s) provided.")
+		dl := &download{}
+		dl.conns = &connTracker{}
+		opts := clientOpts
+		opts.conns = dl.conns
+		if paths != nil {
+			dl.multipath = paths.fresh()
+			opts.multipath = dl.multipath
+		}
+		dl.client = newHTTPClient(opts)
+		dl.uri = src.uri
+		dl.localPath = localPath(src.uri)
+		if dl.localPath != "" && clientOpts.policy != nil {
+			// Plain paths are read from the file system as file:// URIs are
+			if err := clientOpts.policy.checkScheme("file"); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", src.uri, err)
+				os.Exit(1)
+			}
+		}
+		dl.modTime = src.modTime
+		dl.webdav = *webdavPtr
+		dl.compressed = *compressedPtr
+		dl.stream = *streamPtr
+		dl.unwrapPages = !*noResolvePtr
+		dl.checkPages = !*noPageCheckPtr
+		dl.trustNames = *trustServerNamesPtr
+		dl.boost = *boostPtr
+		dl.mirrors = mirrors
+		dl.headers = headers
+		dl.retryParam = *retryParamPtr
+		dl.scheduler = *schedulerPtr
+		dl.speedLimit = *speedLimitPtr
+		dl.limiter = limiter
+		dl.warmConns = !*noPreconnectPtr
+		dl.speedTime = time.Duration(speedTime)
+		dl.saveInterval = time.Duration(saveInterval)
+		dl.progressFile = *progressFilePtr
+		dl.pieceHashes = *pieceHashesPtr
+		dl.checksum = sum
+		if locked != nil {
+			dl.checksum = locked.Files[i].sum
+		}
+		dl.strategy = *strategyPtr
+		dl.verifyWrites = *verifyWritesPtr
+		dl.chaos = *chaosPtr
+		dl.keepGoing = *keepGoingPtr
+		dl.sweeps = *sweepsPtr
+		dl.healthInterval = time.Duration(healthCheck)
+		dl.pause = pause
+		dl.ioNice = *ioNicePtr
+		dl.reorderWindow = reorderWindow
+		dl.mptcp = *mptcpPtr
+		dls[i] = dl
+	}
+
+	outputDir := *filenamePtr != "" && isDirPath(*filenamePtr)
+	if *filenamePtr != "" && !outputDir && len(dls) > 1 {
+		fmt.Fprintln(os.Stderr, "-filename names a single file; end it with a / to download several files into a directory.")
 		os.Exit(1)
 	}
+	naming := namingOptions{filename: *filenamePtr, dir: outputDir, fixExtension: *fixExtensionPtr}
 
-	for _, uri := range fileURIs {
-		var dl download
-		dl.uri = uri
-		dl.boost = *boostPtr
+	var record *manifest
+	if *manifestPtr != "" {
+		record = &manifest{}
+	}
+	var session multiReporter
+	if *eventsPtr != "" {
+		events, err := openEventLog(*eventsPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		session = append(session, events)
+	}
+	var report *sessionReport
+	if *reportPtr != "" {
+		report = newSessionReport(*reportPtr, dls)
+		session = append(session, report)
+	}
+
+	batch := prefetchMetadata(dls)
+	// Existing files are checked while earlier ones download
+	var pre *preverifier
+	if *skipExistingPtr && !*dryRunPtr {
+		pre = newPreverifier()
+		go pre.lookAhead(batch, sources, naming, func(i int, name string) *checksum {
+			switch {
+			case locked != nil:
+				return locked.Files[i].sum
+			case sums != nil:
+				c, _ := sums.lookup(name)
+				return c
+			}
+			return sum
+		})
+	}
+	usage := make(hostReport)
+	names := make(batchNames)
+	for i, item := range batch {
+		src, dl := sources[i], item.dl
+		<-item.done
+		for item.err != nil && *waitForNetworkPtr && dl.offline(item.err) {
+			dl.waitForNetwork(item.err)
+			dl.redirects = nil
+			item.err = dl.FetchMetadata()
+		}
+		if item.err != nil {
+			fmt.Fprintf(os.Stderr, "Error fetching metadata: %v\n", item.err)
+			session.downloadFinished(i+1, item.err)
+			exitIfCaptivePortal(portalCheck, item.err)
+			os.Exit(1)
+		}
+		if dl.looksIntercepted() {
+			exitIfCaptivePortal(portalCheck, nil)
+		}
+		size := expectSize
+		if locked != nil {
+			size = int64(locked.Files[i].Size)
+		}
+		if err := dl.avoidErrorPage(size); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			session.downloadFinished(i+1, err)
+			os.Exit(1)
+		}
+		if err := dl.checkExpectations(expected, expectSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			session.downloadFinished(i+1, err)
+			os.Exit(1)
+		}
+		if len(batch) > 1 {
+			dl.batch = &batchPosition{items: batch, index: i}
+			total, unknown := batchSize(batch[i:])
+			if unknown > 0 {
+				fmt.Printf("File %d of %d, %s left in the batch so far (%d sizes still unknown).\n", i+1, len(batch), formatBytes(float64(total)), unknown)
+			} else {
+				fmt.Printf("File %d of %d, %s left in the batch.\n", i+1, len(batch), formatBytes(float64(total)))
+			}
+		}
+
+		dl.coalesce = dl.supportsRange && dl.useCoalescing(*coalescePtr)
 
-		// Fetch file metadata
-		if err := dl.FetchMetadata(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error fetching metadata: %v\n", err)
+		if *verbosePtr {
+			for _, hop := range dl.redirects {
+				fmt.Println("Redirected to:", hop)
+			}
+			if dl.ttfb > 0 {
+				fmt.Println(dl.describeCoalescing())
+			}
+		}
+
+		if err := dl.checkMirrors(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking mirrors: %v\n", err)
 			os.Exit(1)
 		}
+		if locked != nil && dl.filesize != locked.Files[i].Size {
+			// No need to download it to know it won't match
+			fmt.Fprintf(os.Stderr, "%s has changed: it is %d bytes, but was %d bytes when recorded in %s.\n", dl.uri, dl.filesize, locked.Files[i].Size, *fromManifestPtr)
+			os.Exit(1)
+		}
+		if extract != nil {
+			if err := dl.applyRange(*extract); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
 
 		// Override filename if specified
-		if *filenamePtr != "" {
-			dl.filename = *filenamePtr
+		if dl.unsafeName != "" && src.filename == "" && (*filenamePtr == "" || outputDir) {
+			fmt.Fprintf(os.Stderr, "Ignoring the unsafe filename %q the server suggested.\n", dl.unsafeName)
+		}
+		dl.filename = naming.name(src, dl.filename, dl.contentType)
+		if dl.filename == "" {
+			fmt.Fprintln(os.Stderr, "Cannot determine a filename for", dl.uri, "- use -filename to set one.")
+			os.Exit(1)
+		}
+		if sums != nil {
+			c, ok := sums.lookup(dl.filename)
+			if !ok {
+				fmt.Fprintln(os.Stderr, "No checksum for", dl.filename, "in", *checksumFilePtr)
+				os.Exit(1)
+			}
+			dl.checksum = c
+		}
+		names.claim(dl)
+
+		if *dryRunPtr {
+			dl.info().print(os.Stdout)
+			fmt.Println()
+			continue
 		}
 
 		wd, err := os.Getwd()
@@ -84,108 +1290,436 @@ func main() {
 		}
 		dl.workingDir = wd
 
-		// Handle signals (to allow cleanup if needed)
-		sigc := make(chan os.Signal, 1)
-		signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-		go func() {
-			sig := <-sigc
-			fmt.Printf("\nReceived signal %s; aborting download...\n", sig)
-			// If you want to remove the partially downloaded file on abort:
-			_ = os.Remove(dl.outputPath())
+		// Names from a WebDAV collection keep its directory layout
+		if err := os.MkdirAll(filepath.Dir(dl.outputPath()), 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating directory: %v\n", err)
 			os.Exit(1)
-		}()
+		}
+
+		if dl.localPath != "" {
+			if err := dl.checkLocalOutput(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		// A part of the file is neither recorded nor cached as if it
+		// were the whole
+		whole := dl.localPath == "" && dl.extract == nil
+		if whole && !*refetchPtr && validators.unchanged(dl) {
+			fmt.Println("Not modified, using existing file:", dl.filename)
+			if report != nil {
+				report.unchanged(i + 1)
+			}
+			if err := dl.placeCopies(alsoTo); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			continue
+		}
+		if whole && pre != nil && dl.alreadyComplete(pre) {
+			fmt.Println("Already downloaded, using existing file:", dl.filename)
+			if report != nil {
+				report.unchanged(i + 1)
+			}
+			if err := dl.placeCopies(alsoTo); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			continue
+		}
+
+		if quota > 0 && dl.localPath == "" {
+			used, err := meter.usedThisMonth()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			// A file of unknown size needs at least a byte
+			if used+max(int64(dl.filesize), 1) > quota {
+				fmt.Fprintf(os.Stderr, "Downloading %s would go past the monthly quota of %s, with %s used so far.\n", dl.filename, formatBytes(float64(quota)), formatBytes(float64(used)))
+				os.Exit(1)
+			}
+		}
+
+		if len(members) > 0 {
+			fmt.Println("Extracting from:", dl.filename)
+			if len(session) > 0 {
+				dl.session, dl.id = session, i+1
+				session.downloadStarted(dl.id, dl.info())
+			}
+			if err := dl.extractMembers(context.Background(), members, filepath.Dir(dl.outputPath())); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				session.downloadFinished(i+1, err)
+				meter.save()
+				os.Exit(1)
+			}
+			session.downloadFinished(i+1, nil)
+			meter.save()
+			usage.merge(dl.hosts)
+			continue
+		}
 
 		fmt.Println("Downloading:", dl.filename)
+		if r := dl.extract; r != nil {
+			fmt.Printf("Only bytes %d to %d of the remote file (%s).\n", r.Start, r.End+1, formatBytes(float64(dl.filesize)))
+		}
+		if m := dl.manifest; m != nil {
+			if m.live {
+				fmt.Printf("Capturing the live %s stream until it ends; press Ctrl+C to stop.\n", m.kind)
+			} else {
+				fmt.Printf("Saving the %s stream of %d segments.\n", m.kind, len(m.segments))
+			}
+		}
+		if len(session) > 0 {
+			dl.session, dl.id = session, i+1
+			session.downloadStarted(dl.id, dl.info())
+		}
 
 		// If the server does not support partial downloads and boost > 1, fallback to single download
-		if !dl.supportsRange && dl.boost > 1 {
-			fmt.Println("Server does not support partial content. Falling back to single-threaded download.")
+		if !dl.supportsRange && dl.boost > 1 && dl.localPath == "" && dl.manifest == nil {
+			if encoded(dl.contentEncoding) {
+				fmt.Println("The server sends the file compressed, which can't be split into parts. Downloading in a single stream.")
+			} else {
+				fmt.Println("Server does not support partial content. Falling back to single-threaded download.")
+			}
 			dl.boost = 1
 		}
 
-		// Perform the download
-		if err := dl.Fetch(); err != nil {
+		// Perform the download, unless the cache has a copy
+		cached := cache != nil && whole && cache.restore(dl)
+		if cached {
+			fmt.Println("Copied from the cache.")
+		} else if pause != nil {
+			pause.wait()
+		}
+		start := time.Now()
+		current.Store(dl)
+		for !cached {
+			err := dl.fetchAndVerify(context.Background(), *verifyRetriesPtr)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errPaused) {
+				if err := dl.saveProgress(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error saving progress: %v\n", err)
+					os.Exit(1)
+				}
+				// Don't hold on to connections for hours
+				dl.client.CloseIdleConnections()
+				fmt.Println()
+				pause.wait()
+				dl.reset()
+				continue
+			}
+			if *waitForNetworkPtr && dl.offline(err) {
+				if dl.supportsRange {
+					if err := dl.saveProgress(); err != nil {
+						fmt.Fprintf(os.Stderr, "Error saving progress: %v\n", err)
+						os.Exit(1)
+					}
+				}
+				dl.client.CloseIdleConnections()
+				dl.waitForNetwork(err)
+				dl.reset()
+				continue
+			}
 			fmt.Fprintf(os.Stderr, "Error while downloading: %v\n", err)
-			// Remove partially downloaded file upon error
-			_ = os.Remove(dl.outputPath())
+			if isDiskFull(err) && dl.supportsRange {
+				// Everything written so far is kept, so the download
+				// can go on once there is room
+				if err := dl.saveProgress(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error saving progress: %v\n", err)
+					os.Exit(exitDiskFull)
+				}
+				if *waitForSpacePtr && waitForSpace() {
+					dl.reset()
+					continue
+				}
+				fmt.Fprintln(os.Stderr, "Out of disk space; progress saved. Free up space and run dl again with the same URI to resume.")
+				session.downloadFinished(i+1, err)
+				meter.save()
+				os.Exit(exitDiskFull)
+			}
+			session.downloadFinished(i+1, err)
+			meter.save()
+			// Keep resumable progress, remove anything else. A file
+			// that failed verification is already gone.
+			if !errors.Is(err, errChecksumMismatch) {
+				dl.abort()
+				if *quarantinePtr {
+					if dir, err := dl.quarantine(); err != nil {
+						fmt.Fprintf(os.Stderr, "Error moving the partial download to %s: %v\n", partialDir, err)
+					} else if dir != "" {
+						fmt.Fprintln(os.Stderr, "Moved the partial download to", dir)
+					}
+				}
+			}
+			if isDiskFull(err) {
+				os.Exit(exitDiskFull)
+			}
+			exitIfCaptivePortal(portalCheck, err)
+			os.Exit(1)
+		}
+		if followGrowing > 0 && dl.localPath == "" {
+			if err := dl.follow(time.Duration(followGrowing), time.Duration(followFor)); err != nil {
+				fmt.Fprintf(os.Stderr, "Error following %s: %v\n", dl.filename, err)
+			}
+		}
+		current.Store(nil)
+		// The next download gets its own connections
+		dl.client.CloseIdleConnections()
+
+		if err := dl.applyModTime(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting modification time: %v\n", err)
+		}
+		if whole {
+			if err := validators.record(dl); err != nil {
+				fmt.Fprintf(os.Stderr, "Error recording validators: %v\n", err)
+			}
+		}
+		if cache != nil && !cached && whole {
+			if err := cache.store(dl); err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding to the cache: %v\n", err)
+			}
+		}
+		if record != nil {
+			// Written after every file, so an interrupted session still
+			// leaves a record of what it completed
+			err := record.add(dl)
+			if err == nil {
+				err = record.write(*manifestPtr)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing manifest: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if *exportPtr != "" && dl.localPath == "" {
+			if path, err := dl.export(*exportPtr); err != nil {
+				fmt.Fprintf(os.Stderr, "Error exporting %s: %v\n", dl.filename, err)
+			} else {
+				fmt.Println("Wrote", path)
+			}
+		}
+
+		if err := dl.placeCopies(alsoTo); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 
 		fmt.Println("Download completed:", dl.filename)
+		session.downloadFinished(i+1, nil)
+		meter.save()
+		if n := dl.stats.reconnects.Load(); n > 0 {
+			fmt.Printf("Reconnected %d time(s) after the server closed the connection early.\n", n)
+		}
+		if n := dl.stats.resets.Load(); n > 0 {
+			fmt.Printf("Reconnected %d time(s) after the transfer slowed down.\n", n)
+		}
+		if *verbosePtr && len(dl.parts) > 0 {
+			dl.printConnections()
+		}
+		if *statsPtr {
+			dl.printStats(time.Since(start))
+		}
+		usage.merge(dl.hosts)
+	}
+
+	// Show which hosts were slow when there were several to compare
+	if len(usage) > 1 || len(batch) > 1 && len(usage) > 0 {
+		fmt.Println()
+		usage.print(os.Stdout)
 	}
 }
 
 func (dl *download) FetchMetadata() error {
-	resp, err := http.Head(dl.uri)
+	if dl.localPath != "" {
+		return dl.statLocal()
+	}
+	if dl.webdav {
+		return dl.fetchWebDAVMetadata()
+	}
+	if dl.stream {
+		return dl.fetchStreamMetadata()
+	}
+
+	// Record the redirects followed to reach the file
+	var redirects redirectLog
+	ctx := context.WithValue(context.Background(), redirectLogKey{}, &redirects)
+	req, err := http.NewRequestWithContext(dl.traceConns(ctx, nil), "HEAD", dl.uri, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HEAD request: %w", err)
+	}
+	dl.setHeaders(req)
+	if dl.compressed {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	start := time.Now()
+	resp, err := dl.do(req)
 	if err != nil {
 		return fmt.Errorf("HEAD request failed: %w", err)
 	}
 	defer resp.Body.Close()
+	dl.ttfb = time.Since(start)
+	dl.redirects = append(dl.redirects, redirects.chain()...)
 
-	contentLength := resp.Header.Get("Content-Length")
-	if contentLength == "" {
-		return fmt.Errorf("missing Content-Length header, cannot determine file size")
+	dl.header = resp.Header
+	dl.contentType = resp.Header.Get("Content-Type")
+	dl.contentEncoding = resp.Header.Get("Content-Encoding")
+
+	// A mirror redirector may put a page with a meta refresh or script
+	// redirect in front of the file; follow it to the file itself
+	if dl.unwrapPages && dl.unwraps < maxUnwraps && strings.HasPrefix(dl.contentType, "text/html") && !looksLikePage(dl.uri) {
+		target, err := dl.unwrapRedirectPage(dl.uri)
+		if err != nil {
+			return fmt.Errorf("error reading redirect page: %w", err)
+		}
+		if target != "" {
+			dl.uri = target
+			dl.unwraps++
+			dl.redirects = append(dl.redirects, target)
+			return dl.FetchMetadata()
+		}
 	}
 
-	dl.filesize, err = strconv.ParseUint(contentLength, 10, 64)
-	if err != nil {
-		return fmt.Errorf("invalid Content-Length: %w", err)
+	// Responses compressed on the fly often have no length, as it isn't
+	// known until they are sent
+	contentLength := resp.Header.Get("Content-Length")
+	switch {
+	case contentLength != "":
+		dl.filesize, err = strconv.ParseUint(contentLength, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid Content-Length: %w", err)
+		}
+	case !encoded(dl.contentEncoding):
+		return fmt.Errorf("missing Content-Length header, cannot determine file size")
 	}
 
-	// Check if server supports range requests
+	// Check if server supports range requests. Ranges of a compressed
+	// response are of the compressed bytes, which can't be decoded
+	// separately.
 	acceptRanges := resp.Header.Get("Accept-Ranges")
-	dl.supportsRange = strings.ToLower(acceptRanges) == "bytes"
+	dl.supportsRange = strings.ToLower(acceptRanges) == "bytes" && !encoded(dl.contentEncoding)
+
+	// Validators to tell whether a partial download is still current
+	dl.etag = resp.Header.Get("ETag")
+	dl.lastModified = resp.Header.Get("Last-Modified")
+	if !encoded(dl.contentEncoding) {
+		dl.s3ETag = s3ETagFor(resp.Header)
+	}
 
 	// Try to determine filename
 	contentDisposition := resp.Header.Get("Content-Disposition")
 	_, params, err := mime.ParseMediaType(contentDisposition)
 	if err != nil {
 		dl.filename = dl.filenameFromURI()
-	} else {
-		dl.filename = params["filename"]
-		if dl.filename == "" {
+	} else if suggested := params["filename"]; suggested != "" {
+		var ok bool
+		if dl.filename, ok = serverFilename(suggested, dl.trustNames); !ok {
+			dl.unsafeName = suggested
 			dl.filename = dl.filenameFromURI()
 		}
+	} else {
+		dl.filename = dl.filenameFromURI()
+	}
+
+	// Fall back to the host and content type when the URI has no name,
+	// e.g. when it ends in a slash
+	if dl.filename == "" {
+		dl.filename = dl.filenameFromContentType()
 	}
 
 	return nil
 }
 
-// Fetch downloads the file. If boost=1 or partial content not supported,
-// it fetches in a single request. Otherwise, it launches multiple goroutines
-// for parallel range requests, each writing to the correct position of the same file.
-func (dl *download) Fetch() error {
-	// Create/Truncate the final file up front
-	outFile, err := os.Create(dl.outputPath())
-	if err != nil {
-		return fmt.Errorf("cannot create output file: %w", err)
+// Fetch downloads the file. If partial content is not supported, it
+// fetches in a single request. Otherwise, it launches boost goroutines
+// for parallel range requests, each writing to the correct position of
+// the same file, and picks up any progress saved by an earlier run.
+func (dl *download) Fetch(ctx context.Context) error {
+	if dl.localPath != "" {
+		return dl.copyLocal(ctx)
+	}
+	if dl.manifest != nil {
+		return dl.fetchStream(ctx)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var out io.WriterAt
+	var files *partFileSet
+	var err error
+	resuming := dl.loadProgress()
+	if resuming {
+		fmt.Println("Resuming previous download.")
 	}
-	defer outFile.Close()
+	if dl.partFiles() {
+		if files, err = dl.openPartFiles(resuming); err != nil {
+			return err
+		}
+		defer files.close()
+		out = files
+	} else {
+		var outFile *os.File
+		if resuming {
+			outFile, err = os.OpenFile(dl.outputPath(), os.O_RDWR, 0)
+			if err != nil {
+				return fmt.Errorf("cannot open output file: %w", err)
+			}
+		} else {
+			// Create/Truncate the final file up front
+			outFile, err = os.Create(dl.outputPath())
+			if err != nil {
+				return fmt.Errorf("cannot create output file: %w", err)
+			}
+		}
+		defer outFile.Close()
 
-	// We set the file size right away (optional, but can be useful on some OSes)
-	if dl.boost > 1 && dl.supportsRange {
-		if err = outFile.Truncate(int64(dl.filesize)); err != nil {
-			return fmt.Errorf("error setting file size: %w", err)
+		// We set the file size right away (optional, but can be useful on some OSes)
+		if dl.supportsRange {
+			if err = outFile.Truncate(int64(dl.filesize)); err != nil {
+				return fmt.Errorf("error setting file size: %w", err)
+			}
 		}
+		out = outFile
 	}
 
-	// Create a progress bar spanning the entire file
-	bar := progressbar.DefaultBytes(
-		int64(dl.filesize),
-		"Downloading",
-	)
+	if dl.ioNice {
+		out = &niceWriter{out: out}
+	}
+	dl.reorder = nil
+	if dl.reorderWindow > 0 && dl.supportsRange {
+		dl.reorder = newOrderedWriter(out, dl.reorderWindow)
+		out = dl.reorder
+	}
 
-	if dl.boost == 1 || !dl.supportsRange {
+	// Create a progress bar spanning the entire file, and keep its
+	// speed and ETA up to date while the transfer runs
+	dl.progress = dl.newReporter()
+	dl.resumed = dl.filesize - dl.remainingBytes()
+	dl.addProgress(int64(dl.resumed))
+	stop := make(chan struct{})
+	defer close(stop)
+	go dl.watchSpeed(stop, cancel)
+
+	if !dl.supportsRange {
 		// Single-stream download
-		req, err := http.NewRequest("GET", dl.uri, nil)
+		req, err := http.NewRequestWithContext(dl.traceConns(ctx, nil), "GET", dl.uri, nil)
 		if err != nil {
 			return fmt.Errorf("failed to create request: %w", err)
 		}
-		req.Header.Set("User-Agent", "dl/1.1.1")
+		dl.setHeaders(req)
+		if dl.compressed {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
 
-		resp, err := http.DefaultClient.Do(req)
+		dl.stats.requests.Add(1)
+		resp, err := dl.do(req)
 		if err != nil {
-			return fmt.Errorf("single-stream download failed: %w", err)
+			return fmt.Errorf("single-stream download failed: %w", cancelCause(ctx, err))
 		}
 		defer resp.Body.Close()
 
@@ -195,43 +1729,138 @@ func (dl *download) Fetch() error {
 
 		// Write everything to offset=0 in the final file
 		ow := &offsetWriter{
-			w:      outFile,
+			w:      out,
 			offset: 0,
 		}
-		_, err = io.Copy(io.MultiWriter(ow, bar), resp.Body)
+		sum := crc32.New(crcTable)
+		start := time.Now()
+		received := &countingReader{r: dl.limitReader(ctx, resp.Body)}
+		var body io.Reader = received
+		dst := []io.Writer{ow, sum}
+		decode := dl.compressed && encoded(resp.Header.Get("Content-Encoding"))
+		switch {
+		case decode && encoded(dl.contentEncoding):
+			// The size is of the compressed response, so progress is
+			// counted as it arrives
+			body = io.TeeReader(received, progressCounter{dl})
+		default:
+			dst = append(dst, progressCounter{dl})
+		}
+		var ahead *readAhead
+		if decode {
+			// Decoding is kept from holding up the transfer
+			ahead = newReadAhead(body)
+			dec, err := decoder(resp.Header.Get("Content-Encoding"), ahead)
+			if err != nil {
+				resp.Body.Close()
+				ahead.Close()
+				return err
+			}
+			defer dec.Close()
+			body = dec
+		}
+		n, err := io.Copy(io.MultiWriter(dst...), body)
+		if ahead != nil {
+			// Done with received once reading ahead has stopped
+			resp.Body.Close()
+			ahead.Close()
+		}
+		dl.recordHost(resp, received.n, time.Since(start))
+		if err == nil && dl.verifyWrites {
+			err = verifyWrite(out, 0, n, sum.Sum32())
+		}
+		if err == nil && decode {
+			// What follows deals with the file as saved. The speed
+			// is still being sampled, so the size is set under dl.mu
+			dl.mu.Lock()
+			dl.filesize = uint64(n)
+			dl.mu.Unlock()
+		}
+		return cancelCause(ctx, err)
+	}
+
+	// Save right away, so there is a progress file to update even if
+	// the disk fills up
+	if err := dl.saveProgress(); err != nil {
 		return err
 	}
+	if dl.saveInterval > 0 {
+		go dl.saveProgressPeriodically(stop)
+	}
+	if dl.healthInterval > 0 {
+		go dl.watchHealth(stop)
+	}
+	if dl.pause != nil {
+		go dl.watchPause(stop, cancel)
+	}
 
 	// Multi-part parallel download
-	var wg sync.WaitGroup
-	errCh := make(chan error, dl.boost)
+	dl.sched, err = newScheduler(dl.scheduler, dl)
+	if err != nil {
+		return err
+	}
+
+	if dl.warmConns {
+		dl.preconnect(ctx)
+	}
+
+	err = dl.fetchParts(ctx, out, dl.boost)
+	// Sweep up the ranges failed parts left behind before declaring
+	// failure, which rescues downloads from servers failing the odd
+	// request
+	for sweep := 1; err != nil && sweep <= dl.sweeps && ctx.Err() == nil && !isDiskFull(err); sweep++ {
+		dl.warn("Retrying the incomplete ranges (%d of %d) after: %v", sweep, dl.sweeps, err)
+		dl.settleParts()
+		dl.sched = dl.sweepScheduler(sweep)
+		err = dl.fetchParts(ctx, out, min(len(dl.remainingRanges()), dl.boost))
+	}
+	if err != nil {
+		return err
+	}
 
-	// Prepare chunk boundaries
-	dl.parts = make([]downloadPart, dl.boost)
-	for i := 0; i < dl.boost; i++ {
-		start, end := dl.calculatePartBoundary(i)
-		dl.parts[i] = downloadPart{
-			index:     i,
-			uri:       dl.uri,
-			startByte: start,
-			endByte:   end,
+	if files != nil {
+		if err := files.join(); err != nil {
+			return err
 		}
 	}
+	dl.removeProgress()
+	return nil
+}
 
-	// Launch goroutines
-	for _, part := range dl.parts {
+// fetchParts runs workers until the scheduler has nothing left and
+// returns the first error. The first failure stops the other workers
+// rather than have them finish a pass that has already failed, unless
+// -keep-going is set; a full disk stops them regardless.
+func (dl *download) fetchParts(ctx context.Context, out io.WriterAt, workers int) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+
+	// Launch workers; each keeps asking the scheduler for more work
+	// until there is none left
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(dp downloadPart) {
+		go func() {
 			defer wg.Done()
-			if err := dl.fetchPartRange(dp, outFile, bar); err != nil {
-				errCh <- err
+			if err := dl.runWorker(ctx, out); err != nil {
+				if !dl.keepGoing || isDiskFull(err) {
+					cancel(err)
+				}
+				errCh <- cancelCause(ctx, err)
 			}
-		}(part)
+		}()
 	}
 
 	// Wait until all parts complete
 	wg.Wait()
 	close(errCh)
+	// What is still held to be written belongs to this pass
+	var flushErr error
+	if w, ok := out.(*orderedWriter); ok {
+		flushErr = w.Flush()
+	}
 
 	// If any part failed, return the first error
 	for e := range errCh {
@@ -239,63 +1868,321 @@ func (dl *download) Fetch() error {
 			return e
 		}
 	}
+	if flushErr != nil {
+		return fmt.Errorf("error writing: %w", flushErr)
+	}
 	return nil
 }
 
+// settleParts folds the parts fetched so far into the completed ranges
+// and drops them, so a new scheduler only hands out what is left.
+func (dl *download) settleParts() {
+	completed := dl.completedRanges()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.completed = completed
+	dl.parts = nil
+}
+
+// parseStartAt parses a -start-at time: either a time of day, meaning
+// its next occurrence after now in local time, or a full RFC 3339
+// timestamp.
+func parseStartAt(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	clock, err := time.Parse("15:04", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither HH:MM nor an RFC 3339 timestamp", s)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// cancelCause returns the reason ctx was canceled in place of err, so a
+// deliberate abort isn't reported as whichever request it interrupted.
+func cancelCause(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
 // fetchPartRange downloads the specific byte range for a part
-// and writes it to the corresponding offset in outFile.
-func (dl *download) fetchPartRange(p downloadPart, outFile *os.File, bar *progressbar.ProgressBar) error {
+// and writes it to the corresponding offset in out. If the server
+// closes the connection before the range is complete, a new ranged
+// request is issued from the current offset.
+func (dl *download) fetchPartRange(ctx context.Context, p *downloadPart, out io.WriterAt) error {
+	for {
+		offset, end, done := dl.partRemaining(p)
+		if done {
+			return nil
+		}
+
+		resets := dl.stats.resets.Load()
+		written, err := dl.fetchRange(ctx, p, offset, end, out)
+		if _, _, done := dl.partRemaining(p); done {
+			return nil
+		}
+		if dl.stats.resets.Load() != resets && ctx.Err() == nil {
+			// The connection was dropped for a fresh one
+			continue
+		}
+		if !isPrematureEOF(err) {
+			return err
+		}
+		if written == 0 {
+			// No progress at all; reconnecting would loop forever
+			return fmt.Errorf("error writing part %d: server closed connection at byte %d", p.index, offset)
+		}
+		dl.stats.reconnects.Add(1)
+	}
+}
+
+// fetchRange issues a single ranged request for bytes offset through end,
+// unless one was sent ahead of time, and copies the response into
+// out. It returns the number of bytes written, which may be short if
+// the server ends the response early or the part's range is split while
+// the request is in flight.
+func (dl *download) fetchRange(ctx context.Context, p *downloadPart, offset, end uint64, out io.WriterAt) (int64, error) {
+	resp := p.resp
+	p.resp = nil
+	if resp == nil {
+		var err error
+		if resp, err = dl.openRange(ctx, p, offset, end); err != nil {
+			return 0, err
+		}
+	}
+	defer resp.Body.Close()
+
+	// Write directly to the correct offset
+	pw := &partWriter{
+		dl:    dl,
+		part:  p,
+		w:     out,
+		start: time.Now(),
+	}
+	if dl.verifyWrites {
+		pw.sum = crc32.New(crcTable)
+	}
+	written, copyErr := io.Copy(pw, dl.limitReader(ctx, dl.chaosReader(resp.Body)))
+	dl.recordHost(resp, written, time.Since(pw.start))
+	if pw.sum != nil && written > 0 {
+		if err := verifyWrite(out, int64(offset), written, pw.sum.Sum32()); err != nil {
+			// None of the range can be trusted, so it is fetched
+			// again if the download is resumed
+			dl.mu.Lock()
+			p.offset, p.committed = offset, offset
+			dl.mu.Unlock()
+			return written, fmt.Errorf("error verifying part %d: %w", p.index, err)
+		}
+	}
+	if copyErr != nil {
+		return written, fmt.Errorf("error writing part %d: %w", p.index, copyErr)
+	}
+	return written, nil
+}
+
+// openRange requests bytes offset through end of part p and checks that
+// the server honors the range.
+func (dl *download) openRange(ctx context.Context, p *downloadPart, offset, end uint64) (*http.Response, error) {
 	// Construct the range header
-	byteRange := fmt.Sprintf("bytes=%d-%d", p.startByte, p.endByte)
-	req, err := http.NewRequest("GET", p.uri, nil)
+	start, last := dl.remoteOffset()+offset, dl.remoteOffset()+end
+	byteRange := fmt.Sprintf("bytes=%d-%d", start, last)
+	req, err := http.NewRequestWithContext(dl.traceConns(ctx, p), "GET", p.uri, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request for part %d: %w", p.index, err)
+		return nil, fmt.Errorf("failed to create request for part %d: %w", p.index, err)
 	}
 	req.Header.Set("Range", byteRange)
-	req.Header.Set("User-Agent", "dl/1.0")
+	p.attempts++
+	dl.setHeadersFor(req, requestVars{part: p.index, attempt: p.attempts, start: start, end: last, hasRange: true})
+	if p.attempts > 1 && dl.retryParam != "" {
+		dl.bustCache(req)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	if err := dl.chaosFailure(p); err != nil {
+		return nil, err
+	}
+	dl.stats.requests.Add(1)
+	resp, err := dl.do(req)
 	if err != nil {
-		return fmt.Errorf("failed to download part %d: %w", p.index, err)
+		return nil, fmt.Errorf("failed to download part %d: %w", p.index, err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("non-2xx status (%d) for part %d", resp.StatusCode, p.index)
+		resp.Body.Close()
+		return nil, fmt.Errorf("non-2xx status (%d) for part %d", resp.StatusCode, p.index)
 	}
 
-	// Write directly to the correct offset
-	ow := &offsetWriter{
-		w:      outFile,
-		offset: int64(p.startByte),
+	// Anything past the start of the file must be honored as a range,
+	// otherwise we would write the start of the file at offset
+	if dl.remoteOffset()+offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server ignored range request for part %d", p.index)
+	}
+	return resp, nil
+}
+
+// partRemaining returns the part's next offset and current end, and
+// whether the part is complete.
+func (dl *download) partRemaining(p *downloadPart) (offset, end uint64, done bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return p.offset, p.endByte, p.offset > p.endByte
+}
+
+// nextPart returns the next part for an idle worker, or nil when the
+// scheduler has no more work.
+func (dl *download) nextPart() *downloadPart {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.sched.next(dl)
+}
+
+// splitLargestPart splits the remaining range of the running part with
+// the most bytes left and returns the upper half as a new part for an
+// idle worker to fetch over a fresh connection. It returns nil when no
+// part has enough left to be worth splitting. It must be called with
+// dl.mu held.
+func (dl *download) splitLargestPart() *downloadPart {
+	var largest *downloadPart
+	var remaining uint64
+	for _, p := range dl.parts {
+		if p.offset > p.endByte {
+			continue
+		}
+		if r := p.endByte - p.offset + 1; r > remaining {
+			largest, remaining = p, r
+		}
 	}
-	if _, copyErr := io.Copy(io.MultiWriter(ow, bar), resp.Body); copyErr != nil {
-		return fmt.Errorf("error writing part %d: %w", p.index, copyErr)
+	if largest == nil || remaining < dl.minSplit() {
+		return nil
+	}
+
+	mid := largest.offset + remaining/2
+	tail := &downloadPart{
+		index:     len(dl.parts),
+		uri:       largest.uri,
+		startByte: mid,
+		endByte:   largest.endByte,
+		offset:    mid,
+		committed: mid,
+	}
+	largest.endByte = mid - 1
+	dl.parts = append(dl.parts, tail)
+	dl.stats.splits.Add(1)
+	return tail
+}
+
+// isPrematureEOF reports whether err indicates that the server closed
+// the connection before sending the whole response body. A nil error
+// counts as well, since some servers end a response short without error.
+func isPrematureEOF(err error) bool {
+	return err == nil || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// remainingBytes returns how many bytes are left to fetch before any
+// parts are started.
+func (dl *download) remainingBytes() uint64 {
+	var n uint64
+	for _, r := range dl.remainingRanges() {
+		n += r.End - r.Start + 1
 	}
+	return n
+}
+
+// checkMirrors makes sure every mirror serves a file of the same size
+// with range support, since parts from all sources land in one file.
+// Mirrors sending what looks like an error page are dropped.
+func (dl *download) checkMirrors() error {
+	var kept []string
+	for _, mirror := range dl.mirrors {
+		req, err := http.NewRequest("HEAD", mirror, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create HEAD request for %s: %w", mirror, err)
+		}
+		dl.setHeaders(req)
+
+		resp, err := dl.do(req)
+		if err != nil {
+			return fmt.Errorf("HEAD request to %s failed: %w", mirror, err)
+		}
+		resp.Body.Close()
 
+		size, err := strconv.ParseUint(resp.Header.Get("Content-Length"), 10, 64)
+		if err == nil && dl.checkPages {
+			if why := errorPageReason(mirror, resp.Header.Get("Content-Type"), size, int64(dl.filesize)); why != "" {
+				fmt.Fprintf(os.Stderr, "Skipping mirror %s: %s.\n", mirror, why)
+				continue
+			}
+		}
+		if err != nil || size != dl.filesize {
+			return fmt.Errorf("mirror %s does not report the same size as %s", mirror, dl.uri)
+		}
+		if strings.ToLower(resp.Header.Get("Accept-Ranges")) != "bytes" {
+			return fmt.Errorf("mirror %s does not support partial content", mirror)
+		}
+		kept = append(kept, mirror)
+	}
+	dl.mirrors = kept
 	return nil
 }
 
-// calculatePartBoundary calculates the start and end bytes for a part index.
-func (dl *download) calculatePartBoundary(part int) (uint64, uint64) {
-	chunkSize := dl.filesize / uint64(dl.boost)
-	startByte := uint64(part) * chunkSize
-	var endByte uint64
+// setHeaders adds the user's extra headers to req, replacing any the
+// request already has.
+func (dl *download) setHeaders(req *http.Request) {
+	dl.setHeadersFor(req, requestVars{attempt: 1})
+}
 
-	// Last part gets any remaining bytes
-	if part == dl.boost-1 {
-		endByte = dl.filesize - 1
-	} else {
-		endByte = startByte + chunkSize - 1
+// printStats prints the transfer counters for the download, so the
+// schedulers can be compared against the same server.
+func (dl *download) printStats(elapsed time.Duration) {
+	speed := float64(dl.filesize-dl.resumed) / elapsed.Seconds()
+	fmt.Printf("Scheduler: %s, parts: %d, requests: %d, reconnects: %d, splits: %d, elapsed: %s, average: %s/s\n",
+		dl.scheduler, len(dl.parts), dl.stats.requests.Load(), dl.stats.reconnects.Load(),
+		dl.stats.splits.Load(), elapsed.Round(time.Millisecond), formatBytes(speed))
+	fmt.Printf("Connections: %d new, %d reused, %d TLS sessions resumed\n",
+		dl.stats.newConns.Load(), dl.stats.reusedConns.Load(), dl.stats.resumedTLS.Load())
+	if dl.mptcp {
+		fmt.Printf("Multipath TCP: %d of %d new connections\n", dl.stats.mptcpConns.Load(), dl.stats.newConns.Load())
+	}
+	if dl.multipath != nil {
+		fmt.Println("Received over:", dl.multipath.describe())
 	}
-	return startByte, endByte
 }
 
+// filenameFromURI returns the last segment of the URI path, fully
+// percent-decoded. It is empty when the path ends in a slash. Encoded
+// path separators are replaced so the name can't point elsewhere.
 func (dl *download) filenameFromURI() string {
-	splitURI := strings.Split(dl.uri, "/")
-	return splitURI[len(splitURI)-1]
+	u, err := url.Parse(dl.uri)
+	if err != nil {
+		return ""
+	}
+	segments := strings.Split(u.EscapedPath(), "/")
+	name, err := url.PathUnescape(segments[len(segments)-1])
+	if err != nil {
+		return ""
+	}
+	if name == "." || name == ".." {
+		return ""
+	}
+	// Escapes of bytes that aren't UTF-8 can't make a name every file
+	// system accepts
+	name = strings.ToValidUTF8(name, "\uFFFD")
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(name)
 }
 
+// outputPath returns where the file is written: at the filename, if it
+// is absolute, or relative to the working directory. Either way the path
+// is absolute, so on Windows the os package can add the \\?\ prefix that
+// paths longer than 260 characters need.
 func (dl *download) outputPath() string {
-	return fmt.Sprintf("%s%c%s", dl.workingDir, os.PathSeparator, dl.filename)
+	if filepath.IsAbs(dl.filename) {
+		return dl.filename
+	}
+	return filepath.Join(dl.workingDir, dl.filename)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// manifest records what a session downloaded, so the same files can be
+// fetched again later and checked to be identical, like a lockfile for
+// binary dependencies.
+type manifest struct {
+	Files []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	URI string `json:"uri"`
+	// FinalURI is where redirects led. It is only recorded, as it is
+	// often a signed URL that expires; downloads start from URI again.
+	FinalURI     string `json:"final_uri,omitempty"`
+	Filename     string `json:"filename"`
+	Size         uint64 `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+
+	sum *checksum
+}
+
+// readManifest reads the manifest at path, as written by -manifest.
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	for i := range m.Files {
+		e := &m.Files[i]
+		if e.URI == "" || e.Filename == "" {
+			return nil, fmt.Errorf("invalid manifest %s: file %d has no URI or filename", path, i+1)
+		}
+		if e.sum, err = parseChecksum("sha256:" + e.SHA256); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %s: %w", path, e.URI, err)
+		}
+	}
+	return &m, nil
+}
+
+// sources returns the files of the manifest to download.
+func (m *manifest) sources() []source {
+	sources := make([]source, len(m.Files))
+	for i, e := range m.Files {
+		sources[i] = source{uri: e.URI, filename: e.Filename}
+	}
+	return sources
+}
+
+// add records dl's completed file, hashing it.
+func (m *manifest) add(dl *download) error {
+	f, err := os.Open(dl.outputPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", dl.outputPath(), err)
+	}
+
+	info := dl.info()
+	e := manifestEntry{
+		URI:          info.uri,
+		Filename:     filepath.ToSlash(info.filename),
+		Size:         uint64(size),
+		ETag:         info.etag,
+		LastModified: info.lastModified,
+		SHA256:       hex.EncodeToString(h.Sum(nil)),
+	}
+	if info.finalURI != info.uri {
+		e.FinalURI = info.finalURI
+	}
+	m.Files = append(m.Files, e)
+	return nil
+}
+
+// write saves the manifest to path.
+func (m *manifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// remoteTailSize is how much of the end of an archive is fetched up
+	// front, as its index is kept there.
+	remoteTailSize = 256 << 10
+	// remoteSkipLimit is how far ahead a read may be for the open
+	// request to be read up to it rather than a new one made.
+	remoteSkipLimit = 64 << 10
+)
+
+// remoteFile reads dl's remote file through range requests, as an
+// io.ReaderAt for archive/zip. The end of the file is fetched once up
+// front; other reads that carry on where the last one stopped, as
+// reading a member's data does, share one request. It isn't safe for
+// concurrent use.
+type remoteFile struct {
+	dl   *download
+	ctx  context.Context
+	size int64
+	// tail holds the file from tailStart on.
+	tail      []byte
+	tailStart int64
+	// body is the open request, which reads on from pos.
+	body io.ReadCloser
+	pos  int64
+}
+
+// openRemote fetches the end of dl's remote file and returns a reader
+// for the rest of it.
+func (dl *download) openRemote(ctx context.Context) (*remoteFile, error) {
+	r := &remoteFile{dl: dl, ctx: ctx, size: int64(dl.filesize)}
+	r.tailStart = max(r.size-remoteTailSize, 0)
+	body, err := r.open(r.tailStart)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if r.tail, err = io.ReadAll(body); err != nil {
+		return nil, err
+	}
+	if int64(len(r.tail)) != r.size-r.tailStart {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return r, nil
+}
+
+// open requests the remote file from off on.
+func (r *remoteFile) open(off int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.dl.uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	r.dl.setHeaders(req)
+	r.dl.stats.requests.Add(1)
+	resp, err := r.dl.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, errors.New("the server ignored the range request")
+		}
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r.dl.limitReader(r.ctx, resp.Body), resp.Body}, nil
+}
+
+func (r *remoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if off >= r.tailStart {
+		n := copy(p, r.tail[off-r.tailStart:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	want := min(int64(len(p)), r.size-off)
+	var n int64
+	for attempt := 1; n < want; attempt++ {
+		err := r.seek(off + n)
+		if err == nil {
+			var m int
+			m, err = io.ReadFull(r.body, p[n:want])
+			n += int64(m)
+			r.pos += int64(m)
+		}
+		if err != nil {
+			r.Close()
+			if attempt > segmentRetries || r.ctx.Err() != nil {
+				return int(n), err
+			}
+			r.dl.warn("Reading the archive failed: %v; retrying", err)
+		}
+	}
+	if want < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// seek readies body to read from off, reading on to it if it is a little
+// ahead and making a new request otherwise.
+func (r *remoteFile) seek(off int64) error {
+	if r.body != nil && off >= r.pos && off-r.pos <= remoteSkipLimit {
+		n, err := io.CopyN(io.Discard, r.body, off-r.pos)
+		r.pos += n
+		if err == nil {
+			return nil
+		}
+	}
+	r.Close()
+	body, err := r.open(off)
+	if err != nil {
+		return err
+	}
+	r.body, r.pos = body, off
+	return nil
+}
+
+// Close ends the open request, if any.
+func (r *remoteFile) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// extractMembers extracts the members of dl's remote zip archive that
+// match patterns into dir, fetching only the archive's index and the
+// members' own compressed data. Each member is named after the last
+// element of its path in the archive.
+func (dl *download) extractMembers(ctx context.Context, patterns []string, dir string) error {
+	if dl.localPath != "" {
+		return errors.New("members can only be extracted from remote archives")
+	}
+	if !dl.supportsRange {
+		return fmt.Errorf("the server of %s doesn't support ranges", dl.uri)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Retries while reading the index are reported as they happen
+	dl.progress = nopReporter{}
+	r, err := dl.openRemote(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching the end of the archive: %w", err)
+	}
+	defer r.Close()
+	archive, err := zip.NewReader(r, r.size)
+	if err != nil {
+		if errors.Is(err, zip.ErrFormat) {
+			return fmt.Errorf("%s is not a zip archive", dl.filename)
+		}
+		return fmt.Errorf("error reading the archive's index: %w", err)
+	}
+	files, err := matchMembers(archive.File, patterns)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(files))
+	paths := make(map[string]string)
+	for i, f := range files {
+		base, err := memberName(f.Name)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, base)
+		if other, ok := paths[name]; ok {
+			return fmt.Errorf("both %s and %s would be extracted to %s", other, f.Name, name)
+		}
+		paths[name] = f.Name
+		names[i] = name
+	}
+
+	// Progress is of the extracted data, whose total is known up front
+	dl.filesize = 0
+	for _, f := range files {
+		dl.filesize += f.UncompressedSize64
+	}
+	dl.progress = dl.newReporter()
+	stop := make(chan struct{})
+	defer close(stop)
+	go dl.watchSpeed(stop, cancel)
+
+	for i, f := range files {
+		if err := dl.extractMember(f, names[i]); err != nil {
+			return cancelCause(ctx, fmt.Errorf("error extracting %s: %w", f.Name, err))
+		}
+	}
+	for i, f := range files {
+		fmt.Printf("Extracted %s (%s) to %s\n", f.Name, formatBytes(float64(f.UncompressedSize64)), names[i])
+	}
+	return nil
+}
+
+// memberName returns the file name a member at the given path in an
+// archive is extracted under: the last element of the path, taking
+// backslashes as separators too, as archives made on Windows may.
+// Names that would land outside the directory, or aren't valid file
+// names here, such as ".." or a drive letter, are an error.
+func memberName(name string) (string, error) {
+	base := path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if base == "." || base == ".." || base == "/" || !filepath.IsLocal(base) {
+		return "", fmt.Errorf("member %q has no name that can be extracted", name)
+	}
+	return base, nil
+}
+
+// extractMember decompresses member f to name. The file appears at name
+// complete or not at all.
+func (dl *download) extractMember(f *zip.File, name string) error {
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := fmt.Sprintf("%s.%d.tmp", name, os.Getpid())
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	// archive/zip checks the member's CRC-32 as it reaches the end
+	_, err = io.Copy(io.MultiWriter(out, progressCounter{dl}), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if !f.Modified.IsZero() {
+		_ = os.Chtimes(name, f.Modified, f.Modified)
+	}
+	return nil
+}
+
+// matchMembers returns the files of an archive named by patterns, each
+// either a member's full path or a path.Match pattern for it. Every
+// pattern must match at least one file.
+func matchMembers(files []*zip.File, patterns []string) ([]*zip.File, error) {
+	var matched []*zip.File
+	seen := make(map[*zip.File]bool)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid member pattern %q: %w", pattern, err)
+		}
+		found := false
+		for _, f := range files {
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			if ok, _ := path.Match(pattern, f.Name); !ok && f.Name != pattern {
+				continue
+			}
+			found = true
+			if !seen[f] {
+				seen[f] = true
+				matched = append(matched, f)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no member of the archive matches %q", pattern)
+		}
+	}
+	return matched, nil
+}
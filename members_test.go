@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+func TestMemberName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"readme.txt", "readme.txt"},
+		{"docs/readme.txt", "readme.txt"},
+		{`docs\readme.txt`, "readme.txt"},
+		{`..\..\evil.exe`, "evil.exe"},
+		{"../../evil.exe", "evil.exe"},
+		{"/etc/passwd", "passwd"},
+		{"docs/..", ""},
+		{`docs\..`, ""},
+		{"..", ""},
+		{".", ""},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := memberName(tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("memberName(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("memberName(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// zipArchive returns a zip archive of the given members and contents.
+func zipArchive(t *testing.T, members map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range members {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractMembers(t *testing.T) {
+	archive := zipArchive(t, map[string]string{
+		"docs/readme.txt": "read me",
+		"data/big.bin":    string(dltest.RandomData(1<<20, 6)),
+		`..\..\evil.exe`:  "evil",
+		"docs/..":         "dots",
+	})
+	srv := dltest.NewServer(archive, dltest.Options{Ranges: true})
+	defer srv.Close()
+	dir := filepath.Join(t.TempDir(), "a", "b")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	dl := newTestDownload(t, srv.FileURL("archive.zip"), dir)
+	if err := dl.extractMembers(context.Background(), []string{"docs/readme.txt", "data/*"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "readme.txt")); err != nil || string(got) != "read me" {
+		t.Errorf("readme.txt holds %q, %v", got, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "big.bin")); err != nil || !bytes.Equal(got, dltest.RandomData(1<<20, 6)) {
+		t.Errorf("big.bin is %d bytes, %v", len(got), err)
+	}
+	// Only what was asked for is fetched: the end of the archive and the
+	// two members
+	if n := srv.Requests(); n > 6 {
+		t.Errorf("made %d requests", n)
+	}
+
+	dl = newTestDownload(t, srv.FileURL("archive.zip"), dir)
+	if err := dl.extractMembers(context.Background(), []string{"*"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.exe")); err != nil {
+		t.Errorf("evil.exe wasn't extracted into the directory: %v", err)
+	}
+	for _, outside := range []string{filepath.Join(dir, "..", "evil.exe"), filepath.Join(dir, "..", "..", "evil.exe")} {
+		if _, err := os.Stat(outside); err == nil {
+			t.Errorf("%s was written outside the directory", outside)
+		}
+	}
+
+	dl = newTestDownload(t, srv.FileURL("archive.zip"), dir)
+	if err := dl.extractMembers(context.Background(), []string{"docs/*"}, dir); err == nil {
+		t.Error("extracted a member named docs/..")
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorEntry is a file of a remote directory being mirrored.
+type mirrorEntry struct {
+	uri string
+	// rel is the file's path within the directory, with slashes.
+	rel string
+	// size is -1, and modTime zero, when the listing doesn't say.
+	size    int64
+	modTime time.Time
+	// md5 is the file's MD5 when the listing gives it, as S3 does for
+	// objects not uploaded in parts.
+	md5 []byte
+}
+
+// listMirror lists the files in the remote directory uri and its
+// subdirectories, from a WebDAV server, an S3 compatible bucket, or a web
+// server's directory index, whichever it turns out to be.
+func (dl *download) listMirror(uri string) ([]mirrorEntry, error) {
+	if entries, err := dl.propfind(uri, "0"); err == nil && len(entries) > 0 && entries[0].collection {
+		var files []mirrorEntry
+		err := dl.walkWebDAV(uri, func(e davEntry, rel string) {
+			f := mirrorEntry{uri: e.uri, rel: rel, size: int64(e.size)}
+			f.modTime, _ = http.ParseTime(e.lastModified)
+			files = append(files, f)
+		})
+		return files, err
+	}
+	if files, ok, err := dl.listS3(uri); ok {
+		return files, err
+	}
+	return dl.listIndex(uri)
+}
+
+// s3ListResult is a page of an S3 ListObjectsV2 response.
+type s3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listS3 lists the objects under uri, a prefix in an S3 compatible
+// bucket, addressed either by host, as bucket.s3.amazonaws.com/prefix/,
+// or by path, as s3.amazonaws.com/bucket/prefix/. It reports false if uri
+// isn't in a bucket that can be listed.
+func (dl *download) listS3(uri string) ([]mirrorEntry, bool, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, false, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	// The bucket is the host, or else the first element of the path
+	type bucketPrefix struct{ bucket, prefix string }
+	tries := []bucketPrefix{{"/", key}}
+	if bucket, rest, ok := strings.Cut(key, "/"); ok {
+		tries = append(tries, bucketPrefix{"/" + bucket + "/", rest})
+	}
+
+	for _, try := range tries {
+		var files []mirrorEntry
+		token := ""
+		for page := 0; ; page++ {
+			list := url.URL{Scheme: u.Scheme, Host: u.Host, Path: try.bucket}
+			q := url.Values{"list-type": {"2"}, "prefix": {try.prefix}}
+			if token != "" {
+				q.Set("continuation-token", token)
+			}
+			list.RawQuery = q.Encode()
+			result, err := dl.fetchS3List(list.String())
+			if err != nil && page == 0 {
+				break
+			}
+			if err != nil {
+				return nil, true, err
+			}
+			for _, c := range result.Contents {
+				rel := strings.TrimPrefix(c.Key, try.prefix)
+				if rel == "" || strings.HasSuffix(rel, "/") {
+					// Folder markers
+					continue
+				}
+				obj := url.URL{Scheme: u.Scheme, Host: u.Host, Path: try.bucket + c.Key}
+				f := mirrorEntry{uri: obj.String(), rel: rel, size: c.Size, modTime: c.LastModified}
+				// A multipart upload's ETag isn't the MD5 of the object
+				if etag := strings.Trim(c.ETag, `"`); len(etag) == 32 {
+					f.md5, _ = hex.DecodeString(etag)
+				}
+				files = append(files, f)
+			}
+			if !result.IsTruncated || result.NextContinuationToken == "" {
+				return files, true, nil
+			}
+			token = result.NextContinuationToken
+		}
+	}
+	return nil, false, nil
+}
+
+// fetchS3List fetches a page of an S3 listing from uri.
+func (dl *download) fetchS3List(uri string) (*s3ListResult, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	dl.setHeaders(req)
+	resp, err := dl.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-200 status (%d) for %s", resp.StatusCode, uri)
+	}
+	var result s3ListResult
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxPageSize)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid bucket listing from %s: %w", uri, err)
+	}
+	return &result, nil
+}
+
+// listIndex lists the files in uri, a directory index page as web
+// servers generate, following the links to its subdirectories. Links to
+// anywhere else, such as the parent directory or the index sorted
+// another way, are left out.
+func (dl *download) listIndex(uri string) ([]mirrorEntry, error) {
+	root, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	root.Path = strings.TrimSuffix(root.Path, "/") + "/"
+	root.RawPath = ""
+
+	var files []mirrorEntry
+	visited := map[string]bool{root.Path: true}
+	queue := []string{root.String()}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		page, isHTML, err := dl.fetchPage(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !isHTML {
+			return nil, fmt.Errorf("%s is not a directory index", dir)
+		}
+		links, err := pageLinks(page, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range links {
+			if u.Host != root.Host || u.RawQuery != "" || visited[u.Path] || !strings.HasPrefix(u.Path, root.Path) {
+				continue
+			}
+			visited[u.Path] = true
+			if strings.HasSuffix(u.Path, "/") {
+				queue = append(queue, u.String())
+				continue
+			}
+			rel := strings.TrimPrefix(u.Path, root.Path)
+			if strings.Contains("/"+rel+"/", "/../") {
+				continue
+			}
+			files = append(files, mirrorEntry{uri: u.String(), rel: rel, size: -1})
+		}
+	}
+	return files, nil
+}
+
+// mirrorPlan is what dl mirror does to bring a local directory up to
+// date with a remote one.
+type mirrorPlan struct {
+	// fetch are the files that are new or changed.
+	fetch                     []source
+	added, changed, unchanged int
+	// remove are the local files gone from the remote directory.
+	remove []string
+}
+
+// planMirror compares the files of the remote directory uri with those in
+// dir. A file is unchanged if it is the same size and has the same
+// modification time or, failing that, the same hash, from sums or the
+// listing; one with progress saved is resumed. Files in the listing
+// without a size, as in directory indexes, are asked for it first.
+func (dl *download) planMirror(uri, dir string, sums checksumList, progressFile string) (*mirrorPlan, error) {
+	files, err := dl.listMirror(uri)
+	if err != nil {
+		return nil, err
+	}
+	dl.statMirror(files)
+
+	plan := &mirrorPlan{}
+	remote := make(map[string]bool)
+	for _, f := range files {
+		name := filepath.Clean(filepath.FromSlash(f.rel))
+		if !filepath.IsLocal(name) {
+			continue
+		}
+		remote[name] = true
+		local := filepath.Join(dir, name)
+		switch mirrorState(f, local, sums, progressFile) {
+		case "unchanged":
+			plan.unchanged++
+			continue
+		case "new":
+			plan.added++
+		default:
+			plan.changed++
+		}
+		plan.fetch = append(plan.fetch, source{uri: f.uri, filename: filepath.ToSlash(local), modTime: f.modTime})
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		// Hidden files, such as dl's own progress files, are kept
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && !remote[rel] {
+			plan.remove = append(plan.remove, path)
+		}
+		return nil
+	})
+	return plan, err
+}
+
+// statMirror fills in the size and modification time of files whose
+// listing didn't give them, a few at a time.
+func (dl *download) statMirror(files []mirrorEntry) {
+	queue := make(chan *mirrorEntry)
+	var wg sync.WaitGroup
+	for range metadataWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				probe := &download{uri: f.uri, client: dl.client, headers: dl.headers}
+				if probe.FetchMetadata() != nil {
+					// Downloaded again, to find out
+					continue
+				}
+				f.size = int64(probe.filesize)
+				f.modTime, _ = http.ParseTime(probe.lastModified)
+			}
+		}()
+	}
+	for i := range files {
+		if files[i].size < 0 {
+			queue <- &files[i]
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// mirrorState returns whether the remote file f is "new", "changed", or
+// "unchanged" compared with the local file at path.
+func mirrorState(f mirrorEntry, path string, sums checksumList, progressFile string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "new"
+	}
+	probe := &download{filename: path, progressFile: progressFile}
+	if _, err := os.Stat(probe.progressPath()); err == nil || f.size < 0 || info.Size() != f.size {
+		return "changed"
+	}
+	if f.modTime.IsZero() || info.ModTime().Unix() == f.modTime.Unix() {
+		return "unchanged"
+	}
+
+	// Touched but perhaps the same, which its hash tells
+	var same bool
+	if c, ok := sums.lookup(f.rel); ok {
+		same = c.verifyQuietly(path, "") == nil
+	} else if f.md5 != nil {
+		h := md5.New()
+		same = hashFile(path, "", h) == nil && bytes.Equal(h.Sum(nil), f.md5)
+	}
+	if !same {
+		return "changed"
+	}
+	// Checked by the time from now on
+	_ = os.Chtimes(path, time.Now(), f.modTime)
+	return "unchanged"
+}
+
+// removesEverything reports whether prune would delete every local file,
+// as when the listing came back empty, which more likely means something
+// is wrong with the remote directory than that it really was emptied.
+func (p *mirrorPlan) removesEverything() bool {
+	return len(p.remove) > 0 && p.changed+p.unchanged == 0
+}
+
+// prune deletes the local files gone from the remote directory, and the
+// directories they leave empty.
+func (p *mirrorPlan) prune(dir string) error {
+	for _, path := range p.remove {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Println("Deleted:", path)
+		// Removing a directory fails unless it's empty
+		for parent := filepath.Dir(path); parent != filepath.Clean(dir); parent = filepath.Dir(parent) {
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// multipath spreads the connections of a download over several network
+// interfaces, such as Ethernet and LTE, so their bandwidth adds up. Each
+// new connection is made from the next interface in turn.
+type multipath struct {
+	links []*link
+	next  atomic.Uint64
+}
+
+// link is a network interface that connections are made from.
+type link struct {
+	name string
+	// addrs are the interface's addresses to connect from, IPv4 first.
+	addrs []net.IP
+	// received counts the bytes read over the interface.
+	received atomic.Int64
+}
+
+// parseMultipath looks up the interfaces in a comma separated list of
+// names, such as "eth0,wwan0".
+func parseMultipath(s string) (*multipath, error) {
+	m := &multipath{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", name, err)
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return nil, fmt.Errorf("interface %s is down", name)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("interface %s: %w", name, err)
+		}
+		l := &link{name: name}
+		var v6 []net.IP
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			// Link-local addresses can't reach servers
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				l.addrs = append(l.addrs, ipnet.IP)
+			} else {
+				v6 = append(v6, ipnet.IP)
+			}
+		}
+		l.addrs = append(l.addrs, v6...)
+		if len(l.addrs) == 0 {
+			return nil, fmt.Errorf("interface %s has no address to connect from", name)
+		}
+		m.links = append(m.links, l)
+	}
+	return m, nil
+}
+
+// fresh returns a multipath over the same interfaces with no bytes
+// counted yet, for the next download.
+func (m *multipath) fresh() *multipath {
+	f := &multipath{}
+	for _, l := range m.links {
+		f.links = append(f.links, &link{name: l.name, addrs: l.addrs})
+	}
+	return f
+}
+
+// dial returns a dial function that connects through base from the next
+// interface in turn, falling back to the others if that fails.
+func (m *multipath) dial(base *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		first := int(m.next.Add(1) - 1)
+		var errs []error
+		for i := range m.links {
+			l := m.links[(first+i)%len(m.links)]
+			conn, err := l.dial(ctx, base, network, addr)
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, fmt.Errorf("via %s: %w", l.name, err))
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// dial connects to addr from the interface, trying each of its
+// addresses until one is of a family the server has an address of.
+func (l *link) dial(ctx context.Context, base *net.Dialer, network, addr string) (net.Conn, error) {
+	d := *base
+	d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if base.ControlContext != nil {
+			if err := base.ControlContext(ctx, network, address, c); err != nil {
+				return err
+			}
+		}
+		bindToDevice(c, l.name)
+		return nil
+	}
+	var err error
+	for _, ip := range l.addrs {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, addr); err == nil {
+			return &linkConn{Conn: conn, l: l}, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// linkConn counts the bytes read over its link.
+type linkConn struct {
+	net.Conn
+	l *link
+}
+
+func (c *linkConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.l.received.Add(int64(n))
+	return n, err
+}
+
+// NetConn returns the underlying connection, as tls.Conn's does.
+func (c *linkConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// describe summarizes how much was received over each interface.
+func (m *multipath) describe() string {
+	var total int64
+	for _, l := range m.links {
+		total += l.received.Load()
+	}
+	parts := make([]string, len(m.links))
+	for i, l := range m.links {
+		n := l.received.Load()
+		share := 0.0
+		if total > 0 {
+			share = float64(n) / float64(total) * 100
+		}
+		parts[i] = fmt.Sprintf("%s %s (%.0f%%)", l.name, formatBytes(float64(n)), share)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// tcpConn returns the TCP connection under conn's wrappers, such as
+// tls.Conn and linkConn, or nil if there is none.
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
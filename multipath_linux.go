@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+// bindToDevice ties the socket to the named interface, so its traffic
+// leaves through that interface whatever the routing table says. It
+// needs CAP_NET_RAW; without it, the source address alone decides,
+// which takes source-based routing rules to route as intended.
+func bindToDevice(c syscall.RawConn, name string) {
+	_ = c.Control(func(fd uintptr) {
+		_ = syscall.BindToDevice(int(fd), name)
+	})
+}
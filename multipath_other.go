@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// bindToDevice is a no-op here; the source address decides which
+// interface connections leave through.
+func bindToDevice(c syscall.RawConn, name string) {}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// preferredExtensions picks the usual extension for common content types,
+// where mime.ExtensionsByType would return several in no useful order.
+var preferredExtensions = map[string]string{
+	"application/gzip":   ".gz",
+	"application/json":   ".json",
+	"application/pdf":    ".pdf",
+	"application/x-gzip": ".gz",
+	"application/xml":    ".xml",
+	"application/zip":    ".zip",
+	"image/jpeg":         ".jpg",
+	"text/html":          ".html",
+	"text/plain":         ".txt",
+}
+
+// extensionForType returns the file extension for a Content-Type header,
+// or "" if there is no sensible one. Generic binary content gets none.
+func extensionForType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// filenameFromContentType derives a filename for URIs without a usable
+// name of their own (e.g. ending in "/"), from the host and content type.
+func (dl *download) filenameFromContentType() string {
+	name := "download"
+	if u, err := url.Parse(dl.uri); err == nil && u.Hostname() != "" {
+		name = u.Hostname()
+	}
+	return name + extensionForType(dl.contentType)
+}
+
+// namingOptions are the flags that decide what downloads are saved as.
+type namingOptions struct {
+	// filename is -filename, which dir reports names a directory.
+	filename string
+	dir      bool
+	// fixExtension appends the extension matching the content type to
+	// names without one.
+	fixExtension bool
+}
+
+// name returns what the file from src is saved as, given the name and
+// content type its metadata came with, or "" if there is no usable name.
+// Files of a batch may still be renamed to tell them apart.
+func (o namingOptions) name(src source, name, contentType string) string {
+	switch {
+	case o.filename != "" && !o.dir:
+		name = o.filename
+	case src.filename != "":
+		name = filepath.FromSlash(src.filename)
+	case o.fixExtension && filepath.Ext(name) == "":
+		name += extensionForType(contentType)
+	}
+	if strings.TrimSpace(name) == "" {
+		return ""
+	}
+	// A directory keeps the file's own name, within it
+	if o.dir {
+		name = filepath.Join(o.filename, name)
+	}
+	return name
+}
+
+// serverFilename returns the name to save a file under from name, the
+// filename a server suggested in Content-Disposition, and whether it is
+// safe to use. Only the last element of a path is kept, unless
+// trustPaths is set, when directories are kept as long as they stay
+// within the download directory. Names that are empty, hidden, or
+// special, such as .. or, on Windows, NUL, are refused.
+func serverFilename(name string, trustPaths bool) (string, bool) {
+	// Servers may send Windows paths, whatever the client
+	name = strings.ReplaceAll(name, "\\", "/")
+	elems := strings.Split(name, "/")
+	if !trustPaths || path.IsAbs(name) || !filepath.IsLocal(filepath.FromSlash(name)) {
+		elems = elems[len(elems)-1:]
+	}
+	for _, e := range elems {
+		if e == "" || e == "." || strings.HasPrefix(e, ".") || !filepath.IsLocal(e) || strings.ContainsFunc(e, unicode.IsControl) {
+			return "", false
+		}
+	}
+	return filepath.Join(elems...), true
+}
+
+// normalizeURI cleans up a URI as typed or pasted by a user before any
+// requests are made: international host names are converted to punycode,
+// and spaces and other characters that aren't valid in a URI are
+// percent-encoded. The fragment is dropped since it's never sent.
+func normalizeURI(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" {
+		return "", fmt.Errorf("%q has no scheme, such as https://, and isn't a file that exists", raw)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute URI", raw)
+	}
+
+	host := hostToASCII(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.RawQuery = escapeInvalid(u.RawQuery)
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String(), nil
+}
+
+// escapeInvalid percent-encodes bytes that may not appear literally in a
+// URI, leaving existing escapes and reserved characters alone.
+func escapeInvalid(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"<>\\^`{|}", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// isDirPath reports whether path, as given to -filename, names a
+// directory: one that exists, or any path ending in a separator.
+func isDirPath(path string) bool {
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// batchNames keeps the output paths taken by the downloads of a batch
+// so far, so URIs that end in the same name don't overwrite each other.
+type batchNames map[string]string
+
+// key returns how path is compared with the others: cleaned, and on file
+// systems that usually ignore case, lowercased.
+func (b batchNames) key(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// claim takes dl's filename for it, renaming it with a number if an
+// earlier download of another URI in the batch already has it. The same
+// URI twice is the same file, so it keeps its name.
+func (b batchNames) claim(dl *download) {
+	name := dl.filename
+	for n := 2; ; n++ {
+		uri, taken := b[b.key(name)]
+		if !taken || uri == dl.uri {
+			break
+		}
+		name = numberedName(dl.filename, n)
+	}
+	if name != dl.filename {
+		fmt.Printf("%s is already the name of another file in the batch; saving %s as %s.\n", dl.filename, dl.uri, name)
+		dl.filename = name
+	}
+	b[b.key(name)] = dl.uri
+}
+
+// numberedName returns name with n added before its extension, keeping
+// compound extensions such as .tar.gz together: "file-2.tar.gz".
+func numberedName(name string, n int) string {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if inner := filepath.Ext(stem); strings.EqualFold(inner, ".tar") {
+		ext = inner + ext
+		stem = strings.TrimSuffix(stem, inner)
+	}
+	return fmt.Sprintf("%s-%d%s", stem, n, ext)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeURI(t *testing.T) {
+	tests := []struct {
+		uri, want string
+	}{
+		{"https://example.com/file.iso", "https://example.com/file.iso"},
+		{"https://münchen.de/karte.pdf", "https://xn--mnchen-3ya.de/karte.pdf"},
+		{"https://例え.テスト:8443/a", "https://xn--r8jz45g.xn--zckzah:8443/a"},
+		{"https://example.com/my file.zip", "https://example.com/my%20file.zip"},
+		{"https://example.com/straße.txt", "https://example.com/stra%C3%9Fe.txt"},
+		{"https://example.com/f?q=a b", "https://example.com/f?q=a%20b"},
+		{"https://example.com/f#section", "https://example.com/f"},
+		{"  https://example.com/f  ", "https://example.com/f"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeURI(tt.uri)
+		if err != nil {
+			t.Errorf("normalizeURI(%q) failed: %v", tt.uri, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeURI(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+
+	for _, uri := range []string{"example.com/file", "/file.iso", "https://"} {
+		if got, err := normalizeURI(uri); err == nil {
+			t.Errorf("normalizeURI(%q) = %q, want an error", uri, got)
+		}
+	}
+}
+
+func TestFilenameFromURI(t *testing.T) {
+	tests := []struct {
+		uri, want string
+	}{
+		{"https://example.com/file.iso", "file.iso"},
+		{"https://example.com/my%20file.zip", "my file.zip"},
+		{"https://example.com/stra%C3%9Fe.txt", "straße.txt"},
+		{"https://example.com/%E4%BE%8B%E3%81%88.pdf", "例え.pdf"},
+		{"https://example.com/caf%C3%A9%20menu.pdf?v=2", "café menu.pdf"},
+		{"https://example.com/e%CC%81t%C3%A9.txt", "e\u0301té.txt"},
+		{"https://example.com/a%2Fb%5Cc.txt", "a_b_c.txt"},
+		{"https://example.com/%FF%FEbad.txt", "�bad.txt"},
+		{"https://example.com/100%25.txt", "100%.txt"},
+		{"https://example.com/dir/", ""},
+		{"https://example.com/%2E%2E", ""},
+		{"https://example.com/bad%zz", ""},
+	}
+	for _, tt := range tests {
+		dl := &download{uri: tt.uri}
+		if got := dl.filenameFromURI(); got != tt.want {
+			t.Errorf("filenameFromURI(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.WriteFile("exists.iso", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source, want string
+	}{
+		{"/data/file.iso", "/data/file.iso"},
+		{"./file.iso", "./file.iso"},
+		{"../file.iso", "../file.iso"},
+		{"exists.iso", "exists.iso"},
+		{"file:///data/file.iso", filepath.FromSlash("/data/file.iso")},
+		{"file:/data/file.iso", filepath.FromSlash("/data/file.iso")},
+		{"file:data/file.iso", filepath.FromSlash("data/file.iso")},
+		{"example.com/file.iso", ""},
+		{"missing.iso", ""},
+		{"https://example.com/file.iso", ""},
+	}
+	for _, tt := range tests {
+		if got := localPath(tt.source); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+
+	_, err = normalizeURI("example.com/file.iso")
+	if err == nil || !strings.Contains(err.Error(), "no scheme") {
+		t.Errorf("normalizeURI of a URI without a scheme: %v", err)
+	}
+}
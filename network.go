@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// networkProbeTimeout bounds each check of whether the network is up.
+	networkProbeTimeout = 15 * time.Second
+	// networkProbeMin and networkProbeMax bound the delay between
+	// checks while waiting for the network, which doubles after each.
+	networkProbeMin = time.Second
+	networkProbeMax = time.Minute
+)
+
+// isNetworkError reports whether err comes from failing to reach a
+// server at all, such as a failed DNS lookup, a connection that couldn't
+// be made or was lost, or a timeout, rather than from the server itself.
+func isNetworkError(err error) bool {
+	if errors.Is(err, errBlocked) || errors.Is(err, syscall.ECONNREFUSED) {
+		// The server was reached, or never would be
+		return false
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// reachable reports whether the download's server answers a HEAD
+// request, whatever its status.
+func (dl *download) reachable() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), networkProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dl.uri, nil)
+	if err != nil {
+		return false
+	}
+	dl.setHeaders(req)
+	resp, err := dl.do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// offline reports whether err means the network is down: it must come
+// from the network, and the server must still be out of reach.
+func (dl *download) offline(err error) bool {
+	return isNetworkError(err) && !dl.reachable()
+}
+
+// waitForNetwork waits until the download's server can be reached again,
+// checking with growing delays.
+func (dl *download) waitForNetwork(err error) {
+	fmt.Fprintf(os.Stderr, "%v\nThe network seems to be down; waiting for it to come back...\n", err)
+	delay := networkProbeMin
+	for {
+		time.Sleep(delay)
+		if dl.reachable() {
+			break
+		}
+		delay = min(2*delay, networkProbeMax)
+	}
+	fmt.Fprintln(os.Stderr, "The network is back; resuming.")
+}
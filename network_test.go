@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReachableWithoutClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	dl := &download{uri: srv.URL + "/file.bin"}
+	if !dl.reachable() {
+		t.Error("a server answering 404 isn't reachable")
+	}
+	netErr := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+	if dl.offline(netErr) {
+		t.Error("offline while the server answers")
+	}
+
+	srv.Close()
+	if dl.reachable() {
+		t.Error("a closed server is reachable")
+	}
+	if !dl.offline(netErr) {
+		t.Error("not offline with the server gone")
+	}
+}
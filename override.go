@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseResolve parses -resolve entries of the form "host:port:address",
+// as curl's --resolve takes them, into a map from "host:port" to the
+// address to connect to instead. The address may be an IPv6 address in
+// brackets, or another host name.
+func parseResolve(entries []string) (map[string]string, error) {
+	resolve := make(map[string]string)
+	for _, e := range entries {
+		host, rest, ok := strings.Cut(e, ":")
+		port, addr, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 || host == "" || addr == "" {
+			return nil, fmt.Errorf("%q must be in the form host:port:address", e)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid port in %q", e)
+		}
+		addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		resolve[net.JoinHostPort(strings.ToLower(host), port)] = net.JoinHostPort(addr, port)
+	}
+	return resolve, nil
+}
+
+// resolveOverride wraps dial so connections to the hosts in resolve go
+// to the addresses given for them instead. Only where to connect
+// changes: requests keep their Host header, and TLS its server name.
+func resolveOverride(dial func(ctx context.Context, network, addr string) (net.Conn, error), resolve map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if to, ok := resolve[strings.ToLower(addr)]; ok {
+			addr = to
+		}
+		return dial(ctx, network, addr)
+	}
+}
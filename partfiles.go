@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// strategies are the valid -strategy values: writeat writes every part
+// straight into the output file, partfiles writes each part to a file of
+// its own and joins them once the download is complete.
+var strategies = []string{"writeat", "partfiles"}
+
+// partFile holds the bytes of the download from start on.
+type partFile struct {
+	start uint64
+	size  uint64
+	f     *os.File
+}
+
+// partFileSet spreads a download over part files, each only ever
+// appended to, for destinations where writing at random offsets of one
+// large file is slow or unreliable, such as some FUSE and network mounts.
+type partFileSet struct {
+	dl *download
+
+	mu sync.Mutex
+	// files is sorted by start. Parts never overlap, so a write either
+	// continues a file or starts a new one.
+	files []*partFile
+}
+
+// partFiles reports whether dl is written to part files.
+func (dl *download) partFiles() bool {
+	return dl.strategy == "partfiles" && dl.supportsRange
+}
+
+// partFilePath returns where the part file starting at start is kept.
+func (dl *download) partFilePath(start uint64) string {
+	dir, name := filepath.Split(dl.outputPath())
+	return fmt.Sprintf("%s%s%s.%d.part", dir, dl.partFilePrefix(), name, start)
+}
+
+// partFilePrefix is what the names of part files start with: a dot,
+// hiding them, unless the progress file isn't hidden either.
+func (dl *download) partFilePrefix() string {
+	if strings.HasPrefix(filepath.Base(dl.progressPath()), ".") {
+		return "."
+	}
+	return ""
+}
+
+// existingPartFiles returns the start offsets of the part files on disk.
+func (dl *download) existingPartFiles() ([]uint64, error) {
+	dir, name := filepath.Split(dl.outputPath())
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var starts []uint64
+	for _, e := range entries {
+		rest, ok := strings.CutPrefix(e.Name(), dl.partFilePrefix()+name+".")
+		if !ok {
+			continue
+		}
+		if rest, ok = strings.CutSuffix(rest, ".part"); !ok {
+			continue
+		}
+		if start, err := strconv.ParseUint(rest, 10, 64); err == nil {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts, nil
+}
+
+// removePartFiles deletes the download's part files.
+func (dl *download) removePartFiles() {
+	starts, _ := dl.existingPartFiles()
+	for _, start := range starts {
+		_ = os.Remove(dl.partFilePath(start))
+	}
+}
+
+// openPartFiles opens the part files of the download. When resuming,
+// each file is cut back to the bytes recorded as completed, and files
+// holding nothing completed are dropped; otherwise leftovers of earlier
+// runs are removed.
+func (dl *download) openPartFiles(resuming bool) (*partFileSet, error) {
+	set := &partFileSet{dl: dl}
+	if !resuming {
+		dl.removePartFiles()
+		return set, nil
+	}
+
+	starts, err := dl.existingPartFiles()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read part files: %w", err)
+	}
+	for _, start := range starts {
+		path := dl.partFilePath(start)
+		var keep uint64
+		for _, r := range dl.completed {
+			if r.Start <= start && start <= r.End {
+				keep = r.End - start + 1
+				break
+			}
+		}
+		if keep == 0 {
+			_ = os.Remove(path)
+			continue
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			set.close()
+			return nil, fmt.Errorf("cannot open part file: %w", err)
+		}
+		info, err := f.Stat()
+		if err == nil {
+			keep = min(keep, uint64(info.Size()))
+			err = f.Truncate(int64(keep))
+		}
+		if err != nil {
+			f.Close()
+			set.close()
+			return nil, fmt.Errorf("cannot resume part file: %w", err)
+		}
+		set.files = append(set.files, &partFile{start: start, size: keep, f: f})
+	}
+	return set, nil
+}
+
+// WriteAt writes b to the part file continuing at off, creating one if
+// none does.
+func (s *partFileSet) WriteAt(b []byte, off int64) (int, error) {
+	pf, err := s.fileAt(uint64(off))
+	if err != nil {
+		return 0, err
+	}
+	n, err := pf.f.WriteAt(b, off-int64(pf.start))
+	s.mu.Lock()
+	pf.size = max(pf.size, uint64(off)-pf.start+uint64(n))
+	s.mu.Unlock()
+	return n, err
+}
+
+func (s *partFileSet) fileAt(off uint64) (*partFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].start > off })
+	if i > 0 && off <= s.files[i-1].start+s.files[i-1].size {
+		return s.files[i-1], nil
+	}
+	f, err := os.OpenFile(s.dl.partFilePath(off), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create part file: %w", err)
+	}
+	pf := &partFile{start: off, f: f}
+	s.files = append(s.files, nil)
+	copy(s.files[i+1:], s.files[i:])
+	s.files[i] = pf
+	return pf, nil
+}
+
+// fileFor returns the part file holding byte off, if any.
+func (s *partFileSet) fileFor(off uint64) *partFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].start > off })
+	if i == 0 {
+		return nil
+	}
+	return s.files[i-1]
+}
+
+// join writes the part files one after the other into the output file,
+// then removes them.
+func (s *partFileSet) join() error {
+	out, err := os.Create(s.dl.outputPath())
+	if err != nil {
+		return fmt.Errorf("cannot create output file: %w", err)
+	}
+
+	var next uint64
+	for _, pf := range s.files {
+		if pf.start != next {
+			err = fmt.Errorf("part files are missing bytes %d-%d", next, pf.start-1)
+			break
+		}
+		if _, err = io.Copy(out, io.NewSectionReader(pf.f, 0, int64(pf.size))); err != nil {
+			err = fmt.Errorf("cannot join part files: %w", err)
+			break
+		}
+		next += pf.size
+	}
+	if err == nil && next != s.dl.filesize {
+		err = fmt.Errorf("part files hold %d of %d bytes", next, s.dl.filesize)
+	}
+	if cerr := out.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("cannot write output file: %w", cerr)
+	}
+	if err != nil {
+		_ = os.Remove(s.dl.outputPath())
+		return err
+	}
+
+	s.close()
+	for _, pf := range s.files {
+		if err := os.Remove(pf.f.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "Error removing part file: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// close closes the part files, leaving them on disk.
+func (s *partFileSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pf := range s.files {
+		pf.f.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+// partFilesLeft returns the names of the part files in dir.
+func partFilesLeft(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".part") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestPartFilesResume(t *testing.T) {
+	data := dltest.RandomData(4<<20, 11)
+	srv := dltest.NewServer(data, dltest.Options{Ranges: true, Rate: 1 << 20, ETag: `"v1"`})
+	defer srv.Close()
+	dir := t.TempDir()
+
+	dl := newTestDownload(t, srv.FileURL("file.bin"), dir)
+	dl.strategy = "partfiles"
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := dl.Fetch(ctx); err == nil {
+		t.Fatal("Fetch finished before it was interrupted")
+	}
+	dl.abort()
+	if len(partFilesLeft(t, dir)) == 0 {
+		t.Fatal("no part files kept to resume from")
+	}
+
+	dl = newTestDownload(t, srv.FileURL("file.bin"), dir)
+	dl.strategy = "partfiles"
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatalf("resumed Fetch: %v", err)
+	}
+	if dl.resumed == 0 {
+		t.Error("the download started over instead of resuming")
+	}
+	checkOutput(t, dl, data)
+	if left := partFilesLeft(t, dir); len(left) != 0 {
+		t.Errorf("part files left behind: %v", left)
+	}
+}
+
+// TestOpenPartFiles checks that resuming cuts part files back to what
+// was recorded as completed, as bytes past that may not have been
+// written whole, and drops those holding nothing completed.
+func TestOpenPartFiles(t *testing.T) {
+	dir := t.TempDir()
+	dl := &download{filename: "file.bin", workingDir: dir, filesize: 300, progressFile: defaultProgressFile}
+	contents := map[uint64][]byte{
+		0:   bytes.Repeat([]byte{'a'}, 100),
+		100: bytes.Repeat([]byte{'b'}, 80),
+		200: bytes.Repeat([]byte{'c'}, 50),
+	}
+	for start, b := range contents {
+		if err := os.WriteFile(dl.partFilePath(start), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first part is complete, the second was recorded up to byte
+	// 149, and the third not at all
+	dl.completed = []byteRange{{Start: 0, End: 149}}
+
+	set, err := dl.openPartFiles(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.close()
+	if len(set.files) != 2 {
+		t.Fatalf("%d part files opened, want 2", len(set.files))
+	}
+	for i, want := range []struct{ start, size uint64 }{{0, 100}, {100, 50}} {
+		pf := set.files[i]
+		info, err := pf.f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pf.start != want.start || pf.size != want.size || uint64(info.Size()) != want.size {
+			t.Errorf("part file %d starts at %d and holds %d bytes, %d on disk; want %d and %d", i, pf.start, pf.size, info.Size(), want.start, want.size)
+		}
+	}
+	if _, err := os.Stat(dl.partFilePath(200)); err == nil {
+		t.Error("the part file with nothing completed was kept")
+	}
+
+	// Writes continue the file they follow on from, or start a new one
+	if _, err := set.WriteAt(bytes.Repeat([]byte{'b'}, 50), 150); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.WriteAt(bytes.Repeat([]byte{'c'}, 100), 200); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.files) != 2 {
+		t.Fatalf("writes went to %d part files, want 2", len(set.files))
+	}
+	if set.files[1].size != 200 {
+		t.Fatalf("second part file holds %d bytes, want 200", set.files[1].size)
+	}
+	if err := set.join(); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(bytes.Repeat([]byte{'a'}, 100), bytes.Repeat([]byte{'b'}, 100)...), bytes.Repeat([]byte{'c'}, 100)...)
+	if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("joined file is %q, %v", got, err)
+	}
+	if left := partFilesLeft(t, dir); len(left) != 0 {
+		t.Errorf("part files left behind: %v", left)
+	}
+}
+
+func TestJoinMissingBytes(t *testing.T) {
+	dir := t.TempDir()
+	dl := &download{filename: "file.bin", workingDir: dir, filesize: 200, progressFile: defaultProgressFile}
+	set, err := dl.openPartFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.WriteAt(make([]byte, 50), 0)
+	set.WriteAt(make([]byte, 100), 100)
+	if err := set.join(); err == nil || !strings.Contains(err.Error(), "missing bytes 50-99") {
+		t.Errorf("join of part files with a gap: %v", err)
+	}
+	set.close()
+	if _, err := os.Stat(filepath.Join(dir, "file.bin")); err == nil {
+		t.Error("output file left after a failed join")
+	}
+	if len(partFilesLeft(t, dir)) != 2 {
+		t.Error("part files removed after a failed join")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errPaused stops a download when its pause window begins.
+var errPaused = errors.New("pause window began")
+
+// pauseWindow is a daily window of local time, from start up to end,
+// during which downloads pause. It may span midnight.
+type pauseWindow struct {
+	start, end time.Duration
+}
+
+// parsePauseWindow parses a window given as HH:MM-HH:MM.
+func parsePauseWindow(s string) (*pauseWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("%q is not of the form HH:MM-HH:MM", s)
+	}
+	var w pauseWindow
+	for _, c := range []struct {
+		s string
+		d *time.Duration
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(c.s))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a time of day as HH:MM", c.s)
+		}
+		*c.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("window %q is empty", s)
+	}
+	return &w, nil
+}
+
+// nextClock returns the next time after now that the clock reads clock.
+func nextClock(now time.Time, clock time.Duration) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Add(clock)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// ends returns when the window containing now ends, or the zero time if
+// now is outside the window.
+func (w *pauseWindow) ends(now time.Time) time.Time {
+	end := nextClock(now, w.end)
+	if nextClock(now, w.start).Before(end) {
+		return time.Time{}
+	}
+	return end
+}
+
+// wait blocks until the window is over, if now is within it.
+func (w *pauseWindow) wait() {
+	end := w.ends(time.Now())
+	if end.IsZero() {
+		return
+	}
+	fmt.Printf("Paused until %s.\n", end.Format("2006-01-02 15:04 MST"))
+	time.Sleep(time.Until(end))
+}
+
+// watchPause cancels the download with errPaused when the pause window
+// begins, unless stop is closed first.
+func (dl *download) watchPause(stop <-chan struct{}, cancel context.CancelCauseFunc) {
+	t := time.NewTimer(time.Until(nextClock(time.Now(), dl.pause.start)))
+	defer t.Stop()
+	select {
+	case <-stop:
+	case <-t.C:
+		cancel(errPaused)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// slowTTFB is the time to first byte from which -coalesce auto
+	// switches to fewer, larger ranges with pipelined requests.
+	slowTTFB = 250 * time.Millisecond
+	// coalescedChunkSize replaces queueChunkSize when coalescing.
+	coalescedChunkSize = 64 << 20
+	// coalescedSplitSize replaces minSplitSize when coalescing.
+	coalescedSplitSize = 16 << 20
+)
+
+// coalesceModes are the valid -coalesce values.
+var coalesceModes = []string{"auto", "on", "off"}
+
+// useCoalescing decides whether to coalesce ranges for dl under the
+// given -coalesce mode, from the time to first byte measured by the
+// metadata request.
+func (dl *download) useCoalescing(mode string) bool {
+	switch mode {
+	case "on":
+		return true
+	case "auto":
+		return dl.ttfb >= slowTTFB
+	}
+	return false
+}
+
+// chunkSize is the size of the chunks handed out by the queue based
+// schedulers.
+func (dl *download) chunkSize() uint64 {
+	if dl.coalesce {
+		return coalescedChunkSize
+	}
+	return queueChunkSize
+}
+
+// minSplit is the smallest remaining range worth splitting off.
+func (dl *download) minSplit() uint64 {
+	if dl.coalesce {
+		return coalescedSplitSize
+	}
+	return minSplitSize
+}
+
+// runWorker fetches parts until the scheduler runs out. When coalescing,
+// the worker requests its next part while the current one is still
+// arriving, so the server's time to first byte overlaps the transfer
+// instead of stalling the connection between parts.
+func (dl *download) runWorker(ctx context.Context, out io.WriterAt) error {
+	dp := dl.nextPart()
+	for dp != nil {
+		var next chan *downloadPart
+		if dl.coalesce {
+			dp.nearEnd = func() {
+				np := dl.nextPart()
+				if np == nil {
+					return
+				}
+				next = make(chan *downloadPart, 1)
+				go func() {
+					offset, end, _ := dl.partRemaining(np)
+					// On failure, the part is simply requested again
+					// when its turn comes
+					if resp, err := dl.openRange(ctx, np, offset, end); err == nil {
+						np.resp = resp
+					}
+					next <- np
+				}()
+			}
+		}
+
+		err := dl.fetchPartRange(ctx, dp, out)
+		if next == nil {
+			if err != nil {
+				return err
+			}
+			dp = dl.nextPart()
+			continue
+		}
+		np := <-next
+		if err != nil {
+			if np.resp != nil {
+				np.resp.Body.Close()
+			}
+			return err
+		}
+		dp = np
+	}
+	return nil
+}
+
+// nearEnd reports whether a part with remaining bytes left, having
+// received got bytes since its request was answered at start, will be
+// done within the time to first byte of a new request.
+func (dl *download) nearEnd(remaining uint64, got int64, start time.Time) bool {
+	elapsed := time.Since(start).Seconds()
+	if got <= 0 || elapsed <= 0 {
+		return false
+	}
+	return float64(remaining) <= float64(got)/elapsed*dl.ttfb.Seconds()
+}
+
+// describeCoalescing explains the choice made for -verbose.
+func (dl *download) describeCoalescing() string {
+	if dl.coalesce {
+		return fmt.Sprintf("Time to first byte %s; using fewer, larger ranges and requesting each part ahead of time.", dl.ttfb.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("Time to first byte %s.", dl.ttfb.Round(time.Millisecond))
+}
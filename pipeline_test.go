@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+// TestPipelinedSplit checks that with -coalesce, a worker nearly done
+// with its part requests its next one, here the split off tail of a slow
+// part, before the current response has ended.
+func TestPipelinedSplit(t *testing.T) {
+	data := dltest.RandomData(48<<20, 10)
+	srv := newPacedServer(data, func(r *http.Request, start int64) (time.Duration, int64) {
+		if start == 0 && r.Method == http.MethodGet {
+			return 2 * slowTTFB, 8 << 20
+		}
+		return 2 * slowTTFB, 0
+	})
+	defer srv.Close()
+
+	dl := newTestDownload(t, srv.URL+"/file.bin", t.TempDir())
+	dl.boost = 2
+	dl.coalesce = dl.useCoalescing("auto")
+	if !dl.coalesce {
+		t.Fatalf("not coalescing with a time to first byte of %v", dl.ttfb)
+	}
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkOutput(t, dl, data)
+	if dl.stats.splits.Load() == 0 {
+		t.Error("the slow part wasn't split")
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.busiest <= dl.boost {
+		t.Errorf("at most %d requests were open at once; the next part wasn't requested ahead", srv.busiest)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errBlocked is returned for requests the URL policy doesn't allow.
+var errBlocked = errors.New("blocked by URL policy")
+
+// cgnatPrefix is the shared address space used by carrier-grade NAT,
+// which netip doesn't count as private.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// httpClient is used for requests that aren't part of a download, such as
+// reading robots.txt or listing a page's links, and by downloads without
+// a client of their own.
+var httpClient = newHTTPClient(clientOptions{maxRedirects: defaultMaxRedirects})
+
+// userAgent is the User-Agent of every request that doesn't set its own,
+// as those with -header do. -tor makes it Tor Browser's, so that no
+// request, not even for robots.txt or a checksum file, gives dl away.
+var userAgent = "dl/1.0"
+
+// userAgentTransport gives requests without a User-Agent dl's, rather
+// than leaving Go to send its own.
+type userAgentTransport struct {
+	next http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// clientOptions configure the HTTP client.
+type clientOptions struct {
+	// policy, if set, restricts what may be fetched.
+	policy *urlPolicy
+	// maxRedirects is how many redirects a request may follow.
+	maxRedirects int
+	// locationTrusted keeps sending credentials after redirects to
+	// another origin.
+	locationTrusted bool
+	// idleConnsPerHost is how many idle connections to each host are kept
+	// open for reuse; zero means 10.
+	idleConnsPerHost int
+	// proxy picks the proxy for each request; nil means the one set in
+	// the environment.
+	proxy func(*http.Request) (*url.URL, error)
+	// connectTimeout limits how long connecting may take; zero means the
+	// default of 30 seconds.
+	connectTimeout time.Duration
+	// responseTimeout limits how long to wait for the response headers
+	// after sending a request; zero means no limit.
+	responseTimeout time.Duration
+	// keyLog, if set, receives the TLS session secrets in NSS key log
+	// format, so captured traffic can be decrypted.
+	keyLog io.Writer
+	// http1 keeps to HTTP/1.1, so each connection carries one request
+	// at a time instead of HTTP/2 multiplexing them over one.
+	http1 bool
+	// conns, if set, tracks the connections the client opens.
+	conns *connTracker
+	// readBuffer, if set, is the socket receive buffer size of each
+	// connection.
+	readBuffer int
+	// multipath, if set, spreads connections over several interfaces.
+	multipath *multipath
+	// mptcp asks for Multipath TCP where the kernel supports it.
+	mptcp bool
+	// resolve maps "host:port" to the address to connect to instead.
+	resolve map[string]string
+	// credentials, if set, supplies the Authorization of requests
+	// without one.
+	credentials credentialSource
+	// signer, if set, signs requests with AWS Signature Version 4.
+	signer *sigV4Signer
+	// robots, if set, paces requests to each host by its crawl delay.
+	robots *robotsChecker
+	// sni, if set, is the TLS server name sent, and the name the
+	// server's certificate must be valid for, in place of the URL's host.
+	sni string
+}
+
+// urlPolicy restricts what dl may fetch, for when URIs come from someone
+// other than the person running dl. The zero value allows everything.
+type urlPolicy struct {
+	// allowSchemes, when non-empty, lists the only schemes allowed.
+	allowSchemes map[string]bool
+	denySchemes  map[string]bool
+	// denyPrivate refuses connections to loopback, private, link-local
+	// and other internal addresses.
+	denyPrivate bool
+}
+
+// parseSchemes turns a comma separated list of schemes into a set.
+func parseSchemes(list string) map[string]bool {
+	schemes := make(map[string]bool)
+	for _, scheme := range strings.Split(list, ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			schemes[scheme] = true
+		}
+	}
+	return schemes
+}
+
+// checkScheme reports whether the policy allows fetching with scheme.
+func (p *urlPolicy) checkScheme(scheme string) error {
+	scheme = strings.ToLower(scheme)
+	if p.denySchemes[scheme] || (len(p.allowSchemes) > 0 && !p.allowSchemes[scheme]) {
+		return fmt.Errorf("%w: scheme %q is not allowed", errBlocked, scheme)
+	}
+	return nil
+}
+
+// proxiedKey marks the context of a request sent through a proxy, whose
+// host policyTransport has checked already.
+type proxiedKey struct{}
+
+// control runs before each connection is made, after the host name has
+// been resolved. Checking the address here rather than the URI means DNS
+// tricks and redirects can't reach an internal address either. The
+// address of a proxy isn't checked, as it is the request's host that
+// counts, and a proxy on the local network is common.
+func (p *urlPolicy) control(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	if !p.denyPrivate || ctx.Value(proxiedKey{}) != nil {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: cannot parse address %q", errBlocked, address)
+	}
+	if addr := addrPort.Addr().Unmap(); isInternalAddr(addr) {
+		return fmt.Errorf("%w: %s is an internal address", errBlocked, addr)
+	}
+	return nil
+}
+
+// checkHost resolves host and refuses it if any of its addresses is
+// internal, for requests sent through a proxy, which connects to the host
+// in dl's place. Onion services are only reached through Tor, never on
+// the local network.
+func (p *urlPolicy) checkHost(ctx context.Context, host string) error {
+	if !p.denyPrivate || isOnion(host) {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%w: cannot resolve %s to check it: %v", errBlocked, host, err)
+	}
+	for _, addr := range addrs {
+		if addr = addr.Unmap(); isInternalAddr(addr) {
+			return fmt.Errorf("%w: %s is an internal address", errBlocked, addr)
+		}
+	}
+	return nil
+}
+
+// isInternalAddr reports whether addr is not on the public internet.
+func isInternalAddr(addr netip.Addr) bool {
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsUnspecified() || addr.IsMulticast() || cgnatPrefix.Contains(addr)
+}
+
+// policyTransport checks the scheme of every request, including those
+// made while following redirects, before handing it on. The host of a
+// request going through a proxy is checked here too, since the
+// connection made is to the proxy.
+type policyTransport struct {
+	policy *urlPolicy
+	proxy  func(*http.Request) (*url.URL, error)
+	next   http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.policy.checkScheme(req.URL.Scheme)
+	if proxyURL, proxyErr := t.proxy(req); err == nil && proxyErr == nil && proxyURL != nil {
+		if err = t.policy.checkHost(req.Context(), req.URL.Hostname()); err == nil {
+			req = req.WithContext(context.WithValue(req.Context(), proxiedKey{}, true))
+		}
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// openKeyLog opens the TLS key log at path for appending, creating it
+// readable only by the user since anyone with it can decrypt the traffic.
+func openKeyLog(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open TLS key log: %w", err)
+	}
+	return f, nil
+}
+
+// do sends req with the download's client.
+func (dl *download) do(req *http.Request) (*http.Response, error) {
+	if dl.client != nil {
+		return dl.client.Do(req)
+	}
+	return httpClient.Do(req)
+}
+
+// newHTTPClient returns a client with its own connection pool, configured
+// by opts. Compression is disabled so that byte counts and ranges refer to
+// the file itself.
+func newHTTPClient(opts clientOptions) *http.Client {
+	policy := opts.policy
+	connectTimeout := opts.connectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = 30 * time.Second
+	}
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if policy != nil {
+		dialer.ControlContext = policy.control
+	}
+	if opts.mptcp {
+		// Connections fall back to plain TCP if either end lacks it
+		dialer.SetMultipathTCP(true)
+	}
+
+	dial := dialer.DialContext
+	if opts.multipath != nil {
+		dial = opts.multipath.dial(dialer)
+	}
+	if len(opts.resolve) > 0 {
+		dial = resolveOverride(dial, opts.resolve)
+	}
+	dial = countReceived(dial)
+	if opts.readBuffer > 0 {
+		dial = withReadBuffer(dial, opts.readBuffer)
+	}
+	if opts.conns != nil {
+		dial = opts.conns.dial(dial)
+	}
+
+	proxy := opts.proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	// Only the per-host limit applies, with no cap on the total, as a
+	// download's client only talks to its server and mirrors
+	idleConns := opts.idleConnsPerHost
+	if idleConns == 0 {
+		idleConns = 10
+	}
+
+	proxy = onionGuard(proxy)
+	t := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   idleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: opts.responseTimeout,
+		DisableCompression:    true,
+		// Share session tickets between connections, so only the first
+		// connection to a server needs a full handshake
+		TLSClientConfig: &tls.Config{
+			ServerName:         opts.sni,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			KeyLogWriter:       opts.keyLog,
+		},
+	}
+	if opts.http1 {
+		// A non-nil, empty map turns off HTTP/2
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	var transport http.RoundTripper = &userAgentTransport{next: t}
+	if opts.signer != nil {
+		transport = &sigV4Transport{signer: opts.signer, next: transport}
+	}
+	if opts.credentials != nil {
+		// A bearer token is for the server it was given for, while a
+		// helper decides for each host
+		_, helper := opts.credentials.(*credentialHelper)
+		transport = &credentialTransport{source: opts.credentials, sameOrigin: !helper && !opts.locationTrusted, next: transport}
+	}
+	if opts.robots != nil {
+		transport = &robotsTransport{robots: opts.robots, next: transport}
+	}
+	if policy != nil {
+		transport = &policyTransport{policy: policy, proxy: proxy, next: transport}
+	}
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect(opts),
+	}
+}
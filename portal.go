@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// exitCaptivePortal is the exit status when the network requires signing
+// in to a captive portal, so scripts can tell it apart from the server
+// failing and try again later.
+const exitCaptivePortal = 4
+
+// defaultPortalCheck answers with an empty 204 response. A captive
+// portal intercepts the request and answers with its sign-in page or a
+// redirect to it instead.
+const defaultPortalCheck = "http://connectivitycheck.gstatic.com/generate_204"
+
+// portalCheckTimeout bounds the request to the check URL.
+const portalCheckTimeout = 10 * time.Second
+
+// behindCaptivePortal reports whether a captive portal intercepts the
+// request to checkURL. It reports false if the request fails, as the
+// network may simply be down.
+func behindCaptivePortal(checkURL string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), portalCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		return false
+	}
+	client := &http.Client{
+		Transport: httpClient.Transport,
+		// A redirect is itself the sign of a portal
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNoContent
+}
+
+// looksIntercepted reports whether the download was redirected to an
+// HTML page where a file was expected, as captive portals do.
+func (dl *download) looksIntercepted() bool {
+	return len(dl.redirects) > 0 && strings.HasPrefix(dl.contentType, "text/html") && !looksLikePage(dl.uri)
+}
+
+// portalSymptom reports whether err is how a download fails behind a
+// captive portal: a certificate that isn't the server's, or plain HTTP
+// where TLS was expected, from the portal answering in its place, or
+// the network not letting requests through at all. Other failures, such
+// as a 404 or a checksum mismatch, come from the server, so there is no
+// call to ask a third party about the network.
+func portalSymptom(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		errors.As(err, &recordErr) || isNetworkError(err)
+}
+
+// exitIfCaptivePortal exits with exitCaptivePortal, explaining why, if
+// checkURL shows that a captive portal intercepts requests. err is why
+// the download failed, and only those failing as portalSymptom describes
+// are checked; nil means it was redirected to a page, as by a portal, and
+// is always checked. An empty checkURL disables the check.
+func exitIfCaptivePortal(checkURL string, err error) {
+	if checkURL == "" || err != nil && !portalSymptom(err) || !behindCaptivePortal(checkURL) {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "The network requires sign-in: a captive portal is intercepting requests. Sign in, such as by opening any web page in a browser, then try again.")
+	os.Exit(exitCaptivePortal)
+}
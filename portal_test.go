@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExitIfCaptivePortal(t *testing.T) {
+	var checks atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name  string
+		err   error
+		check bool
+	}{
+		{"redirected to a page", nil, true},
+		{"unknown certificate authority", fmt.Errorf("cannot fetch: %w", x509.UnknownAuthorityError{}), true},
+		{"certificate for another host", fmt.Errorf("cannot fetch: %w", x509.HostnameError{Host: "example.com", Certificate: &x509.Certificate{}}), true},
+		{"connection failed", fmt.Errorf("cannot fetch: %w", &net.OpError{Op: "dial", Err: errors.New("no route to host")}), true},
+		{"not found", errors.New("non-2xx status (404) for part 0"), false},
+		{"checksum mismatch", fmt.Errorf("%w: got 00, want ff", errChecksumMismatch), false},
+	}
+	for _, tt := range tests {
+		before := checks.Load()
+		exitIfCaptivePortal(srv.URL, tt.err)
+		if checked := checks.Load() > before; checked != tt.check {
+			t.Errorf("%s: checked for a portal: %v, want %v", tt.name, checked, tt.check)
+		}
+	}
+
+	exitIfCaptivePortal("", nil)
+	if checks.Load() != 4 {
+		t.Errorf("checked %d times, want 4", checks.Load())
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// preconnectTimeout bounds how long a download waits for its connections
+// to be set up before it starts anyway.
+const preconnectTimeout = 10 * time.Second
+
+// preconnect sets up a connection for each worker ahead of the transfer,
+// resolving, connecting, and completing TLS handshakes concurrently with
+// cheap HEAD requests. The connections go back to the client's idle pool,
+// so all parts start transferring at once instead of each spending its
+// first moments on setup. Failures are ignored; the part requests will
+// report any real problem.
+func (dl *download) preconnect(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, preconnectTimeout)
+	defer cancel()
+
+	uris := []string{dl.uri}
+	if dl.scheduler == "mirror-striped" {
+		uris = dl.sources()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < dl.boost; i++ {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(dl.traceConns(ctx, nil), "HEAD", uri, nil)
+			if err != nil {
+				return
+			}
+			dl.setHeaders(req)
+			resp, err := dl.do(req)
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+		}(uris[i%len(uris)])
+	}
+	wg.Wait()
+}
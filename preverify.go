@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// preverifyWorkers is how many existing files are hashed at once ahead
+// of the downloads, leaving the disk to the download in flight too.
+const preverifyWorkers = 2
+
+// existingCheck is the verification of a file already on disk against
+// the checksum of the download it would be skipped for.
+type existingCheck struct {
+	path string
+	sum  *checksum
+	// started is set once a worker or the batch takes the check on, and
+	// err, once done is closed, is whether the file matched.
+	started bool
+	done    chan struct{}
+	err     error
+}
+
+// preverifier checks the files a batch would skip with -skip-existing
+// against their checksums in the background, while earlier files
+// download, so a large batch run again spends its time transferring
+// only what is missing or corrupt rather than hashing what is there.
+type preverifier struct {
+	queue chan *existingCheck
+
+	mu     sync.Mutex
+	checks map[string]*existingCheck
+}
+
+func newPreverifier() *preverifier {
+	p := &preverifier{queue: make(chan *existingCheck), checks: make(map[string]*existingCheck)}
+	for range preverifyWorkers {
+		go func() {
+			for c := range p.queue {
+				if p.take(c) {
+					// Hashed without a progress bar, as the download
+					// in flight has the terminal
+					c.run("")
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// add queues the file at path to be checked against sum, unless it is
+// queued already, waiting for a worker to be free.
+func (p *preverifier) add(path string, sum *checksum) {
+	p.mu.Lock()
+	if _, ok := p.checks[path]; ok {
+		p.mu.Unlock()
+		return
+	}
+	c := &existingCheck{path: path, sum: sum, done: make(chan struct{})}
+	p.checks[path] = c
+	p.mu.Unlock()
+	p.queue <- c
+}
+
+// take reports whether the caller gets to run c, as no one has yet.
+func (p *preverifier) take(c *existingCheck) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c.started {
+		return false
+	}
+	c.started = true
+	return true
+}
+
+// check returns whether the file at path matches sum, from its check in
+// the background if there is one, waiting for it if it is under way. A
+// file the background hasn't got to is checked now, showing progress.
+func (p *preverifier) check(path string, sum *checksum) error {
+	p.mu.Lock()
+	c, ok := p.checks[path]
+	p.mu.Unlock()
+	if !ok || c.sum != sum {
+		return sum.verify(path)
+	}
+	if p.take(c) {
+		c.run("Verifying checksum")
+	}
+	<-c.done
+	return c.err
+}
+
+func (c *existingCheck) run(description string) {
+	c.err = c.sum.verifyQuietly(c.path, description)
+	close(c.done)
+}
+
+// lookAhead queues the existing files of the batch's items for checking
+// as their metadata arrives, naming them as the batch will. Files whose
+// size isn't the remote file's, or that have progress saved, are left
+// out, as they won't be skipped whatever their contents.
+func (p *preverifier) lookAhead(items []*prefetched, sources []source, naming namingOptions, sumFor func(i int, name string) *checksum) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return
+	}
+	for i, item := range items {
+		<-item.done
+		if item.err != nil {
+			continue
+		}
+		name := naming.name(sources[i], item.info.filename, item.info.contentType)
+		sum := sumFor(i, name)
+		if name == "" || sum == nil {
+			continue
+		}
+		probe := &download{filename: name, workingDir: wd, progressFile: item.dl.progressFile}
+		if probe.existingSize() != item.info.size {
+			continue
+		}
+		p.add(probe.outputPath(), sum)
+	}
+}
+
+// existingSize returns the size of the complete file at dl's output path,
+// or 0 if there is none: no file, or one with progress saved, which is
+// still partial.
+func (dl *download) existingSize() uint64 {
+	info, err := os.Stat(dl.outputPath())
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	if _, err := os.Stat(dl.progressPath()); !errors.Is(err, fs.ErrNotExist) {
+		return 0
+	}
+	return uint64(info.Size())
+}
+
+// alreadyComplete reports whether the file at dl's output path is a
+// complete copy of the remote file, so -skip-existing can skip it: it is
+// the same size and, given a checksum, matches it. A file that doesn't
+// match is removed, to be downloaded again from scratch.
+func (dl *download) alreadyComplete(pre *preverifier) bool {
+	if dl.filesize == 0 || dl.existingSize() != dl.filesize {
+		return false
+	}
+	if dl.checksum == nil {
+		return true
+	}
+	if err := pre.check(dl.outputPath(), dl.checksum); err != nil {
+		fmt.Fprintf(os.Stderr, "The existing %s doesn't match: %v. Downloading it again.\n", dl.filename, err)
+		_ = os.Remove(dl.outputPath())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// profile is a named set of flag values from the config file, such as
+// the limits for a metered connection or the proxy needed at work.
+type profile struct {
+	name string
+	// values are the flags the profile sets, as name and value, in the
+	// order given, so repeatable flags keep their order.
+	values [][2]string
+	// ssids and hostnames are globs that select the profile when no
+	// -profile is given, matched against the Wi-Fi network and the
+	// machine's hostname.
+	ssids     []string
+	hostnames []string
+}
+
+// configPath returns where the config file is: $DL_CONFIG, or dl/config
+// in the user's config directory.
+func configPath() string {
+	if p := os.Getenv("DL_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dl", "config")
+}
+
+// readProfiles reads the profiles in the config file at path. A missing
+// file has none.
+func readProfiles(path string) ([]profile, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open config file: %w", err)
+	}
+	defer f.Close()
+	profiles, err := parseProfiles(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return profiles, nil
+}
+
+// parseProfiles parses profiles such as:
+//
+//	[profile metered]
+//	when-ssid = Phone*
+//	limit = 500K
+//	boost = 2
+//
+// Keys are flag names, without the dash; a key on its own sets a boolean
+// flag. Blank lines and lines starting with # are ignored.
+func parseProfiles(r io.Reader) ([]profile, error) {
+	var profiles []profile
+	var cur *profile
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if header, ok := strings.CutPrefix(line, "["); ok {
+			header, ok = strings.CutSuffix(header, "]")
+			name, isProfile := strings.CutPrefix(strings.TrimSpace(header), "profile ")
+			name = strings.TrimSpace(name)
+			if !ok || !isProfile || name == "" {
+				return nil, fmt.Errorf("line %d: expected [profile name]", n)
+			}
+			profiles = append(profiles, profile{name: name})
+			cur = &profiles[len(profiles)-1]
+			continue
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: setting outside of a [profile]", n)
+		}
+		key, value, hasValue := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !hasValue {
+			value = "true"
+		}
+		switch key {
+		case "when-ssid", "when-hostname":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("line %d: invalid pattern %q: %w", n, value, err)
+			}
+			if key == "when-ssid" {
+				cur.ssids = append(cur.ssids, value)
+			} else {
+				cur.hostnames = append(cur.hostnames, value)
+			}
+		case "profile":
+			return nil, fmt.Errorf("line %d: a profile can't select another", n)
+		default:
+			cur.values = append(cur.values, [2]string{key, value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// matches reports whether any of patterns matches s.
+func matches(patterns []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectProfile returns the profile named name or, if name is empty, the
+// first whose rules match the current Wi-Fi network or hostname, along
+// with why it was chosen. It returns nil if none applies.
+func selectProfile(profiles []profile, name string) (*profile, string, error) {
+	if name == "none" {
+		return nil, "", nil
+	}
+	if name != "" {
+		for i := range profiles {
+			if profiles[i].name == name {
+				return &profiles[i], "", nil
+			}
+		}
+		return nil, "", fmt.Errorf("no profile %q in %s", name, configPath())
+	}
+
+	var ssid, hostname string
+	var looked bool
+	for i := range profiles {
+		p := &profiles[i]
+		if len(p.ssids) == 0 && len(p.hostnames) == 0 {
+			continue
+		}
+		if !looked {
+			// Only run the tools that find the network if needed
+			ssid = currentSSID()
+			hostname, _ = os.Hostname()
+			looked = true
+		}
+		if matches(p.ssids, ssid) {
+			return p, "Wi-Fi network " + ssid, nil
+		}
+		if matches(p.hostnames, hostname) {
+			return p, "hostname " + hostname, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// apply sets the profile's flags in fs, except those given on the
+// command line, which take precedence.
+func (p *profile) apply(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, kv := range p.values {
+		name, value := kv[0], kv[1]
+		if given[name] {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("profile %s: unknown flag -%s", p.name, name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("profile %s: invalid value %q for -%s: %w", p.name, value, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+const (
+	// speedInterval is how often transfer speeds are sampled.
+	speedInterval = 500 * time.Millisecond
+	// speedSmoothing is the weight given to the newest sample when
+	// smoothing speeds. Lower is steadier but slower to react.
+	speedSmoothing = 0.3
+	// stallTimeout is how long a part may go without receiving data
+	// before it counts as stalled.
+	stallTimeout = 5 * time.Second
+	// messageDuration is how long a message stays in the progress bar.
+	messageDuration = 10 * time.Second
+	// messageWidth is how much of a message the progress bar shows.
+	messageWidth = 60
+)
+
+// stderrANSI reports whether the progress bar may use ANSI escape
+// sequences to clear its line. Otherwise it overwrites the line with
+// spaces, which wraps onto the next line if the window was narrowed.
+var stderrANSI = sync.OnceValue(func() bool { return enableANSI(os.Stderr) })
+
+// asciiTheme draws the progress bar in ASCII, for Windows consoles too old
+// to understand ANSI escape sequences, whose fonts often lack the block
+// characters of the default theme.
+var asciiTheme = progressbar.Theme{Saucer: "=", SaucerHead: ">", SaucerPadding: " ", BarStart: "|", BarEnd: "|"}
+
+// progressOutput is how progress is shown, as set on the command line.
+var progressOutput = progressSettings{style: "bar"}
+
+// progressSettings select how progress is shown: as a bar redrawn in
+// place for terminals, as plain lines for logs and cron mail, or not at
+// all.
+type progressSettings struct {
+	style string // "bar", "lines", or "none"
+	// every is how often a line is printed, unless percent is set, to
+	// print one whenever the download gets that much further instead.
+	every   time.Duration
+	percent float64
+	// verbose prints messages in full above the bar, which otherwise
+	// only shows them in short for a while.
+	verbose bool
+}
+
+// parseProgressEvery parses how often to print lines of progress, as a
+// duration such as "30s" or a percentage such as "10%".
+func parseProgressEvery(s string) (progressSettings, error) {
+	settings := progressSettings{style: "lines"}
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err := strconv.ParseFloat(p, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return settings, fmt.Errorf("invalid percentage %q", s)
+		}
+		settings.percent = percent
+		return settings, nil
+	}
+	every, err := time.ParseDuration(s)
+	if err != nil || every <= 0 {
+		return settings, fmt.Errorf("invalid interval %q: use a duration such as 30s or a percentage such as 10%%", s)
+	}
+	settings.every = every
+	return settings, nil
+}
+
+// errTooSlow aborts a download whose speed stays below -speed-limit.
+var errTooSlow = errors.New("transfer too slow")
+
+// progressReporter receives the progress of a single download.
+type progressReporter interface {
+	// Add reports n more bytes written to the output file.
+	Add(n int64)
+	// Speed reports the latest smoothed transfer speeds.
+	Speed(s speedSample)
+	// Message reports a problem the download is recovering from, such
+	// as a retry, without breaking the progress display.
+	Message(msg string)
+}
+
+// speedSample is a snapshot of smoothed transfer speeds, in bytes per second.
+type speedSample struct {
+	total   float64
+	parts   map[int]float64
+	stalled int
+	// eta is the estimated time left, or negative when unknown.
+	eta time.Duration
+}
+
+// barReporter renders progress as a terminal progress bar, showing the
+// byte counts, smoothed speed, and ETA in the bar's description. The
+// bar's own byte display is off, since it labels powers of 1024 with SI
+// units.
+type barReporter struct {
+	// mu serializes bar updates, since Describe isn't safe to call
+	// while the bar renders.
+	mu      sync.Mutex
+	bar     *progressbar.ProgressBar
+	total   int64
+	current atomic.Int64
+	// batch, if set, places the download in a batch whose progress is
+	// shown after the download's own.
+	batch *batchPosition
+	// message is shown in the bar until messageUntil.
+	message      string
+	messageUntil time.Time
+}
+
+// newReporter returns the reporter of dl's progress, in the style of
+// progressOutput, passing it on to the session's reporters too.
+func (dl *download) newReporter() progressReporter {
+	var r progressReporter
+	switch progressOutput.style {
+	case "none":
+		r = nopReporter{}
+	case "lines":
+		r = &lineReporter{name: dl.filename, total: int64(dl.filesize), batch: dl.batch, settings: progressOutput, speed: speedSample{eta: -1}, last: time.Now()}
+	default:
+		r = newBarReporter(int64(dl.filesize), dl.batch)
+	}
+	if dl.session != nil {
+		r = &sessionProgress{progressReporter: r, session: dl.session, id: dl.id, total: int64(dl.filesize)}
+	}
+	return r
+}
+
+func newBarReporter(total int64, batch *batchPosition) *barReporter {
+	max := total
+	if max == 0 {
+		// Of unknown size, shown as a spinner
+		max = -1
+	}
+	bar := progressbar.NewOptions64(max, barOptions("Downloading")...)
+	return &barReporter{bar: bar, total: total, batch: batch}
+}
+
+// barOptions returns the options of dl's progress bars, starting out
+// with description.
+func barOptions(description string) []progressbar.Option {
+	opts := []progressbar.Option{
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65 * time.Millisecond),
+		progressbar.OptionOnCompletion(func() { fmt.Fprint(os.Stderr, "\n") }),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetPredictTime(false),
+		progressbar.OptionUseANSICodes(stderrANSI()),
+		progressbar.OptionSetVisibility(progressOutput.style == "bar"),
+	}
+	if runtime.GOOS == "windows" && !stderrANSI() {
+		opts = append(opts, progressbar.OptionSetTheme(asciiTheme))
+	}
+	return opts
+}
+
+func (r *barReporter) Add(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Show the final count, since the last speed update came before it
+	if r.current.Add(n) == r.total {
+		r.bar.Describe(fmt.Sprintf("Downloaded %s", formatBytes(float64(r.total))))
+	}
+	r.bar.Add64(n)
+}
+
+func (r *barReporter) Speed(s speedSample) {
+	size := formatBytes(float64(r.current.Load()))
+	if r.total > 0 {
+		size += "/" + formatBytes(float64(r.total))
+	}
+	desc := fmt.Sprintf("Downloading %s, %s/s, ETA %s", size, formatBytes(s.total), formatETA(s.eta))
+	if s.stalled > 0 {
+		desc += fmt.Sprintf(" (%d stalled)", s.stalled)
+	}
+	if r.batch != nil {
+		desc += " | " + r.batch.describe(r.current.Load(), s.total)
+	}
+	r.mu.Lock()
+	if time.Now().Before(r.messageUntil) {
+		desc += " | " + r.message
+	}
+	r.bar.Describe(desc)
+	r.mu.Unlock()
+}
+
+func (r *barReporter) Message(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.message, _, _ = strings.Cut(msg, "\n")
+	if runes := []rune(r.message); len(runes) > messageWidth {
+		r.message = string(runes[:messageWidth-1]) + "…"
+	}
+	r.messageUntil = time.Now().Add(messageDuration)
+	if progressOutput.verbose {
+		r.bar.Clear()
+		fmt.Fprintln(os.Stderr, msg)
+		r.bar.RenderBlank()
+	}
+}
+
+// lineReporter prints progress as a line at a time, for logs and cron
+// mail, where a bar redrawn with carriage returns piles up.
+type lineReporter struct {
+	name     string
+	total    int64
+	batch    *batchPosition
+	settings progressSettings
+
+	mu      sync.Mutex
+	current int64
+	speed   speedSample
+	// last is when the last line was printed, and step the percentage
+	// steps reached by then.
+	last time.Time
+	step int
+}
+
+func (r *lineReporter) Add(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current += n
+	switch {
+	case r.total > 0 && r.current >= r.total:
+		r.print()
+	case r.settings.percent > 0 && r.total > 0:
+		if step := int(float64(r.current) * 100 / float64(r.total) / r.settings.percent); step > r.step {
+			r.step = step
+			r.print()
+		}
+	}
+}
+
+func (r *lineReporter) Speed(s speedSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.speed = s
+	// Print on a timer even while nothing arrives, so a stalled
+	// download still shows up in the log
+	if r.settings.percent == 0 && time.Since(r.last) >= r.settings.every {
+		r.print()
+	}
+}
+
+func (r *lineReporter) Message(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "%s: %s\n", r.name, msg)
+}
+
+// print writes a line of progress. r.mu must be held.
+func (r *lineReporter) print() {
+	r.last = time.Now()
+	line := r.name + ": "
+	if r.total > 0 {
+		line += fmt.Sprintf("%3.0f%% %s/%s", float64(r.current)*100/float64(r.total), formatBytes(float64(r.current)), formatBytes(float64(r.total)))
+	} else {
+		line += formatBytes(float64(r.current))
+	}
+	if r.current < r.total || r.total == 0 {
+		line += fmt.Sprintf(", %s/s, ETA %s", formatBytes(r.speed.total), formatETA(r.speed.eta))
+	}
+	if r.batch != nil {
+		line += " | " + r.batch.describe(r.current, r.speed.total)
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// nopReporter shows no progress at all.
+type nopReporter struct{}
+
+func (nopReporter) Add(int64)         {}
+func (nopReporter) Speed(speedSample) {}
+
+// Message prints msg all the same, as there is no progress for it to
+// break.
+func (nopReporter) Message(msg string) { fmt.Fprintln(os.Stderr, msg) }
+
+// progressCounter is an io.Writer that reports everything written to it
+// as download progress.
+type progressCounter struct {
+	dl *download
+}
+
+func (pc progressCounter) Write(b []byte) (int, error) {
+	pc.dl.addProgress(int64(len(b)))
+	return len(b), nil
+}
+
+// warn reports a problem the download is recovering from through its
+// progress reporter.
+func (dl *download) warn(format string, args ...any) {
+	dl.progress.Message(fmt.Sprintf(format, args...))
+}
+
+// addProgress records n more bytes written to the output file.
+func (dl *download) addProgress(n int64) {
+	dl.written.Add(n)
+	dl.progress.Add(n)
+}
+
+// speedMeter keeps exponentially smoothed transfer speeds for a download
+// and each of its parts.
+type speedMeter struct {
+	last      time.Time
+	lastTotal int64
+	total     float64
+
+	lastParts map[*downloadPart]uint64
+	parts     map[*downloadPart]float64
+	// active is when each part last received data.
+	active map[*downloadPart]time.Time
+}
+
+// newSpeedMeter starts measuring at now, from written bytes already on disk.
+func newSpeedMeter(now time.Time, written int64) *speedMeter {
+	return &speedMeter{
+		last:      now,
+		lastTotal: written,
+		lastParts: make(map[*downloadPart]uint64),
+		parts:     make(map[*downloadPart]float64),
+		active:    make(map[*downloadPart]time.Time),
+	}
+}
+
+// sample measures the transfer since the previous sample and folds it
+// into the smoothed speeds.
+func (m *speedMeter) sample(dl *download, now time.Time) speedSample {
+	elapsed := now.Sub(m.last).Seconds()
+	if elapsed <= 0 {
+		elapsed = speedInterval.Seconds()
+	}
+	m.last = now
+
+	// What was written goes down when a download starts over, which
+	// isn't a transfer, so the sample is skipped
+	written := dl.written.Load()
+	if written >= m.lastTotal {
+		m.total = smooth(m.total, float64(written-m.lastTotal)/elapsed)
+	}
+	m.lastTotal = written
+
+	s := speedSample{
+		total: m.total,
+		parts: make(map[int]float64),
+		eta:   -1,
+	}
+
+	dl.mu.Lock()
+	for _, p := range dl.parts {
+		if p.offset > p.endByte {
+			continue
+		}
+		done := p.offset - p.startByte
+		last, seen := m.lastParts[p]
+		m.lastParts[p] = done
+		if !seen || done > last {
+			m.active[p] = now
+		}
+		// A part's offset goes back when a range is fetched again, as
+		// after -verify-writes finds it corrupt; the unsigned difference
+		// would wrap around, so that sample is skipped
+		if done >= last {
+			m.parts[p] = smooth(m.parts[p], float64(done-last)/elapsed)
+		}
+		s.parts[p.index] = m.parts[p]
+		if now.Sub(m.active[p]) >= stallTimeout {
+			s.stalled++
+		}
+	}
+	remaining := int64(dl.filesize) - written
+	dl.mu.Unlock()
+
+	// Stalled parts don't contribute to the total speed, so the total
+	// already reflects how fast the rest of the file is arriving, though
+	// never faster than -limit lets it once a burst is spent. Until
+	// anything is moving, the ETA is unknown.
+	speed := m.total
+	if dl.limiter != nil {
+		speed = min(speed, dl.limiter.rate)
+	}
+	if speed > 0 && remaining >= 0 {
+		s.eta = time.Duration(float64(remaining) / speed * float64(time.Second))
+	}
+	return s
+}
+
+// watchSpeed samples speeds for dl and reports them until stop is closed.
+// If a speed limit is set and the speed stays below it for the speed
+// time, the download is canceled with errTooSlow.
+func (dl *download) watchSpeed(stop <-chan struct{}, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(speedInterval)
+	defer ticker.Stop()
+
+	meter := newSpeedMeter(time.Now(), dl.written.Load())
+	lastFast := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s := meter.sample(dl, now)
+			dl.progress.Speed(s)
+
+			if dl.speedLimit <= 0 || s.total >= float64(dl.speedLimit) {
+				lastFast = now
+			} else if now.Sub(lastFast) >= dl.speedTime {
+				cancel(fmt.Errorf("%w: below %s/s for %s", errTooSlow, formatBytes(float64(dl.speedLimit)), dl.speedTime))
+				return
+			}
+		}
+	}
+}
+
+// smooth folds sample into an exponentially weighted moving average. The
+// first sample seeds the average, so early estimates aren't skewed low.
+func smooth(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return speedSmoothing*sample + (1-speedSmoothing)*avg
+}
+
+// formatBytes formats a byte count in displayUnits.
+func formatBytes(n float64) string {
+	base := displayUnits.base()
+	if n < base {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := base, 0
+	for v := n / base; v >= base && exp < len(unitPrefixes)-1; v /= base {
+		div *= base
+		exp++
+	}
+	if displayUnits == siUnits {
+		return fmt.Sprintf("%.1f %cB", n/div, "kMGTPE"[exp])
+	}
+	return fmt.Sprintf("%.1f %ciB", n/div, unitPrefixes[exp])
+}
+
+// formatETA formats an estimated duration, or "unknown" if negative.
+func formatETA(d time.Duration) string {
+	if d < 0 {
+		return "unknown"
+	}
+	return d.Round(time.Second).String()
+}
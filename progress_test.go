@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpeedMeterRewind(t *testing.T) {
+	p := &downloadPart{startByte: 0, endByte: 999_999, offset: 0}
+	dl := &download{filesize: 1_000_000, parts: []*downloadPart{p}}
+	start := time.Now()
+	m := newSpeedMeter(start, 0)
+
+	p.offset = 500_000
+	dl.written.Store(500_000)
+	s := m.sample(dl, start.Add(time.Second))
+	if s.parts[0] != 500_000 || s.total != 500_000 {
+		t.Fatalf("speeds are %v total and %v for the part, want 500000", s.total, s.parts[0])
+	}
+
+	// -verify-writes found the range corrupt and fetches it again
+	p.offset = 100_000
+	s = m.sample(dl, start.Add(2*time.Second))
+	if s.parts[0] != 500_000 {
+		t.Errorf("part speed after rewinding is %v, want it unchanged at 500000", s.parts[0])
+	}
+
+	p.offset = 300_000
+	s = m.sample(dl, start.Add(3*time.Second))
+	if want := smooth(500_000, 200_000); s.parts[0] != want {
+		t.Errorf("part speed after resuming is %v, want %v", s.parts[0], want)
+	}
+}
+
+func TestSpeedMeterRestart(t *testing.T) {
+	dl := &download{filesize: 1_000_000}
+	start := time.Now()
+	m := newSpeedMeter(start, 0)
+	dl.written.Store(400_000)
+	m.sample(dl, start.Add(time.Second))
+
+	// The download starts over after failing verification
+	dl.written.Store(0)
+	s := m.sample(dl, start.Add(2*time.Second))
+	if s.total != 400_000 {
+		t.Errorf("total speed after restarting is %v, want it unchanged at 400000", s.total)
+	}
+}
+
+func TestSpeedMeterLimitedETA(t *testing.T) {
+	dl := &download{filesize: 3_000_000, limiter: newRateLimiter(100_000, 0, 0, "bucket")}
+	start := time.Now()
+	m := newSpeedMeter(start, 0)
+
+	// A burst well above the limit
+	dl.written.Store(1_000_000)
+	s := m.sample(dl, start.Add(time.Second))
+	if want := 20 * time.Second; s.eta != want {
+		t.Errorf("ETA is %v, want %v at the limit", s.eta, want)
+	}
+}
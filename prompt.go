@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// isTerminal reports whether f is a terminal, so there is someone to ask.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks a yes or no question and reports whether the answer was
+// yes, the default. Without anyone to answer, because standard input
+// isn't a terminal or is closed, the answer is yes.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [Y/n] ", question)
+	var answer string
+	if isTerminal(os.Stdin) {
+		answer, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+	}
+	if answer == "" {
+		fmt.Fprintln(os.Stderr, "y")
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "", "y", "yes":
+		return true
+	}
+	return false
+}
+
+// confirmNo is confirm for questions whose default answer is no, such as
+// whether to delete files. Without anyone to answer, the answer is no.
+func confirmNo(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	var answer string
+	if isTerminal(os.Stdin) {
+		answer, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+	}
+	if answer == "" {
+		fmt.Fprintln(os.Stderr, "n")
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// errOnionDirect refuses to connect to an onion service without a proxy,
+// which would fail anyway after leaking the address to the DNS resolver.
+var errOnionDirect = errors.New(".onion addresses can only be reached through Tor; use -tor or a socks5h:// proxy")
+
+// proxyRule sends requests to hosts matching pattern through proxy, or
+// directly when proxy is nil.
+type proxyRule struct {
+	pattern string
+	proxy   *url.URL
+}
+
+// parseProxyURL parses a proxy URI, accepting the schemes net/http can
+// speak to: http, https, socks5, and socks5h.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", s, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme in %q (valid: http, https, socks5, socks5h)", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", s)
+	}
+	return u, nil
+}
+
+// parseProxyRule parses a rule of the form "pattern=proxy", where pattern
+// is a glob matched against the host name and proxy is a proxy URI or
+// DIRECT.
+func parseProxyRule(s string) (proxyRule, error) {
+	pattern, target, ok := strings.Cut(s, "=")
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	target = strings.TrimSpace(target)
+	if !ok || pattern == "" || target == "" {
+		return proxyRule{}, fmt.Errorf("invalid proxy rule %q, expected host-pattern=proxy", s)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return proxyRule{}, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+	}
+	if strings.EqualFold(target, "DIRECT") {
+		return proxyRule{pattern: pattern}, nil
+	}
+	proxy, err := parseProxyURL(target)
+	if err != nil {
+		return proxyRule{}, err
+	}
+	return proxyRule{pattern: pattern, proxy: proxy}, nil
+}
+
+// proxyFunc returns the proxy selection for the HTTP transport: the first
+// rule matching the request's host wins, then the default proxy if one is
+// set, then the usual environment variables.
+func proxyFunc(defaultProxy *url.URL, rules []proxyRule) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		for _, r := range rules {
+			if ok, _ := path.Match(r.pattern, host); ok {
+				return r.proxy, nil
+			}
+		}
+		if defaultProxy != nil {
+			return defaultProxy, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+}
+
+// isOnion reports whether host is a Tor onion service address.
+func isOnion(host string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(host), "."), ".onion")
+}
+
+// onionGuard wraps a proxy selection so onion service addresses are
+// never resolved or dialed directly. Through a proxy, the proxy resolves
+// them; net/http treats socks5 like socks5h and leaves names to it.
+func onionGuard(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err == nil && u == nil && isOnion(req.URL.Hostname()) {
+			return nil, errOnionDirect
+		}
+		return u, err
+	}
+}
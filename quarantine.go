@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// partialDir is the directory, next to the output file, that
+	// -quarantine moves failed downloads into.
+	partialDir = ".dl-partial"
+	// quarantineStamp is the format of the time a failed download is
+	// moved at, which its directory in partialDir is named after.
+	quarantineStamp = "20060102-150405"
+)
+
+// quarantine moves the partial file of a failed download, with its
+// progress and any part files, into a directory of its own in partialDir,
+// so the download directory only holds finished files. It returns the
+// directory they were moved to, or an empty string if there was nothing
+// to move. A later run restores them to resume the download.
+func (dl *download) quarantine() (string, error) {
+	if _, err := os.Stat(dl.progressPath()); err != nil {
+		// Nothing resumable was kept
+		return "", nil
+	}
+	paths := []string{dl.progressPath(), dl.outputPath()}
+	starts, _ := dl.existingPartFiles()
+	for _, start := range starts {
+		paths = append(paths, dl.partFilePath(start))
+	}
+
+	dir, name := filepath.Split(dl.outputPath())
+	dest := filepath.Join(dir, partialDir, time.Now().Format(quarantineStamp)+"-"+name)
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		err := os.Rename(path, filepath.Join(dest, filepath.Base(path)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return dest, nil
+}
+
+// restoreQuarantined moves the newest quarantined partial download of
+// dl's file, if any, back next to the output file so it can be resumed.
+// It reports whether it did. Nothing is restored over an existing file.
+func (dl *download) restoreQuarantined() bool {
+	if _, err := os.Lstat(dl.outputPath()); err == nil {
+		return false
+	}
+	dir, name := filepath.Split(dl.outputPath())
+	entries, err := os.ReadDir(filepath.Join(dir, partialDir))
+	if err != nil {
+		return false
+	}
+	var candidates []string
+	for _, e := range entries {
+		if e.IsDir() && len(e.Name()) == len(quarantineStamp)+1+len(name) && strings.HasSuffix(e.Name(), "-"+name) {
+			candidates = append(candidates, e.Name())
+		}
+	}
+	// Newest first, as the names start with the time
+	sort.Sort(sort.Reverse(sort.StringSlice(candidates)))
+	for _, c := range candidates {
+		src := filepath.Join(dir, partialDir, c)
+		data, err := os.ReadFile(filepath.Join(src, filepath.Base(dl.progressPath())))
+		if err != nil {
+			continue
+		}
+		var state progressState
+		if json.Unmarshal(data, &state) != nil || state.URI != dl.uri {
+			continue
+		}
+		files, err := os.ReadDir(src)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			dest := filepath.Join(dir, f.Name())
+			if f.Name() == filepath.Base(dl.progressPath()) {
+				// It may be kept elsewhere, with -progress-file
+				dest = dl.progressPath()
+			}
+			if err := os.Rename(filepath.Join(src, f.Name()), dest); err != nil {
+				fmt.Fprintf(os.Stderr, "Error restoring the partial download from %s: %v\n", src, err)
+				return false
+			}
+		}
+		_ = os.Remove(src)
+		// Only removed once empty
+		_ = os.Remove(filepath.Join(dir, partialDir))
+		fmt.Println("Restored the partial download from", src)
+		return true
+	}
+	return false
+}
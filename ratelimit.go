@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// limitChunk is the most a limited reader reads at once by default, so
+// waits stay short and the rate smooth.
+const limitChunk = 16 << 10
+
+// limitModes are the valid values of -limit-mode.
+var limitModes = []string{"bucket", "pace"}
+
+// rateLimiter is a token bucket shared by every connection, capping
+// their combined rate.
+type rateLimiter struct {
+	rate float64
+	// burst is how many bytes the bucket holds, and so how far ahead of
+	// the rate a transfer may get after going idle.
+	burst float64
+	// chunk is the most a limited reader reads at once.
+	chunk int64
+	// pace waits for the tokens before reading rather than after, so
+	// data is left in the socket for TCP's flow control to hold back.
+	pace bool
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for the given rate in the given mode.
+// A chunk of 0 is limitChunk. A burst of 0 holds a second's worth of
+// bytes, or a single chunk when pacing.
+func newRateLimiter(bytesPerSecond, burst, chunk int64, mode string) *rateLimiter {
+	if chunk == 0 {
+		chunk = limitChunk
+	}
+	pace := mode == "pace"
+	switch {
+	case burst > 0:
+	case pace:
+		burst = chunk
+	default:
+		burst = bytesPerSecond
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), burst: float64(burst), chunk: chunk, pace: pace, last: time.Now()}
+}
+
+// readBuffer is the socket receive buffer for connections when pacing:
+// a tenth of a second's worth of bytes, or 64 KiB if that is more. With
+// the operating system's much larger default, the sender could get
+// seconds ahead before flow control held it back, arriving in bursts.
+func (l *rateLimiter) readBuffer() int {
+	return int(max(l.rate/10, 64<<10))
+}
+
+// refund returns n bytes taken by wait but not transferred.
+func (l *rateLimiter) refund(n int) {
+	l.mu.Lock()
+	l.tokens = min(l.tokens+float64(n), l.burst)
+	l.mu.Unlock()
+}
+
+// wait blocks until n bytes may be transferred or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	// Take the tokens right away, going into debt if need be, so
+	// concurrent readers queue up behind each other
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// limitedReader reads from r no faster than lim allows.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > lr.lim.chunk {
+		p = p[:lr.lim.chunk]
+	}
+	if lr.lim.pace {
+		// Read only once the bytes may be transferred, giving back
+		// what the read falls short by
+		if err := lr.lim.wait(lr.ctx, len(p)); err != nil {
+			return 0, err
+		}
+		n, err := lr.r.Read(p)
+		lr.lim.refund(len(p) - n)
+		return n, err
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.lim.wait(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// limitReader applies the download's bandwidth limit, if any, to r.
+func (dl *download) limitReader(ctx context.Context, r io.Reader) io.Reader {
+	if dl.limiter == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, lim: dl.limiter}
+}
+
+// withReadBuffer wraps dial so TCP connections it opens get a receive
+// buffer of size bytes.
+func withReadBuffer(dial func(ctx context.Context, network, addr string) (net.Conn, error), size int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tc := tcpConn(conn); tc != nil {
+			_ = tc.SetReadBuffer(size)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// defaultMaxRedirects matches the limit of Go's default client.
+const defaultMaxRedirects = 10
+
+// credentialHeaders are dropped when a redirect leaves the origin of the
+// original request, as curl does, unless -location-trusted is given.
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+type redirectLogKey struct{}
+
+// redirectLog records the redirects followed by requests that carry it
+// in their context.
+type redirectLog struct {
+	mu   sync.Mutex
+	hops []string
+}
+
+func (l *redirectLog) add(to *url.URL) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hops = append(l.hops, to.String())
+}
+
+// chain returns the URIs redirected to, in order.
+func (l *redirectLog) chain() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.hops...)
+}
+
+// checkRedirect returns a CheckRedirect function enforcing the redirect
+// limit and credential policy of opts.
+func checkRedirect(opts clientOptions) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= opts.maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", opts.maxRedirects)
+		}
+		if log, ok := req.Context().Value(redirectLogKey{}).(*redirectLog); ok {
+			log.add(req.URL)
+		}
+
+		// Go already drops credentials when leaving the original domain,
+		// but keeps them for subdomains and other ports or schemes. Be
+		// strict unless told to trust the redirect, then send them as-is.
+		orig := via[0]
+		for _, name := range credentialHeaders {
+			switch {
+			case opts.locationTrusted:
+				if values, ok := orig.Header[name]; ok {
+					req.Header[name] = values
+				}
+			case !sameOrigin(orig.URL, req.URL):
+				req.Header.Del(name)
+			}
+		}
+		return nil
+	}
+}
+
+// sameOrigin reports whether a and b share scheme, host, and port.
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
+
+// parseHeader parses a "Name: value" header as given to -header.
+func parseHeader(s string) (name, value string, err error) {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("header %q must be in the form \"Name: value\"", s)
+	}
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(value), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reflinkSupported reports whether reflink can clone files on this platform.
+const reflinkSupported = false
+
+// reflink is only supported on Linux; elsewhere files are copied.
+func reflink(dst, src *os.File) error {
+	return errors.New("reflink not supported")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// findFile looks in dir for the file with the given device and inode
+// numbers and returns its path, or "" if there is none.
+func findFile(dir string, dev, ino uint64) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if d, i, ok := fileID(info); ok && d == dev && i == ino {
+			return filepath.Join(dir, e.Name())
+		}
+	}
+	return ""
+}
+
+// relinkPartial looks for the partial file state was saved for, which
+// is no longer at the output path, under another name, and offers to
+// move it back so the download can resume. It reports whether it did.
+func (dl *download) relinkPartial(state progressState) bool {
+	if state.Inode == 0 {
+		return false
+	}
+	found := findFile(filepath.Dir(dl.outputPath()), state.Device, state.Inode)
+	if found == "" && state.Path != "" && filepath.Dir(state.Path) != filepath.Dir(dl.outputPath()) {
+		found = findFile(filepath.Dir(state.Path), state.Device, state.Inode)
+	}
+	if found == "" {
+		return false
+	}
+	if !confirm(fmt.Sprintf("The partial download of %s was moved to %s. Move it back and resume?", dl.filename, found)) {
+		return false
+	}
+	if err := os.Rename(found, dl.outputPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error moving partial download back: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// adoptProgress looks for progress saved under another name for the
+// partial file at the output path, as when the file was renamed after
+// being interrupted, and offers to take it over. It returns the progress,
+// or nil if there is none to take over.
+func (dl *download) adoptProgress() []byte {
+	info, err := os.Stat(dl.outputPath())
+	if err != nil {
+		return nil
+	}
+	dev, ino, ok := fileID(info)
+	if !ok {
+		return nil
+	}
+
+	// Progress files of other downloads are where this one's would be,
+	// named after the same pattern
+	dir := filepath.Dir(dl.progressPath())
+	glob := filepath.Base(progressFileVars(dl.outputPath(), true).Replace(progressPattern(dl.progressFile)))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if ok, _ := filepath.Match(glob, name); !ok {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var state progressState
+		if json.Unmarshal(data, &state) != nil || state.Inode != ino || state.Device != dev {
+			continue
+		}
+		if !confirm(fmt.Sprintf("%s is the partial download of %s, renamed. Resume it under its new name?", dl.filename, state.Path)) {
+			return nil
+		}
+		if err := os.Rename(path, dl.progressPath()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error taking over progress: %v\n", err)
+			return nil
+		}
+		return data
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionReport records the outcome of every download of a session in a
+// file, for auditing large mirroring jobs with -report. The file is
+// rewritten as each download finishes, so a session that stops early
+// still leaves a report of what it got through.
+type sessionReport struct {
+	path string
+	dls  []*download
+
+	mu      sync.Mutex
+	started map[int]time.Time
+	rows    []reportRow
+	failed  bool
+}
+
+// reportRow is the outcome of one download.
+type reportRow struct {
+	URI      string `json:"uri"`
+	Filename string `json:"filename,omitempty"`
+	// Status is "completed", "unchanged" if the file on disk was
+	// current, or "failed".
+	Status string `json:"status"`
+	Size   uint64 `json:"size"`
+	// Bytes is how much was transferred in this session, which is less
+	// than Size for resumed downloads.
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+	// Speed is the average in bytes per second.
+	Speed float64 `json:"speed"`
+	// Checksum is "verified" or "mismatch", or empty if there was none
+	// to check.
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// newSessionReport returns a report for the downloads dls, written to
+// path as CSV if it ends in .csv and as JSON otherwise. The downloads are
+// told apart by their position in dls, counting from 1, as with the
+// other session reporters.
+func newSessionReport(path string, dls []*download) *sessionReport {
+	return &sessionReport{path: path, dls: dls, started: make(map[int]time.Time)}
+}
+
+func (r *sessionReport) downloadStarted(id int, info fileInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started[id] = time.Now()
+}
+
+func (r *sessionReport) downloadUpdated(id int, u progressUpdate) {}
+
+func (r *sessionReport) downloadFinished(id int, err error) {
+	r.add(id, "completed", err)
+}
+
+// unchanged records that download id was skipped, as the file on disk
+// was already current.
+func (r *sessionReport) unchanged(id int) {
+	r.add(id, "unchanged", nil)
+}
+
+func (r *sessionReport) add(id int, status string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dl := r.dls[id-1]
+	row := reportRow{
+		URI:      dl.uri,
+		Filename: filepath.ToSlash(dl.filename),
+		Status:   status,
+		Size:     dl.filesize,
+		Bytes:    dl.written.Load(),
+	}
+	if start, ok := r.started[id]; ok {
+		elapsed := time.Since(start)
+		row.Duration = elapsed.Seconds()
+		if elapsed > 0 {
+			row.Speed = float64(row.Bytes) / elapsed.Seconds()
+		}
+	}
+	switch {
+	case errors.Is(err, errChecksumMismatch):
+		row.Checksum = "mismatch"
+	case err == nil && dl.checksum != nil && status == "completed":
+		row.Checksum = "verified"
+	}
+	if err != nil {
+		row.Status = "failed"
+		row.Error = err.Error()
+	}
+	r.rows = append(r.rows, row)
+
+	if werr := r.write(); werr != nil && !r.failed {
+		// The report is a side channel; failing to write it doesn't fail
+		// the downloads
+		fmt.Fprintf(os.Stderr, "Error writing report: %v\n", werr)
+		r.failed = true
+	}
+}
+
+// write saves the rows so far to the report's file.
+func (r *sessionReport) write() error {
+	if !strings.EqualFold(filepath.Ext(r.path), ".csv") {
+		data, err := json.MarshalIndent(r.rows, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(r.path, append(data, '\n'))
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"uri", "filename", "status", "size", "bytes", "duration_seconds", "speed", "checksum", "error"})
+	for _, row := range r.rows {
+		_ = w.Write([]string{
+			row.URI,
+			row.Filename,
+			row.Status,
+			strconv.FormatUint(row.Size, 10),
+			strconv.FormatInt(row.Bytes, 10),
+			strconv.FormatFloat(row.Duration, 'f', 3, 64),
+			strconv.FormatFloat(row.Speed, 'f', 0, 64),
+			row.Checksum,
+			row.Error,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, buf.Bytes())
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxPageSize caps how much of an HTML page resolvers read.
+const maxPageSize = 1 << 20
+
+// scriptRedirectSize is the largest page whose scripts are looked at for
+// a redirect. Interstitials that redirect by script are a few KB at most.
+const scriptRedirectSize = 16 << 10
+
+// maxUnwraps limits how many redirect pages are followed for one file.
+const maxUnwraps = 3
+
+var (
+	// driveFilePath matches the file ID in drive.google.com/file/d/ID/view.
+	driveFilePath = regexp.MustCompile(`^/file/d/([^/]+)`)
+	// driveForm matches the download form on Drive's virus scan warning.
+	driveForm = regexp.MustCompile(`(?s)<form[^>]+id="download-form"[^>]+action="([^"]+)"(.*?)</form>`)
+	// hiddenInput matches a hidden form field.
+	hiddenInput = regexp.MustCompile(`<input[^>]+type="hidden"[^>]+name="([^"]+)"[^>]+value="([^"]*)"`)
+	// driveConfirm matches the confirmation token of older warning pages.
+	driveConfirm = regexp.MustCompile(`confirm=([0-9A-Za-z_-]+)`)
+
+	// metaTag, refreshEquiv, and metaContent pick apart meta refresh tags
+	// regardless of attribute order.
+	metaTag      = regexp.MustCompile(`(?i)<meta\s[^>]*>`)
+	refreshEquiv = regexp.MustCompile(`(?i)http-equiv\s*=\s*["']?refresh`)
+	metaContent  = regexp.MustCompile(`(?i)content\s*=\s*["']([^"']*)["']`)
+	refreshURL   = regexp.MustCompile(`(?i)^\s*\d*\s*;\s*url\s*=\s*['"]?([^'"]+)`)
+	// headEnd matches the end of a page's head, and scriptBlock the
+	// contents of a script element.
+	headEnd     = regexp.MustCompile(`(?i)</head\s*>|<body[\s>]`)
+	scriptBlock = regexp.MustCompile(`(?is)<script[^>]*>(.*?)</script\s*>`)
+	// jsRedirect matches the usual ways a script sends the browser on.
+	jsRedirect = regexp.MustCompile(`(?i)(?:window|document|top)\.location(?:\.href)?\s*=\s*["']([^"']+)["']|location\.(?:replace|assign)\(\s*["']([^"']+)["']`)
+)
+
+// shareResolver turns share links of a file hosting service, which lead
+// to a web page, into URIs serving the file itself.
+type shareResolver struct {
+	name    string
+	matches func(u *url.URL) bool
+	resolve func(dl *download, u *url.URL) (string, error)
+}
+
+var shareResolvers = []shareResolver{
+	{name: "Dropbox", matches: isDropbox, resolve: resolveDropbox},
+	{name: "Google Drive", matches: isGoogleDrive, resolve: resolveGoogleDrive},
+}
+
+// resolveShareLink returns the direct URI for a share link, or uri
+// unchanged if it isn't one.
+func (dl *download) resolveShareLink(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range shareResolvers {
+		if !r.matches(u) {
+			continue
+		}
+		direct, err := r.resolve(dl, u)
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve %s link: %w", r.name, err)
+		}
+		return direct, nil
+	}
+	return uri, nil
+}
+
+func isDropbox(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	return host == "dropbox.com" || host == "www.dropbox.com"
+}
+
+// resolveDropbox asks for the file instead of the preview page, which
+// Dropbox does with dl=1.
+func resolveDropbox(_ *download, u *url.URL) (string, error) {
+	q := u.Query()
+	q.Set("dl", "1")
+	direct := *u
+	direct.RawQuery = q.Encode()
+	return direct.String(), nil
+}
+
+func isGoogleDrive(u *url.URL) bool {
+	return driveFileID(u) != ""
+}
+
+// driveFileID returns the ID of the file a Drive link is for, or "" if it
+// isn't a file link: Docs, Sheets, folders, and the like are left as they
+// are.
+func driveFileID(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	if host != "drive.google.com" && host != "docs.google.com" {
+		return ""
+	}
+	if m := driveFilePath.FindStringSubmatch(u.Path); m != nil {
+		return m[1]
+	}
+	if u.Path == "/open" || u.Path == "/uc" {
+		return u.Query().Get("id")
+	}
+	return ""
+}
+
+// resolveGoogleDrive turns any form of Drive file link into a download
+// link. Files too large for Drive to scan for viruses get a warning page
+// instead of the file; its form holds the parameters that skip it.
+func resolveGoogleDrive(dl *download, u *url.URL) (string, error) {
+	id := driveFileID(u)
+	direct := "https://drive.usercontent.google.com/download?export=download&id=" + url.QueryEscape(id)
+
+	page, isHTML, err := dl.fetchPage(direct)
+	if err != nil {
+		return "", err
+	}
+	if !isHTML {
+		return direct, nil
+	}
+
+	if m := driveForm.FindStringSubmatch(page); m != nil {
+		action, err := url.Parse(html.UnescapeString(m[1]))
+		if err != nil {
+			return "", fmt.Errorf("invalid download form: %w", err)
+		}
+		q := url.Values{}
+		for _, input := range hiddenInput.FindAllStringSubmatch(m[2], -1) {
+			q.Set(html.UnescapeString(input[1]), html.UnescapeString(input[2]))
+		}
+		action.RawQuery = q.Encode()
+		return action.String(), nil
+	}
+	if m := driveConfirm.FindStringSubmatch(page); m != nil {
+		return direct + "&confirm=" + m[1], nil
+	}
+	return "", fmt.Errorf("file is not shared publicly or the download page changed")
+}
+
+// fetchPage GETs uri and, if it is an HTML page, returns its start.
+func (dl *download) fetchPage(uri string) (page string, isHTML bool, err error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", false, err
+	}
+	dl.setHeaders(req)
+
+	resp, err := dl.do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", false, fmt.Errorf("non-2xx status (%d) for %s", resp.StatusCode, uri)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return "", false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return "", false, err
+	}
+	return string(body), true, nil
+}
+
+// unwrapRedirectPage looks for the link an interstitial page (such as
+// SourceForge's "your download will start shortly") sends the browser on
+// to, by meta refresh or script. It returns "" if there is none.
+func (dl *download) unwrapRedirectPage(uri string) (string, error) {
+	page, isHTML, err := dl.fetchPage(uri)
+	if err != nil || !isHTML {
+		return "", err
+	}
+	target := redirectTarget(page)
+	if target == "" {
+		return "", nil
+	}
+
+	base, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	next, err := base.Parse(strings.TrimSpace(html.UnescapeString(target)))
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect %q: %w", target, err)
+	}
+	return next.String(), nil
+}
+
+// redirectTarget returns the link page sends the browser on to, or "" if
+// it doesn't. A meta refresh counts only in the head. A script counts
+// only on a page no bigger than scriptRedirectSize, as an interstitial
+// is, since any page with scripts may change location.href somewhere.
+func redirectTarget(page string) string {
+	head := page
+	if i := headEnd.FindStringIndex(page); i != nil {
+		head = page[:i[0]]
+	}
+	for _, tag := range metaTag.FindAllString(head, -1) {
+		if !refreshEquiv.MatchString(tag) {
+			continue
+		}
+		if c := metaContent.FindStringSubmatch(tag); c != nil {
+			if m := refreshURL.FindStringSubmatch(html.UnescapeString(c[1])); m != nil {
+				return m[1]
+			}
+		}
+	}
+
+	if len(page) > scriptRedirectSize {
+		return ""
+	}
+	for _, script := range scriptBlock.FindAllStringSubmatch(page, -1) {
+		if m := jsRedirect.FindStringSubmatch(script[1]); m != nil {
+			return m[1] + m[2]
+		}
+	}
+	return ""
+}
+
+// looksLikePage reports whether the URI names a web page rather than a
+// file that merely came back as HTML.
+func looksLikePage(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	return ext == ".html" || ext == ".htm" || ext == ".php" || ext == "" && strings.HasSuffix(u.Path, "/")
+}
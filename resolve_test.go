@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDriveFileID(t *testing.T) {
+	tests := []struct {
+		uri, want string
+	}{
+		{"https://drive.google.com/file/d/1AbC_d-E/view?usp=sharing", "1AbC_d-E"},
+		{"https://drive.google.com/file/d/1AbC_d-E", "1AbC_d-E"},
+		{"https://drive.google.com/open?id=1AbC_d-E", "1AbC_d-E"},
+		{"https://drive.google.com/uc?export=download&id=1AbC_d-E", "1AbC_d-E"},
+		{"https://docs.google.com/uc?id=1AbC_d-E&export=download", "1AbC_d-E"},
+		{"https://DRIVE.google.com/file/d/1AbC_d-E/view", "1AbC_d-E"},
+		{"https://docs.google.com/document/d/1AbC_d-E/export?format=pdf", ""},
+		{"https://docs.google.com/spreadsheets/d/1AbC_d-E/export?format=csv", ""},
+		{"https://docs.google.com/presentation/d/1AbC_d-E/edit", ""},
+		{"https://drive.google.com/drive/folders/1AbC_d-E", ""},
+		{"https://drive.google.com/", ""},
+		{"https://docs.google.com/open", ""},
+		{"https://example.com/file/d/1AbC_d-E/view", ""},
+		{"https://example.com/uc?id=1AbC_d-E", ""},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := driveFileID(u); got != tt.want {
+			t.Errorf("driveFileID(%s) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	big := strings.Repeat("<p>Lorem ipsum dolor sit amet.</p>\n", 1000)
+	tests := []struct {
+		name, page, want string
+	}{
+		{"meta refresh", `<html><head><meta http-equiv="refresh" content="5; url=https://dl.example.com/f.iso"></head><body>Your download will start shortly.</body></html>`, "https://dl.example.com/f.iso"},
+		{"meta refresh, attributes swapped", `<head><META content='0;URL=/f.iso' HTTP-EQUIV=Refresh></head>`, "/f.iso"},
+		{"meta refresh on a big page", `<head><meta http-equiv="refresh" content="3;url=/f.iso"></head><body>` + big + `</body>`, "/f.iso"},
+		{"meta refresh in the body", `<head><title>x</title></head><body><meta http-equiv="refresh" content="0;url=/f.iso"></body>`, ""},
+		{"script", `<html><head><script>window.location.href = "/f.iso";</script></head></html>`, "/f.iso"},
+		{"location.replace", `<body><script type="text/javascript">location.replace('/f.iso')</script></body>`, "/f.iso"},
+		{"script on a big page", `<html><body>` + big + `<script>if (x) { window.location = "/login"; }</script></body></html>`, ""},
+		{"outside a script", `<body><p>Set document.location = "/f.iso" to go on.</p></body>`, ""},
+		{"no redirect", `<html><body>Not found</body></html>`, ""},
+	}
+	for _, tt := range tests {
+		if got := redirectTarget(tt.page); got != tt.want {
+			t.Errorf("%s: redirectTarget = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
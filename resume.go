@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// progressInterval is how often the progress of a running download
+	// is saved to disk by default.
+	progressInterval = 2 * time.Second
+	// progressSaveDelta is how much more must have been written since
+	// the last save for progress to be saved again, so a stalled
+	// download doesn't keep rewriting the same state.
+	progressSaveDelta = 1 << 20
+)
+
+// byteRange is an inclusive range of bytes in the output file.
+type byteRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// progressState is saved next to a partial download so that a later run
+// can pick up where it left off.
+type progressState struct {
+	URI          string      `json:"uri"`
+	Size         uint64      `json:"size"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	PartFiles    bool        `json:"part_files,omitempty"`
+	Completed    []byteRange `json:"completed"`
+	// Offset is where in the remote file a -range download starts.
+	Offset uint64 `json:"offset,omitempty"`
+
+	// Path, Device, and Inode record where the partial file was and
+	// which file it is, so it can be found again if it is renamed.
+	Path   string `json:"path,omitempty"`
+	Device uint64 `json:"device,omitempty"`
+	Inode  uint64 `json:"inode,omitempty"`
+}
+
+// defaultProgressFile is where progress is saved unless -progress-file
+// says otherwise: in a hidden file next to the partial file.
+const defaultProgressFile = "{dir}/.{name}.dl"
+
+// progressPath returns where the progress of the download is saved.
+func (dl *download) progressPath() string {
+	return progressFileVars(dl.outputPath(), false).Replace(progressPattern(dl.progressFile))
+}
+
+// progressPattern returns pattern, a -progress-file value, in the form of
+// a path, the default if it is empty.
+func progressPattern(pattern string) string {
+	if pattern == "" {
+		pattern = defaultProgressFile
+	}
+	return filepath.FromSlash(pattern)
+}
+
+// progressFileVars returns a replacer for the variables of a
+// -progress-file pattern for a download to output: {dir} and {name},
+// the directory and name of output, {state}, dl's own directory for
+// progress files, and {id}, a hash of output's path that tells downloads
+// apart in a shared directory. With wildcard set, {name} and {id} become
+// a * instead, to match the progress files of any download.
+func progressFileVars(output string, wildcard bool) *strings.Replacer {
+	dir, name := filepath.Dir(output), filepath.Base(output)
+	sum := sha256.Sum256([]byte(output))
+	id := hex.EncodeToString(sum[:8])
+	if wildcard {
+		name, id = "*", "*"
+	}
+	state, _ := progressStateDir()
+	return strings.NewReplacer("{dir}", dir, "{name}", name, "{state}", state, "{id}", id)
+}
+
+// progressStateDir returns the directory for progress files that
+// -progress-file keeps in one place, away from the downloads.
+func progressStateDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dl", "progress"), nil
+}
+
+// checkProgressPattern makes sure a -progress-file pattern gives each
+// download a progress file of its own.
+func checkProgressPattern(pattern string) error {
+	if !strings.Contains(pattern, "{name}") && !strings.Contains(pattern, "{id}") {
+		return fmt.Errorf("%q must contain {name} or {id}, so each download has its own progress file", pattern)
+	}
+	if strings.Contains(pattern, "{state}") {
+		if _, err := progressStateDir(); err != nil {
+			return fmt.Errorf("no directory for {state}: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadProgress restores the completed ranges of an earlier, interrupted
+// run of the same download. It reports whether there is anything to
+// resume; stale or mismatched progress is ignored. A partial file that
+// was renamed since, or left by another tool, is offered to be resumed
+// rather than started over.
+func (dl *download) loadProgress() bool {
+	if !dl.supportsRange {
+		return false
+	}
+
+	data, err := os.ReadFile(dl.progressPath())
+	if errors.Is(err, fs.ErrNotExist) && dl.restoreQuarantined() {
+		data, err = os.ReadFile(dl.progressPath())
+	}
+	if errors.Is(err, fs.ErrNotExist) && !dl.partFiles() {
+		data = dl.adoptProgress()
+		if data == nil && dl.extract == nil {
+			data = dl.importPartial()
+		}
+		if data != nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return false
+	}
+	var state progressState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false
+	}
+
+	// The remote file must be the one we started with, and the partial
+	// file must still be there
+	if state.Size != dl.filesize || state.ETag != dl.etag || state.LastModified != dl.lastModified {
+		if dl.reusePieces(state) {
+			return true
+		}
+		fmt.Println("Remote file changed since the last attempt; starting over.")
+		return false
+	}
+	if state.Offset != dl.remoteOffset() {
+		fmt.Println("Progress was saved for a different -range; starting over.")
+		return false
+	}
+	if state.PartFiles != dl.partFiles() {
+		fmt.Println("Progress was saved with a different -strategy; starting over.")
+		if state.PartFiles {
+			dl.removePartFiles()
+		}
+		return false
+	}
+	if !state.PartFiles {
+		info, err := os.Stat(dl.outputPath())
+		if errors.Is(err, fs.ErrNotExist) && dl.relinkPartial(state) {
+			info, err = os.Stat(dl.outputPath())
+		}
+		if err != nil || uint64(info.Size()) != dl.filesize {
+			return false
+		}
+	}
+
+	dl.completed = mergeRanges(state.Completed)
+	return len(dl.completed) > 0
+}
+
+// saveProgress writes the completed ranges of the download to its
+// progress file. The file is replaced atomically so a crash mid-write
+// never leaves it unreadable.
+func (dl *download) saveProgress() error {
+	state := progressState{
+		URI:          dl.uri,
+		Size:         dl.filesize,
+		ETag:         dl.etag,
+		LastModified: dl.lastModified,
+		PartFiles:    dl.partFiles(),
+		Completed:    dl.completedRanges(),
+		Offset:       dl.remoteOffset(),
+		Path:         dl.outputPath(),
+	}
+	if !state.PartFiles {
+		if info, err := os.Stat(dl.outputPath()); err == nil {
+			state.Device, state.Inode, _ = fileID(info)
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := dl.progressPath() + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(tmp), 0o755); err != nil {
+		return fmt.Errorf("cannot save progress: %w", err)
+	}
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		_ = os.Remove(tmp)
+		// With the disk full, there may be no room for a second copy,
+		// but rewriting the existing file reuses its space
+		if isDiskFull(err) {
+			if _, serr := os.Stat(dl.progressPath()); serr == nil {
+				if err := os.WriteFile(dl.progressPath(), data, 0o644); err == nil {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("cannot save progress: %w", err)
+	}
+	if err := os.Rename(tmp, dl.progressPath()); err != nil {
+		return fmt.Errorf("cannot save progress: %w", err)
+	}
+	return nil
+}
+
+// removeProgress deletes the progress file of a finished download.
+func (dl *download) removeProgress() {
+	if err := os.Remove(dl.progressPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "Error removing progress file: %v\n", err)
+	}
+}
+
+// saveProgressPeriodically saves progress every save interval until stop
+// is closed, skipping saves when little has been written since the last
+// one. Aborting saves the final state regardless.
+func (dl *download) saveProgressPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(dl.saveInterval)
+	defer ticker.Stop()
+
+	saved := dl.written.Load()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			written := dl.written.Load()
+			if written-saved < progressSaveDelta {
+				continue
+			}
+			if err := dl.saveProgress(); err != nil {
+				dl.warn("Error saving progress: %v", err)
+				continue
+			}
+			saved = written
+		}
+	}
+}
+
+// abort cleans up after a download that won't complete. Resumable
+// downloads keep the partial file or part files and save their progress;
+// anything else is removed.
+func (dl *download) abort() {
+	if dl.manifest != nil && dl.manifest.live {
+		// A live stream can't be captured again, so what was is kept
+		fmt.Fprintln(os.Stderr, "Kept what was captured of the live stream.")
+		return
+	}
+	if dl.supportsRange {
+		if err := dl.saveProgress(); err == nil {
+			fmt.Fprintln(os.Stderr, "Progress saved; run dl again with the same URI to resume.")
+			return
+		}
+	}
+	_ = os.Remove(dl.outputPath())
+	dl.removePartFiles()
+}
+
+// completedRanges returns the ranges written to the output file so far,
+// both in this run and in earlier ones.
+func (dl *download) completedRanges() []byteRange {
+	dl.mu.Lock()
+	ranges := append([]byteRange(nil), dl.completed...)
+	for _, p := range dl.parts {
+		if p.committed > p.startByte {
+			ranges = append(ranges, byteRange{Start: p.startByte, End: p.committed - 1})
+		}
+	}
+	dl.mu.Unlock()
+
+	// Only once what is held to be written in order is written
+	if dl.reorder != nil {
+		return subtractRanges(mergeRanges(ranges), dl.reorder.unwritten())
+	}
+	return mergeRanges(ranges)
+}
+
+// remainingRanges returns the ranges of the file still to be fetched.
+func (dl *download) remainingRanges() []byteRange {
+	var remaining []byteRange
+	var next uint64
+	for _, r := range dl.completed {
+		if r.Start > next {
+			remaining = append(remaining, byteRange{Start: next, End: r.Start - 1})
+		}
+		next = r.End + 1
+	}
+	if next < dl.filesize {
+		remaining = append(remaining, byteRange{Start: next, End: dl.filesize - 1})
+	}
+	return remaining
+}
+
+// mergeRanges sorts ranges and joins those that overlap or touch.
+func mergeRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	var merged []byteRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End+1 {
+			if r.End > merged[n-1].End {
+				merged[n-1].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// robotsAgent is the product token dl looks for in robots.txt.
+const robotsAgent = "dl"
+
+// maxRobotsSize is how much of a robots.txt is read, as RFC 9309 allows.
+const maxRobotsSize = 500 << 10
+
+// robotsRule allows or disallows the paths matching pattern.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// robotsRules are the rules of a robots.txt that apply to dl.
+type robotsRules struct {
+	rules []robotsRule
+	delay time.Duration
+}
+
+// robotsChecker fetches robots.txt once per host and paces requests to
+// each host by its crawl delay, through robotsTransport.
+type robotsChecker struct {
+	mu    sync.Mutex
+	hosts map[string]*robotsHost
+	last  map[string]time.Time
+}
+
+// robotsHost is the robots.txt of a host, fetched by whoever first needs
+// it while others needing it wait.
+type robotsHost struct {
+	once  sync.Once
+	rules *robotsRules
+	err   error
+}
+
+// robotsFetchKey marks the context of robots.txt requests, which
+// robotsTransport lets through unpaced, redirects and all, as they are
+// made while the rules they'd be paced by are looked up.
+type robotsFetchKey struct{}
+
+func newRobotsChecker() *robotsChecker {
+	return &robotsChecker{
+		hosts: make(map[string]*robotsHost),
+		last:  make(map[string]time.Time),
+	}
+}
+
+// allowed reports whether robots.txt lets dl fetch uri.
+func (rc *robotsChecker) allowed(uri string) (bool, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false, err
+	}
+	rules, err := rc.rulesFor(u)
+	if err != nil {
+		return false, err
+	}
+	return rules.allows(u.RequestURI()), nil
+}
+
+// wait sleeps until the crawl delay of uri's host has passed since the
+// previous request to it.
+func (rc *robotsChecker) wait(uri string) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	rules, err := rc.rulesFor(u)
+	if err != nil {
+		return
+	}
+
+	rc.mu.Lock()
+	key := u.Scheme + "://" + u.Host
+	wait := time.Until(rc.last[key].Add(rules.delay))
+	rc.last[key] = time.Now().Add(max(wait, 0))
+	rc.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// robotsTransport paces every request, including those for the parts of
+// downloads and after redirects, by the crawl delay of its host.
+type robotsTransport struct {
+	robots *robotsChecker
+	next   http.RoundTripper
+}
+
+func (t *robotsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(robotsFetchKey{}) == nil {
+		t.robots.wait(req.URL.String())
+	}
+	return t.next.RoundTrip(req)
+}
+
+// rulesFor returns the rules of u's host, fetching its robots.txt the
+// first time. The fetch happens outside rc.mu, so hosts are looked up
+// side by side and pacing other hosts carries on meanwhile.
+func (rc *robotsChecker) rulesFor(u *url.URL) (*robotsRules, error) {
+	key := u.Scheme + "://" + u.Host
+	rc.mu.Lock()
+	host := rc.hosts[key]
+	if host == nil {
+		host = &robotsHost{}
+		rc.hosts[key] = host
+	}
+	rc.mu.Unlock()
+
+	host.once.Do(func() {
+		host.rules, host.err = fetchRobots(key + "/robots.txt")
+	})
+	return host.rules, host.err
+}
+
+// fetchRobots GETs and parses a robots.txt. A missing one allows
+// everything; one that can't be fetched because of a server error
+// disallows everything, as RFC 9309 requires.
+func fetchRobots(uri string) (*robotsRules, error) {
+	ctx := context.WithValue(context.Background(), robotsFetchKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GET request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch %s: %w", uri, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return &robotsRules{rules: []robotsRule{{allow: false, pattern: "/"}}}, nil
+	case resp.StatusCode >= 400:
+		return &robotsRules{}, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("non-2xx status (%d) for %s", resp.StatusCode, uri)
+	}
+	return parseRobots(io.LimitReader(resp.Body, maxRobotsSize), robotsAgent), nil
+}
+
+// parseRobots returns the rules of the group for agent, or of the "*"
+// group if none names it.
+func parseRobots(r io.Reader, agent string) *robotsRules {
+	var named, wildcard *robotsRules
+	var current []*robotsRules
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if key == "user-agent" {
+			// Consecutive user-agent lines share one group
+			if !inAgents {
+				current = nil
+			}
+			inAgents = true
+			switch token := strings.ToLower(value); {
+			case token == agent:
+				if named == nil {
+					named = &robotsRules{}
+				}
+				current = append(current, named)
+			case token == "*":
+				if wildcard == nil {
+					wildcard = &robotsRules{}
+				}
+				current = append(current, wildcard)
+			}
+			continue
+		}
+		inAgents = false
+
+		for _, g := range current {
+			switch key {
+			case "allow", "disallow":
+				if value != "" {
+					g.rules = append(g.rules, robotsRule{allow: key == "allow", pattern: value})
+				}
+			case "crawl-delay":
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+					g.delay = time.Duration(secs * float64(time.Second))
+				}
+			}
+		}
+	}
+
+	switch {
+	case named != nil:
+		return named
+	case wildcard != nil:
+		return wildcard
+	}
+	return &robotsRules{}
+}
+
+// allows applies the most specific rule matching path; on a tie, allow
+// wins.
+func (rr *robotsRules) allows(path string) bool {
+	allow, longest := true, -1
+	for _, r := range rr.rules {
+		if !robotsMatch(r.pattern, path) {
+			continue
+		}
+		if len(r.pattern) > longest || len(r.pattern) == longest && r.allow {
+			allow, longest = r.allow, len(r.pattern)
+		}
+	}
+	return allow
+}
+
+// robotsMatch matches path against a robots.txt pattern, in which "*"
+// matches any run of characters and a trailing "$" anchors the end.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	pieces := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, pieces[0]) {
+		return false
+	}
+	rest := path[len(pieces[0]):]
+	for i, piece := range pieces[1:] {
+		// The last piece of an anchored pattern must end the path
+		if anchored && i == len(pieces)-2 {
+			return strings.HasSuffix(rest, piece)
+		}
+		idx := strings.Index(rest, piece)
+		if idx < 0 {
+			return false
+		}
+		rest = rest[idx+len(piece):]
+	}
+	return !anchored || rest == ""
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+// useRobots sends the requests of the test through a client paced by a
+// new robots checker, as -scrape and -sitemap do.
+func useRobots(t *testing.T) *robotsChecker {
+	t.Helper()
+	rc := newRobotsChecker()
+	saved := httpClient
+	httpClient = newHTTPClient(clientOptions{maxRedirects: defaultMaxRedirects, robots: rc})
+	t.Cleanup(func() { httpClient = saved })
+	return rc
+}
+
+func TestRobotsRedirect(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			http.Redirect(w, r, "/robots-new.txt", http.StatusMovedPermanently)
+		case "/robots-new.txt":
+			w.Write([]byte("User-agent: *\nDisallow: /private/\nCrawl-delay: 0.3\n"))
+		default:
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+		}
+	}))
+	defer srv.Close()
+	rc := useRobots(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, path := range []string{"/private/a", "/public/a"} {
+			ok, err := rc.allowed(srv.URL + path)
+			if err != nil {
+				t.Error(err)
+			}
+			if want := path == "/public/a"; ok != want {
+				t.Errorf("allowed(%s) = %v, want %v", path, ok, want)
+			}
+		}
+		for range 3 {
+			resp, err := httpClient.Get(srv.URL + "/public/a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetching a redirected robots.txt hung")
+	}
+
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < 250*time.Millisecond {
+			t.Errorf("request %d came %v after the one before, under the crawl delay", i, gap)
+		}
+	}
+}
+
+// TestRobotsHostsInParallel checks that a host slow to serve its
+// robots.txt doesn't hold up the lookups of others.
+func TestRobotsHostsInParallel(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("User-agent: *\nDisallow:\n"))
+	}))
+	defer fast.Close()
+	rc := useRobots(t)
+
+	go rc.allowed(slow.URL + "/a")
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if ok, err := rc.allowed(fast.URL + "/a"); !ok || err != nil {
+			t.Errorf("allowed = %v, %v, want true", ok, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("looking up one host waited on another")
+	}
+}
+
+func TestSitemapRobots(t *testing.T) {
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("User-agent: *\nDisallow: /private/\n"))
+	})
+	mux.HandleFunc("/index.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<sitemapindex><sitemap><loc>` + srv.URL + `/public.xml</loc></sitemap><sitemap><loc>` + srv.URL + `/private/hidden.xml</loc></sitemap></sitemapindex>`))
+	})
+	mux.HandleFunc("/public.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<urlset><url><loc>` + srv.URL + `/a.png</loc></url></urlset>`))
+	})
+	mux.HandleFunc("/private/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s was fetched although robots.txt disallows it", r.URL.Path)
+		w.Write([]byte(`<urlset><url><loc>` + srv.URL + `/b.png</loc></url></urlset>`))
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+	rc := useRobots(t)
+
+	lister := download{}
+	found, err := lister.listSitemap(srv.URL+"/index.xml", nil, rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].uri != srv.URL+"/a.png" {
+		t.Errorf("listed %v, want only %s/a.png", found, srv.URL)
+	}
+	if _, err := lister.listSitemap(srv.URL+"/private/hidden.xml", nil, rc); err == nil {
+		t.Error("read a disallowed sitemap")
+	}
+}
+
+// TestRobotsPacesParts checks that the crawl delay holds between the
+// requests for a download's parts, not just between downloads.
+func TestRobotsPacesParts(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	data := dltest.RandomData(1<<20, 13)
+	var mu sync.Mutex
+	var times []time.Time
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("User-agent: *\nCrawl-delay: 0.2\n"))
+	})
+	mux.HandleFunc("/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dl := newTestDownload(t, srv.URL+"/file.bin", t.TempDir())
+	dl.client = newHTTPClient(clientOptions{maxRedirects: defaultMaxRedirects, conns: dl.conns, robots: newRobotsChecker()})
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	checkOutput(t, dl, data)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) < 2 {
+		t.Fatalf("%d GETs for the file, want one per part", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		// Allow a little slack for the clock of the server
+		if gap := times[i].Sub(times[i-1]); gap < delay-20*time.Millisecond {
+			t.Errorf("GET %d came %v after the one before, within the crawl delay", i, gap)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// queueChunkSize is the size of the chunks handed out by the queue based
+// schedulers. Small enough that fast connections pick up more of the
+// file, large enough that per-request overhead stays negligible.
+const queueChunkSize = 8 << 20
+
+// scheduler decides how the byte range of a download is divided among
+// workers. Each idle worker asks for its next part until the scheduler
+// has nothing left to hand out.
+type scheduler interface {
+	// next returns the next part for an idle worker to fetch, or nil if
+	// the worker should stop. It is called with download.mu held.
+	next(dl *download) *downloadPart
+}
+
+// schedulers maps the -scheduler flag values to their constructors.
+var schedulers = map[string]func(dl *download) scheduler{
+	// static gives each worker one equal slice of the file.
+	"static": func(dl *download) scheduler {
+		return &queueScheduler{pending: dl.partition(dl.boost, []string{dl.uri})}
+	},
+	// queue cuts the file into many chunks that workers take in order,
+	// so fast connections end up fetching more of the file.
+	"queue": func(dl *download) scheduler {
+		return &queueScheduler{pending: dl.partition(dl.queueChunks(), []string{dl.uri})}
+	},
+	// tail-split starts like static, then has idle workers take over
+	// half of the largest remaining part.
+	"tail-split": func(dl *download) scheduler {
+		return &queueScheduler{pending: dl.partition(dl.boost, []string{dl.uri}), split: true}
+	},
+	// mirror-striped queues chunks round-robin across the primary URI
+	// and any mirrors.
+	"mirror-striped": func(dl *download) scheduler {
+		return &queueScheduler{pending: dl.partition(dl.queueChunks(), dl.sources())}
+	},
+}
+
+// schedulerNames returns the valid -scheduler values for usage messages.
+func schedulerNames() string {
+	names := make([]string, 0, len(schedulers))
+	for name := range schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newScheduler returns the named scheduler for dl.
+func newScheduler(name string, dl *download) (scheduler, error) {
+	newSched, ok := schedulers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduler %q (valid: %s)", name, schedulerNames())
+	}
+	return newSched(dl), nil
+}
+
+// queueScheduler hands out a fixed list of parts in order and, if split
+// is set, then splits the largest running part for each idle worker.
+type queueScheduler struct {
+	pending []*downloadPart
+	split   bool
+}
+
+func (s *queueScheduler) next(dl *download) *downloadPart {
+	if len(s.pending) > 0 {
+		p := s.pending[0]
+		s.pending = s.pending[1:]
+		p.index = len(dl.parts)
+		dl.parts = append(dl.parts, p)
+		return p
+	}
+	if s.split {
+		return dl.splitLargestPart()
+	}
+	return nil
+}
+
+// sweepScheduler returns the scheduler for sweep n, the nth pass over
+// the ranges failed parts left incomplete. Each range becomes one part,
+// fetched over a connection of its own and, given mirrors, from a
+// different source than in the pass before.
+func (dl *download) sweepScheduler(n int) scheduler {
+	sources := dl.sources()
+	k := n % len(sources)
+	sources = append(sources[k:], sources[:k]...)
+	parts := dl.partition(1, sources)
+	for _, p := range parts {
+		// Their ranges were requested at least once before
+		p.attempts = n
+	}
+	return &queueScheduler{pending: parts}
+}
+
+// partition divides the bytes still to be fetched into about count
+// contiguous parts, assigning them to uris round-robin.
+func (dl *download) partition(count int, uris []string) []*downloadPart {
+	remaining := dl.remainingRanges()
+	var total uint64
+	for _, r := range remaining {
+		total += r.End - r.Start + 1
+	}
+
+	var parts []*downloadPart
+	for _, r := range remaining {
+		// Each range gets its share of the parts, but at least one
+		n := int(uint64(count) * (r.End - r.Start + 1) / total)
+		for _, sub := range splitRange(r, n) {
+			parts = append(parts, &downloadPart{
+				uri:       uris[len(parts)%len(uris)],
+				startByte: sub.Start,
+				endByte:   sub.End,
+				offset:    sub.Start,
+				committed: sub.Start,
+			})
+		}
+	}
+	return parts
+}
+
+// splitRange divides r into n equal ranges, the last one taking any
+// remaining bytes. It always returns at least one range and never more
+// ranges than there are bytes.
+func splitRange(r byteRange, n int) []byteRange {
+	length := r.End - r.Start + 1
+	if n < 1 {
+		n = 1
+	}
+	if uint64(n) > length {
+		n = int(length)
+	}
+
+	chunkSize := length / uint64(n)
+	ranges := make([]byteRange, n)
+	for i := range ranges {
+		start := r.Start + uint64(i)*chunkSize
+		end := start + chunkSize - 1
+		if i == n-1 {
+			end = r.End
+		}
+		ranges[i] = byteRange{Start: start, End: end}
+	}
+	return ranges
+}
+
+// queueChunks returns how many chunks the queue based schedulers cut
+// the file into: chunkSize each, but at least one per worker.
+func (dl *download) queueChunks() int {
+	chunks := int(dl.filesize / dl.chunkSize())
+	if chunks < dl.boost {
+		chunks = dl.boost
+	}
+	return chunks
+}
+
+// sources returns the primary URI followed by any mirrors.
+func (dl *download) sources() []string {
+	return append([]string{dl.uri}, dl.mirrors...)
+}
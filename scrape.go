@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// linkAttr matches the link of <a href> and <source src> tags.
+	linkAttr = regexp.MustCompile(`(?is)<(?:a|source)\s[^>]*?\b(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	// baseHref matches the <base href> that relative links resolve against.
+	baseHref = regexp.MustCompile(`(?is)<base\s[^>]*?\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// linkPattern selects links by a glob on their filename, such as
+// "*.iso", or by a regular expression on the whole URI when written
+// between slashes, such as "/releases/.*\.tar\.gz$/".
+type linkPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func parseLinkPattern(s string) (*linkPattern, error) {
+	if len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		return &linkPattern{re: re}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", s, err)
+	}
+	return &linkPattern{glob: s}, nil
+}
+
+func (p *linkPattern) match(u *url.URL) bool {
+	if p.re != nil {
+		return p.re.MatchString(u.String())
+	}
+	ok, _ := path.Match(p.glob, path.Base(u.Path))
+	return ok
+}
+
+// scrapeLinks returns the links on the HTML page at uri that match
+// pattern, without duplicates and in the order they appear.
+func (dl *download) scrapeLinks(uri string, pattern *linkPattern) ([]source, error) {
+	page, isHTML, err := dl.fetchPage(uri)
+	if err != nil {
+		return nil, err
+	}
+	if !isHTML {
+		return nil, fmt.Errorf("%s is not an HTML page", uri)
+	}
+
+	links, err := pageLinks(page, uri)
+	if err != nil {
+		return nil, err
+	}
+	var sources []source
+	for _, u := range links {
+		if !pattern.match(u) {
+			continue
+		}
+		normalized, err := normalizeURI(u.String())
+		if err != nil {
+			continue
+		}
+		sources = append(sources, source{uri: normalized})
+	}
+	return sources, nil
+}
+
+// pageLinks returns the HTTP(S) links on page, the HTML page at uri,
+// resolved and without fragments or duplicates, in the order they
+// appear.
+func pageLinks(page, uri string) ([]*url.URL, error) {
+	base, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if m := baseHref.FindStringSubmatch(page); m != nil {
+		if b, err := base.Parse(html.UnescapeString(m[1] + m[2] + m[3])); err == nil {
+			base = b
+		}
+	}
+
+	var links []*url.URL
+	seen := make(map[string]bool)
+	for _, m := range linkAttr.FindAllStringSubmatch(page, -1) {
+		href := strings.TrimSpace(html.UnescapeString(m[1] + m[2] + m[3]))
+		if href == "" || strings.HasPrefix(href, "#") {
+			continue
+		}
+		u, err := base.Parse(href)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		u.Fragment = ""
+		if seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		links = append(links, u)
+	}
+	return links, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty body, which is what GET and
+// HEAD requests carry.
+const emptyPayloadHash = "e3b0c44298fc1c149afbe4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sigV4Signer signs requests with AWS Signature Version 4, for private
+// S3 buckets and other endpoints that require it.
+type sigV4Signer struct {
+	region, service string
+	creds           awsCredentials
+}
+
+// awsCredentials are the keys requests are signed with.
+type awsCredentials struct {
+	accessKeyID, secretAccessKey, sessionToken string
+}
+
+// newSigV4Signer returns a signer for spec, a region and service such as
+// "us-east-1/s3", with credentials from the environment or, failing that,
+// the shared credentials file.
+func newSigV4Signer(spec string) (*sigV4Signer, error) {
+	region, service, ok := strings.Cut(spec, "/")
+	if !ok || region == "" || service == "" || strings.Contains(service, "/") {
+		return nil, fmt.Errorf("%q must be a region and service, such as us-east-1/s3", spec)
+	}
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return &sigV4Signer{region: region, service: service, creds: creds}, nil
+}
+
+// loadAWSCredentials reads credentials as the AWS tools do: from
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or else from the profile
+// AWS_PROFILE names, "default" if unset, in the shared credentials file.
+func loadAWSCredentials() (awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return awsCredentials{accessKeyID: id, secretAccessKey: secret, sessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return awsCredentials{}, errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or add them to ~/.aws/credentials")
+	}
+	defer f.Close()
+
+	var creds awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == profile:
+			key, value, _ := strings.Cut(line, "=")
+			value = strings.TrimSpace(value)
+			switch strings.TrimSpace(key) {
+			case "aws_access_key_id":
+				creds.accessKeyID = value
+			case "aws_secret_access_key":
+				creds.secretAccessKey = value
+			case "aws_session_token":
+				creds.sessionToken = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials for profile %q in %s", profile, path)
+	}
+	return creds, nil
+}
+
+// sign adds the headers of a Signature Version 4 signature, made at now,
+// to req, which must have no body. Only the host and the x-amz- headers
+// are signed, so the signature holds whatever else is set afterwards.
+func (s *sigV4Signer) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.service == "s3" {
+		// S3 requires the payload hash as a header too
+		req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	}
+	if s.creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL.Path, s.service),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, s.region, s.service)
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.creds.secretAccessKey), date)
+	for _, part := range []string{s.region, s.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query of a canonical request: each name and
+// value escaped, sorted by name and then value.
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for name, values := range q {
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// canonicalPath returns the path of a request as it is signed: each
+// segment escaped with awsEscape, however the URI escaped it, and escaped
+// once more for services other than S3, which expect that.
+func canonicalPath(path, service string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = awsEscape(seg)
+		if service != "s3" {
+			segments[i] = awsEscape(segments[i])
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsEscape percent-encodes every byte of s but the unreserved
+// characters of RFC 3986, as signatures require.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sigV4Transport signs each request, including those made while
+// following redirects, unless it carries its own Authorization or is
+// presigned.
+type sigV4Transport struct {
+	signer *sigV4Signer
+	next   http.RoundTripper
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" || req.URL.Query().Has("X-Amz-Signature") {
+		return t.next.RoundTrip(req)
+	}
+	signed := req.Clone(req.Context())
+	t.signer.sign(signed, time.Now())
+	return t.next.RoundTrip(signed)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		path, service, want string
+	}{
+		{"", "s3", "/"},
+		{"/", "s3", "/"},
+		{"/bucket/key.txt", "s3", "/bucket/key.txt"},
+		{"/bucket/my file+(1).txt", "s3", "/bucket/my%20file%2B%281%29.txt"},
+		{"/bucket/a=b&c$d!e*f'g,h;i:j@k", "s3", "/bucket/a%3Db%26c%24d%21e%2Af%27g%2Ch%3Bi%3Aj%40k"},
+		{"/bucket/dir//key~_-.", "s3", "/bucket/dir//key~_-."},
+		{"/bucket/naïve.txt", "s3", "/bucket/na%C3%AFve.txt"},
+		{"/bucket/100%.txt", "s3", "/bucket/100%25.txt"},
+		{"/my file", "execute-api", "/my%2520file"},
+		{"/plain/path", "execute-api", "/plain/path"},
+	}
+	for _, tt := range tests {
+		if got := canonicalPath(tt.path, tt.service); got != tt.want {
+			t.Errorf("canonicalPath(%q, %q) = %q, want %q", tt.path, tt.service, got, tt.want)
+		}
+	}
+}
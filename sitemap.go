@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxSitemapSize is the largest sitemap the protocol allows, uncompressed.
+const maxSitemapSize = 50 << 20
+
+// maxSitemaps limits how many sitemaps an index may expand into.
+const maxSitemaps = 1000
+
+// sitemapDoc holds either a sitemap's URLs or, for a sitemap index, the
+// sitemaps it lists.
+type sitemapDoc struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// listSitemap returns the entries of the sitemap at uri that match
+// pattern (all of them if pattern is nil), expanding sitemap indexes.
+// With robots set, sitemaps robots.txt disallows aren't read: uri is an
+// error, and those an index lists are skipped.
+func (dl *download) listSitemap(uri string, pattern *linkPattern, robots *robotsChecker) ([]source, error) {
+	var sources []source
+	seen := make(map[string]bool)
+	visited := map[string]bool{uri: true}
+	queue := []string{uri}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		if robots != nil {
+			ok, err := robots.allowed(next)
+			if err != nil {
+				return nil, fmt.Errorf("cannot check robots.txt: %w", err)
+			}
+			if !ok && next == uri {
+				return nil, fmt.Errorf("robots.txt doesn't allow reading %s; use -no-robots to ignore it", uri)
+			}
+			if !ok {
+				fmt.Println("Skipping sitemap (disallowed by robots.txt):", next)
+				continue
+			}
+		}
+		doc, err := dl.fetchSitemap(next)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range doc.Sitemaps {
+			loc := strings.TrimSpace(s.Loc)
+			if loc == "" || visited[loc] {
+				continue
+			}
+			if len(visited) >= maxSitemaps {
+				return nil, fmt.Errorf("more than %d sitemaps", maxSitemaps)
+			}
+			visited[loc] = true
+			queue = append(queue, loc)
+		}
+		for _, e := range doc.URLs {
+			u, err := url.Parse(strings.TrimSpace(e.Loc))
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+			if seen[u.String()] || pattern != nil && !pattern.match(u) {
+				continue
+			}
+			seen[u.String()] = true
+
+			normalized, err := normalizeURI(u.String())
+			if err != nil {
+				continue
+			}
+			sources = append(sources, source{uri: normalized})
+		}
+	}
+	return sources, nil
+}
+
+// fetchSitemap GETs and parses a sitemap or sitemap index, which may be
+// gzipped.
+func (dl *download) fetchSitemap(uri string) (*sitemapDoc, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GET request: %w", err)
+	}
+	dl.setHeaders(req)
+
+	resp, err := dl.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("non-2xx status (%d) for %s", resp.StatusCode, uri)
+	}
+
+	var body io.Reader = bufio.NewReader(resp.Body)
+	if magic, _ := body.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzipped sitemap %s: %w", uri, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var doc sitemapDoc
+	if err := xml.NewDecoder(io.LimitReader(body, maxSitemapSize)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid sitemap %s: %w", uri, err)
+	}
+	if doc.XMLName.Local != "urlset" && doc.XMLName.Local != "sitemapindex" {
+		return nil, fmt.Errorf("%s is not a sitemap", uri)
+	}
+	return &doc, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// currentSSID returns the name of the Wi-Fi network connected to, or ""
+// if there is none or it can't be told.
+func currentSSID() string {
+	out, err := exec.Command("networksetup", "-getairportnetwork", "en0").Output()
+	if err != nil {
+		return ""
+	}
+	ssid, ok := strings.CutPrefix(strings.TrimSpace(string(out)), "Current Wi-Fi Network: ")
+	if !ok {
+		return ""
+	}
+	return ssid
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// currentSSID returns the name of the Wi-Fi network connected to, or ""
+// if there is none or it can't be told.
+func currentSSID() string {
+	if out, err := exec.Command("iwgetid", "-r").Output(); err == nil {
+		if ssid := strings.TrimSpace(string(out)); ssid != "" {
+			return ssid
+		}
+	}
+	// NetworkManager lists networks as "yes:name" for the active one
+	out, err := exec.Command("nmcli", "-t", "-f", "active,ssid", "dev", "wifi").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if ssid, ok := strings.CutPrefix(line, "yes:"); ok {
+			return strings.ReplaceAll(ssid, `\:`, ":")
+		}
+	}
+	return ""
+}
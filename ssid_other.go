@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+// currentSSID can't tell the Wi-Fi network here.
+func currentSSID() string {
+	return ""
+}
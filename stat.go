@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// fileInfo describes a file as its server reports it, without
+// downloading it.
+type fileInfo struct {
+	uri           string
+	finalURI      string
+	filename      string
+	size          uint64
+	supportsRange bool
+	contentType   string
+	etag          string
+	lastModified  string
+}
+
+// info returns what FetchMetadata learned about the file.
+func (dl *download) info() fileInfo {
+	final := dl.uri
+	if n := len(dl.redirects); n > 0 {
+		final = dl.redirects[n-1]
+	}
+	return fileInfo{
+		uri:           dl.uri,
+		finalURI:      final,
+		filename:      dl.filename,
+		size:          dl.filesize,
+		supportsRange: dl.supportsRange,
+		contentType:   dl.contentType,
+		etag:          dl.etag,
+		lastModified:  dl.lastModified,
+	}
+}
+
+// print writes fi to w, one field per line, leaving out those the server
+// didn't send.
+func (fi fileInfo) print(w io.Writer) {
+	ranges := "not supported"
+	if fi.supportsRange {
+		ranges = "supported"
+	}
+	fields := []struct{ name, value string }{
+		{"URI", fi.uri},
+		{"Final URI", fi.finalURI},
+		{"Filename", fi.filename},
+		{"Size", fmt.Sprintf("%s (%d bytes)", formatBytes(float64(fi.size)), fi.size)},
+		{"Ranges", ranges},
+		{"Content-Type", fi.contentType},
+		{"ETag", fi.etag},
+		{"Last-Modified", fi.lastModified},
+	}
+	for _, f := range fields {
+		if f.value != "" {
+			fmt.Fprintf(w, "%-14s %s\n", f.name+":", f.value)
+		}
+	}
+}
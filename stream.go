@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// maxManifestSize bounds the HLS playlists and DASH manifests read.
+	maxManifestSize = 16 << 20
+	// segmentRetries is how many times a failed segment is fetched again
+	// before the download fails.
+	segmentRetries = 3
+	// maxSegments bounds the segments listed by a manifest, which a
+	// broken one could make endless.
+	maxSegments = 1 << 20
+)
+
+// streamManifest is a stream, as listed by an HLS playlist or a DASH
+// manifest, to be saved as a single file of its segments in order.
+type streamManifest struct {
+	kind string
+	// uri is where the manifest listing the segments is reloaded from.
+	uri string
+	// init, if set, is the initialization segment, which comes first.
+	init     *segment
+	segments []segment
+	// live streams have more segments to come: the manifest is reloaded
+	// every refresh for them.
+	live    bool
+	refresh time.Duration
+	// ext is the extension of the saved file, matching the segments'
+	// container.
+	ext string
+}
+
+// segment is a piece of a stream, fetched on its own.
+type segment struct {
+	uri string
+	// rng, if set, is the part of uri the segment is.
+	rng *byteRange
+	// seq numbers the segments of a stream in order, to tell which
+	// segments of a reloaded manifest are new.
+	seq int64
+}
+
+// segmentStatusError is the status of a failed segment request.
+type segmentStatusError int
+
+func (e segmentStatusError) Error() string {
+	return fmt.Sprintf("status %d", int(e))
+}
+
+// temporary reports whether the request may succeed if made again.
+func (e segmentStatusError) temporary() bool {
+	return e >= 500 || e == http.StatusRequestTimeout || e == http.StatusTooManyRequests
+}
+
+// segmentResult is a fetched segment, or why it couldn't be.
+type segmentResult struct {
+	data []byte
+	err  error
+}
+
+// fetchStreamMetadata reads the manifest at dl.uri and names the file its
+// stream is saved to after it.
+func (dl *download) fetchStreamMetadata() error {
+	m, err := dl.loadManifest(context.Background(), dl.uri)
+	if err != nil {
+		return err
+	}
+	dl.manifest = m
+	name := dl.filenameFromURI()
+	dl.filename = strings.TrimSuffix(name, path.Ext(name)) + m.ext
+	// The size is only known once every segment is in
+	dl.filesize = 0
+	dl.supportsRange = false
+	return nil
+}
+
+// loadManifest fetches and parses the HLS playlist or DASH manifest at
+// uri. A master playlist is followed to its highest bandwidth variant.
+func (dl *download) loadManifest(ctx context.Context, uri string) (*streamManifest, error) {
+	base, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	data, err := dl.fetchSmall(ctx, uri, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(bytes.TrimLeft(data, "\ufeff \t\r\n"), []byte("#EXTM3U")):
+		variants, m, err := parseHLS(base, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HLS playlist: %w", err)
+		}
+		if m != nil {
+			return m, nil
+		}
+		best := variants[0]
+		for _, v := range variants[1:] {
+			if v.bandwidth > best.bandwidth {
+				best = v
+			}
+		}
+		if best.uri == uri {
+			return nil, errors.New("invalid HLS playlist: it lists itself as a variant")
+		}
+		return dl.loadManifest(ctx, best.uri)
+	case bytes.Contains(data, []byte("<MPD")):
+		m, err := parseDASH(base, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DASH manifest: %w", err)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("%s is not an HLS playlist or DASH manifest", uri)
+}
+
+// fetchSmall returns the body of uri, which may be at most limit bytes.
+func (dl *download) fetchSmall(ctx context.Context, uri string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	dl.setHeaders(req)
+	resp, err := dl.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("larger than %s", formatBytes(float64(limit)))
+	}
+	return data, nil
+}
+
+// fetchStream saves the segments of dl's stream to the output file in
+// order, fetching up to dl.boost of them at once.
+func (dl *download) fetchStream(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	out, err := os.Create(dl.outputPath())
+	if err != nil {
+		return fmt.Errorf("cannot create output file: %w", err)
+	}
+	defer out.Close()
+
+	dl.progress = dl.newReporter()
+	stop := make(chan struct{})
+	defer close(stop)
+	go dl.watchSpeed(stop, cancel)
+
+	// Segments are fetched in the order they are queued, and written in
+	// that order as each one's turn comes. The queue bounds how far the
+	// fetches get ahead of the writing.
+	queue := make(chan chan segmentResult, max(dl.boost, 1))
+	var listErr error
+	go func() {
+		defer close(queue)
+		listErr = dl.listSegments(ctx, func(s segment) bool {
+			res := make(chan segmentResult, 1)
+			select {
+			case queue <- res:
+			case <-ctx.Done():
+				return false
+			}
+			go func() {
+				data, err := dl.fetchSegment(ctx, s)
+				res <- segmentResult{data: data, err: err}
+			}()
+			return true
+		})
+	}()
+
+	var written int64
+	for res := range queue {
+		r := <-res
+		if r.err == nil {
+			_, r.err = out.Write(r.data)
+		}
+		if r.err != nil {
+			cancel(r.err)
+			return cancelCause(ctx, r.err)
+		}
+		written += int64(len(r.data))
+		dl.addProgress(int64(len(r.data)))
+	}
+	if listErr != nil {
+		return cancelCause(ctx, listErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+	dl.filesize = uint64(written)
+	return nil
+}
+
+// listSegments passes the segments of dl's stream to queue in order,
+// reloading the manifest of a live stream for new ones until it ends. It
+// stops early if queue returns false.
+func (dl *download) listSegments(ctx context.Context, queue func(segment) bool) error {
+	m := dl.manifest
+	if m.init != nil && !queue(*m.init) {
+		return nil
+	}
+	last := int64(-1)
+	for {
+		for _, s := range m.segments {
+			if s.seq <= last {
+				continue
+			}
+			if !queue(s) {
+				return nil
+			}
+			last = s.seq
+		}
+		if !m.live {
+			return nil
+		}
+
+		// Wait for the live stream to grow
+		select {
+		case <-time.After(m.refresh):
+		case <-ctx.Done():
+			return nil
+		}
+		var err error
+		for attempt := 1; ; attempt++ {
+			var next *streamManifest
+			if next, err = dl.loadManifest(ctx, m.uri); err == nil {
+				m = next
+				break
+			}
+			if attempt > segmentRetries || ctx.Err() != nil {
+				return err
+			}
+			dl.warn("Reloading the playlist failed: %v; retrying", err)
+			time.Sleep(m.refresh)
+		}
+	}
+}
+
+// fetchSegment returns the data of segment s, retrying if fetching it
+// fails for what may be a passing reason.
+func (dl *download) fetchSegment(ctx context.Context, s segment) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		data, err := dl.fetchSegmentOnce(ctx, s)
+		if err == nil || ctx.Err() != nil {
+			return data, err
+		}
+		var status segmentStatusError
+		if attempt > segmentRetries || errors.As(err, &status) && !status.temporary() {
+			return nil, fmt.Errorf("error fetching segment %d: %w", s.seq, err)
+		}
+		dl.warn("Segment %d failed: %v; retrying", s.seq, err)
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+func (dl *download) fetchSegmentOnce(ctx context.Context, s segment) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.rng != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.rng.Start, s.rng.End))
+	}
+	dl.setHeaders(req)
+	dl.stats.requests.Add(1)
+	start := time.Now()
+	resp, err := dl.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, segmentStatusError(resp.StatusCode)
+	case s.rng != nil && resp.StatusCode != http.StatusPartialContent:
+		return nil, fmt.Errorf("the server ignored the range of %s", s.uri)
+	}
+	var b bytes.Buffer
+	n, err := io.Copy(&b, dl.limitReader(ctx, resp.Body))
+	dl.recordHost(resp, n, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+)
+
+// torSOCKSAddr is where a local Tor daemon listens for SOCKS connections.
+const torSOCKSAddr = "127.0.0.1:9050"
+
+// torUserAgent is the User-Agent of Tor Browser, so requests blend in
+// with everyone else's rather than announcing dl.
+const torUserAgent = "Mozilla/5.0 (Windows NT 10.0; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+// torProxy returns a proxy URI for the local Tor daemon with fresh,
+// random SOCKS credentials. Tor puts connections with different
+// credentials on different circuits, so requests made through one proxy
+// URI can't be linked to those made through another. socks5h leaves
+// name resolution to Tor, so no DNS queries leak.
+func torProxy() *url.URL {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &url.URL{
+		Scheme: "socks5h",
+		User:   url.UserPassword("dl-"+hex.EncodeToString(b), "x"),
+		Host:   torSOCKSAddr,
+	}
+}
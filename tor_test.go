@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+// TestTorUserAgent checks that under -tor every kind of request carries
+// Tor Browser's User-Agent, not just those with the download's headers.
+func TestTorUserAgent(t *testing.T) {
+	saved := userAgent
+	userAgent = torUserAgent
+	defer func() { userAgent = saved }()
+
+	data := dltest.RandomData(1<<20, 7)
+	var mu sync.Mutex
+	agents := make(map[string][]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path
+		if r.Header.Get("Range") != "" {
+			key += " range"
+		}
+		mu.Lock()
+		agents[key] = append(agents[key], r.UserAgent())
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Write([]byte("User-agent: *\nDisallow:\n"))
+		case "/SHA256SUMS":
+			w.Write([]byte("0000000000000000000000000000000000000000000000000000000000000000  file.bin\n"))
+		default:
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := fetchRobots(srv.URL + "/robots.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readChecksumList(srv.URL + "/SHA256SUMS"); err != nil {
+		t.Fatal(err)
+	}
+	dl := newTestDownload(t, srv.URL+"/file.bin", t.TempDir())
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"GET /robots.txt", "GET /SHA256SUMS", "GET /file.bin range"} {
+		if len(agents[key]) == 0 {
+			t.Errorf("no %s request", key)
+		}
+	}
+	for key, uas := range agents {
+		for _, ua := range uas {
+			if ua != torUserAgent {
+				t.Errorf("%s request has User-Agent %q", key, ua)
+			}
+		}
+	}
+}
+
+// TestHeaderUserAgent checks that a User-Agent given with -header still
+// wins over dl's own, with its placeholders filled in for each part.
+func TestHeaderUserAgent(t *testing.T) {
+	data := dltest.RandomData(1<<20, 8)
+	var mu sync.Mutex
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			mu.Lock()
+			agents = append(agents, r.UserAgent())
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dl := newTestDownload(t, srv.URL+"/file.bin", t.TempDir())
+	dl.headers = http.Header{"User-Agent": {"fetcher/{part}"}}
+	if err := dl.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) == 0 {
+		t.Fatal("no part requests")
+	}
+	for _, ua := range agents {
+		if !strings.HasPrefix(ua, "fetcher/") || ua == "fetcher/{part}" {
+			t.Errorf("part request has User-Agent %q", ua)
+		}
+	}
+}
+
+// TestTorProxyIsolation checks that each torProxy gets its own SOCKS
+// credentials, so Tor puts it on a circuit of its own.
+func TestTorProxyIsolation(t *testing.T) {
+	a, b := torProxy(), torProxy()
+	if a.Host != torSOCKSAddr || a.Scheme != "socks5h" {
+		t.Errorf("proxy is %s, want socks5h://%s", a.Redacted(), torSOCKSAddr)
+	}
+	if a.User.String() == b.User.String() {
+		t.Errorf("two proxies share the credentials %q", a.User.Username())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+)
+
+// connTrace records how a part's requests got their connections.
+type connTrace struct {
+	requests int
+	reused   int
+	resumed  int
+}
+
+// traceConns returns ctx with a trace that records whether the request
+// reused a pooled connection and, for a new TLS connection, whether the
+// session was resumed from a ticket rather than negotiated in full. The
+// counts go to the download's stats and, if p isn't nil, to the part.
+func (dl *download) traceConns(ctx context.Context, p *downloadPart) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				dl.stats.reusedConns.Add(1)
+			} else {
+				dl.stats.newConns.Add(1)
+				if tc := tcpConn(info.Conn); tc != nil {
+					if mptcp, err := tc.MultipathTCP(); err == nil && mptcp {
+						dl.stats.mptcpConns.Add(1)
+					}
+				}
+			}
+			if p == nil {
+				return
+			}
+			dl.mu.Lock()
+			p.conns.requests++
+			if info.Reused {
+				p.conns.reused++
+			}
+			dl.mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil || !state.DidResume {
+				return
+			}
+			dl.stats.resumedTLS.Add(1)
+			if p == nil {
+				return
+			}
+			dl.mu.Lock()
+			p.conns.resumed++
+			dl.mu.Unlock()
+		},
+	})
+}
+
+// printConnections prints how each part's requests were served, to see
+// whether connections and TLS sessions are being reused.
+func (dl *download) printConnections() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for _, p := range dl.parts {
+		c := p.conns
+		fmt.Printf("Part %d: %d request(s), %d on a reused connection, %d with a resumed TLS session\n",
+			p.index, c.requests, c.reused, c.resumed)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteUnits selects whether sizes use powers of 1024 (KiB, MiB, ...) or
+// of 1000 (kB, MB, ...).
+type byteUnits int
+
+const (
+	binaryUnits byteUnits = iota
+	siUnits
+)
+
+// displayUnits are the units sizes and speeds are shown in, set by -units.
+var displayUnits = binaryUnits
+
+func parseUnits(s string) (byteUnits, error) {
+	switch strings.ToLower(s) {
+	case "binary":
+		return binaryUnits, nil
+	case "si":
+		return siUnits, nil
+	}
+	return 0, fmt.Errorf("unknown units %q (valid: binary, si)", s)
+}
+
+func (u byteUnits) base() float64 {
+	if u == siUnits {
+		return 1000
+	}
+	return 1024
+}
+
+// unitPrefixes are the multiplier prefixes in increasing order, starting
+// at kilo.
+const unitPrefixes = "KMGTPE"
+
+// parseBandwidthLimit parses a rate in bytes per second such as "500K",
+// "2MiB/s", "1.5GiB", "1_000_000", or, in bits, "750kbit", "100mbit", or
+// "100Mbps". Binary suffixes (Ki, KiB, Mi, MiB, ...) always mean powers
+// of 1024; plain ones (K, KB, M, MB, ...) follow units, except for bits
+// (kbit, Mbit, ...), which are powers of 1000. Input that could be read
+// more than one way, such as "10Mb" (bits or bytes?) or "1.5" bytes, is
+// rejected rather than guessed at.
+func parseBandwidthLimit(s string, units byteUnits) (int64, error) {
+	rest := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	if number, ok := strings.CutSuffix(rest, "bps"); ok {
+		rest = number + "bit"
+	}
+	return parseByteCount(s, rest, "bandwidth limit", " per second", units)
+}
+
+// parseSize parses a size in bytes such as "500M", "10GiB", or
+// "1_000_000", read as parseBandwidthLimit reads rates.
+func parseSize(s string, units byteUnits) (int64, error) {
+	return parseByteCount(s, strings.TrimSpace(s), "size", "", units)
+}
+
+// parseByteCount parses rest, the number and unit of s, as a count of
+// bytes. what names the value in errors, and per follows "one byte" in
+// them.
+func parseByteCount(s, rest, what, per string, units byteUnits) (int64, error) {
+	i := strings.IndexFunc(rest, func(r rune) bool { return (r < '0' || r > '9') && r != '_' && r != '.' })
+	if i < 0 {
+		i = len(rest)
+	}
+	number, suffix := rest[:i], strings.TrimSpace(rest[i:])
+	n, err := parseDecimal(number)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", what, s, err)
+	}
+
+	bits := false
+	if unit, ok := strings.CutSuffix(suffix, "bit"); ok {
+		bits, suffix = true, unit
+	} else if strings.HasSuffix(suffix, "b") {
+		return 0, fmt.Errorf("ambiguous unit %q in %s %q: use B for bytes or bit for bits", suffix, what, s)
+	}
+
+	mult := 1.0
+	if suffix != "" && suffix != "B" {
+		prefix := suffix[:1]
+		if prefix == "k" || bits {
+			// Nobody means millibits
+			prefix = strings.ToUpper(prefix)
+		}
+		exp := strings.Index(unitPrefixes, prefix)
+		if exp < 0 {
+			return 0, fmt.Errorf("unknown unit %q in %s %q", suffix, what, s)
+		}
+		// Bit rates are quoted in powers of 1000 nearly everywhere
+		base := units.base()
+		switch unit := suffix[1:]; {
+		case unit == "" && bits:
+			base = 1000
+		case unit == "" || unit == "B" && !bits:
+		case unit == "i" || unit == "iB" && !bits:
+			base = 1024
+		default:
+			if bits {
+				suffix += "bit"
+			}
+			return 0, fmt.Errorf("unknown unit %q in %s %q", suffix, what, s)
+		}
+		mult = math.Pow(base, float64(exp+1))
+	}
+	if bits {
+		mult /= 8
+	}
+
+	if mult <= 1 && n != math.Trunc(n) {
+		return 0, fmt.Errorf("%s %q is a fraction of a byte; add a unit such as K or M", what, s)
+	}
+	limit := math.Round(n * mult)
+	if limit > math.MaxInt64 {
+		return 0, fmt.Errorf("%s %q is too large", what, s)
+	}
+	if limit < 1 {
+		return 0, fmt.Errorf("%s %q must be at least one byte%s", what, s, per)
+	}
+	return int64(limit), nil
+}
+
+// parseDecimal parses a non-negative decimal number in which digits may
+// be grouped with single underscores, such as "1_000_000" or "1.5".
+func parseDecimal(s string) (float64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing number")
+	}
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if whole == "" || hasFrac && frac == "" {
+		return 0, fmt.Errorf("malformed number %q", s)
+	}
+	for _, group := range []string{whole, frac} {
+		if strings.HasPrefix(group, "_") || strings.HasSuffix(group, "_") || strings.Contains(group, "__") || strings.Contains(group, ".") {
+			return 0, fmt.Errorf("malformed number %q", s)
+		}
+	}
+	return strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// usageFlushInterval is how often the bytes received are added to
+	// the usage file while downloading, so other runs see them.
+	usageFlushInterval = 10 * time.Second
+	// usageKeepDays is how long daily totals are kept.
+	usageKeepDays = 400
+)
+
+// received counts every byte read from the network, on any connection,
+// including protocol overhead, as metered plans count it.
+var received atomic.Int64
+
+// countingConn counts the bytes read from it in received.
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	received.Add(int64(n))
+	return n, err
+}
+
+// NetConn returns the underlying connection, as tls.Conn's does.
+func (c countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// countReceived wraps dial so the connections it opens count the bytes
+// read from them.
+func countReceived(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return countingConn{conn}, nil
+	}
+}
+
+// usagePath returns where the bytes downloaded per day are recorded.
+func usagePath() string {
+	if p := os.Getenv("DL_USAGE_FILE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dl", "usage.json")
+}
+
+// usageRecord holds the bytes downloaded on each day, by local date as
+// "2006-01-02".
+type usageRecord struct {
+	Days map[string]int64 `json:"days"`
+}
+
+// readUsage reads the usage file at path. A missing file records no use.
+func readUsage(path string) (*usageRecord, error) {
+	u := &usageRecord{Days: make(map[string]int64)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read usage: %w", err)
+	}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, fmt.Errorf("invalid usage file %s: %w", path, err)
+	}
+	if u.Days == nil {
+		u.Days = make(map[string]int64)
+	}
+	return u, nil
+}
+
+// month returns the bytes downloaded in the month of t.
+func (u *usageRecord) month(t time.Time) int64 {
+	prefix := t.Format("2006-01-")
+	var total int64
+	for day, n := range u.Days {
+		if len(day) > len(prefix) && day[:len(prefix)] == prefix {
+			total += n
+		}
+	}
+	return total
+}
+
+// usageMeter adds the bytes received by this run to the usage file.
+type usageMeter struct {
+	path string
+
+	mu sync.Mutex
+	// recorded is how much of received is already in the file.
+	recorded int64
+}
+
+// flush adds what was received since the last flush to today's total.
+// The file is locked while it is updated, as other runs may be doing
+// the same. A nil meter records nothing.
+func (m *usageMeter) flush() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := received.Load() - m.recorded
+	if n == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(m.path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock, true, true); err != nil {
+		return err
+	}
+
+	u, err := readUsage(m.path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u.Days[now.Format("2006-01-02")] += n
+	oldest := now.AddDate(0, 0, -usageKeepDays).Format("2006-01-02")
+	for day := range u.Days {
+		if day < oldest {
+			delete(u.Days, day)
+		}
+	}
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.path, data); err != nil {
+		return err
+	}
+	m.recorded += n
+	return nil
+}
+
+// save flushes, reporting any error, since failing to record usage
+// doesn't fail the download.
+func (m *usageMeter) save() {
+	if err := m.flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error recording usage: %v\n", err)
+	}
+}
+
+// savePeriodically saves every usageFlushInterval, for as long as dl
+// runs.
+func (m *usageMeter) savePeriodically() {
+	for range time.Tick(usageFlushInterval) {
+		m.save()
+	}
+}
+
+// usedThisMonth returns the bytes downloaded this month, including those
+// this run hasn't recorded yet.
+func (m *usageMeter) usedThisMonth() (int64, error) {
+	u, err := readUsage(m.path)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return u.month(time.Now()) + received.Load() - m.recorded, nil
+}
+
+// runUsage reports how much dl has downloaded, as "dl usage".
+func runUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	quotaFlag := fs.String("monthly-quota", os.Getenv("DL_MONTHLY_QUOTA"), "show this month's use against this quota, such as 50G (default $DL_MONTHLY_QUOTA)")
+	months := fs.Int("months", 6, "how many months to show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	path := usagePath()
+	if path == "" {
+		return errors.New("no usage file; set DL_USAGE_FILE")
+	}
+	u, err := readUsage(path)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	fmt.Printf("Today       %10s\n", formatBytes(float64(u.Days[now.Format("2006-01-02")])))
+	line := fmt.Sprintf("This month  %10s", formatBytes(float64(u.month(now))))
+	if *quotaFlag != "" {
+		quota, err := parseSize(*quotaFlag, displayUnits)
+		if err != nil {
+			return err
+		}
+		if quota <= 0 {
+			return errors.New("-monthly-quota must be positive")
+		}
+		line += fmt.Sprintf(" of %s quota (%.0f%%)", formatBytes(float64(quota)), float64(u.month(now))*100/float64(quota))
+	}
+	fmt.Println(line)
+
+	// Earlier months with any use, most recent first
+	for i := 1; i < *months; i++ {
+		month := now.AddDate(0, -i, 1-now.Day())
+		if n := u.month(month); n > 0 {
+			fmt.Printf("%-11s %10s\n", month.Format("2006-01"), formatBytes(float64(n)))
+		}
+	}
+	return nil
+}
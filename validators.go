@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// maxValidators is how many URIs the validator store remembers; the
+// least recently downloaded are forgotten first.
+const maxValidators = 1000
+
+// validatorsPath returns where the validators of completed downloads are
+// kept.
+func validatorsPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dl", "validators.json")
+}
+
+// validatorEntry is what was downloaded from a URI last: the server's
+// validators for it, and where the file was saved and how it was left,
+// to tell whether it is still there untouched.
+type validatorEntry struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	Recorded     time.Time `json:"recorded"`
+}
+
+// validatorStore remembers the validators of completed downloads by URI,
+// so downloading one again can be skipped when a conditional request
+// says it hasn't changed, whether or not its progress was kept.
+type validatorStore struct {
+	path string
+}
+
+// read returns the entries of the store. A missing file has none.
+func (s *validatorStore) read() (map[string]validatorEntry, error) {
+	entries := make(map[string]validatorEntry)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read validators: %w", err)
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid validators file %s: %w", s.path, err)
+	}
+	return entries, nil
+}
+
+// record adds dl's validators and completed file to the store. Other runs
+// may be doing the same, so the file is locked while it is updated.
+func (s *validatorStore) record(dl *download) error {
+	if s == nil || dl.etag == "" && dl.lastModified == "" {
+		return nil
+	}
+	info, err := os.Stat(dl.outputPath())
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock, true, true); err != nil {
+		return err
+	}
+
+	entries, err := s.read()
+	if err != nil {
+		return err
+	}
+	entries[dl.uri] = validatorEntry{
+		ETag:         dl.etag,
+		LastModified: dl.lastModified,
+		Path:         dl.outputPath(),
+		Size:         info.Size(),
+		ModTime:      info.ModTime(),
+		Recorded:     time.Now(),
+	}
+	if len(entries) > maxValidators {
+		uris := make([]string, 0, len(entries))
+		for uri := range entries {
+			uris = append(uris, uri)
+		}
+		sort.Slice(uris, func(i, j int) bool {
+			return entries[uris[i]].Recorded.Before(entries[uris[j]].Recorded)
+		})
+		for _, uri := range uris[:len(entries)-maxValidators] {
+			delete(entries, uri)
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// unchanged reports whether the file dl would download is already at its
+// output path, as saved by an earlier download that the server confirms
+// is still current with a conditional request.
+func (s *validatorStore) unchanged(dl *download) bool {
+	if s == nil {
+		return false
+	}
+	entries, err := s.read()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return false
+	}
+	e, ok := entries[dl.uri]
+	if !ok || e.Path != dl.outputPath() {
+		return false
+	}
+	// Anything else writing to the file since makes it no longer the
+	// one downloaded
+	info, err := os.Stat(e.Path)
+	if err != nil || info.Size() != e.Size || !info.ModTime().Equal(e.ModTime) {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dl.uri, nil)
+	if err != nil {
+		return false
+	}
+	dl.setHeaders(req)
+	if e.ETag != "" {
+		req.Header.Set("If-None-Match", e.ETag)
+	}
+	if e.LastModified != "" {
+		req.Header.Set("If-Modified-Since", e.LastModified)
+	}
+	resp, err := dl.do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNotModified
+}
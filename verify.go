@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// errWriteMismatch reports data that reads back from storage differently
+// than it was written.
+var errWriteMismatch = errors.New("data read back from disk doesn't match what was written")
+
+// crcTable is used for the checksums of written data. CRC-32C is fast
+// on most CPUs and good at catching the kinds of errors storage makes.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// verifyWrite reads n bytes at off back from out's storage and compares
+// them with sum, the checksum of the bytes written there. The data is
+// flushed and, where possible, dropped from the page cache first, so it
+// really comes from the device.
+func verifyWrite(out io.WriterAt, off, n int64, sum uint32) error {
+	if w, ok := out.(*orderedWriter); ok {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	f, foff := backingFile(out, off)
+	if f == nil {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("cannot flush written data: %w", err)
+	}
+	dropCache(f, foff, n)
+
+	h := crc32.New(crcTable)
+	if _, err := io.Copy(h, io.NewSectionReader(f, foff, n)); err != nil {
+		return fmt.Errorf("cannot read back written data: %w", err)
+	}
+	if h.Sum32() != sum {
+		return fmt.Errorf("%w at bytes %d-%d", errWriteMismatch, off, off+n-1)
+	}
+	return nil
+}
+
+// backingFile returns the file that byte off of out is stored in, and
+// its offset there.
+func backingFile(out io.WriterAt, off int64) (*os.File, int64) {
+	switch o := out.(type) {
+	case *os.File:
+		return o, off
+	case *partFileSet:
+		if pf := o.fileFor(uint64(off)); pf != nil {
+			return pf.f, off - int64(pf.start)
+		}
+	case *niceWriter:
+		return backingFile(o.out, off)
+	case *orderedWriter:
+		return backingFile(o.out, off)
+	}
+	return nil, 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mgomes/dl/dltest"
+)
+
+func TestVerifyWrites(t *testing.T) {
+	data := dltest.RandomData(2<<20, 12)
+	srv := dltest.NewServer(data, dltest.Options{Ranges: true})
+	defer srv.Close()
+
+	for _, strategy := range []string{"writeat", "partfiles"} {
+		t.Run(strategy, func(t *testing.T) {
+			dl := newTestDownload(t, srv.FileURL("file.bin"), t.TempDir())
+			dl.strategy = strategy
+			dl.verifyWrites = true
+			if err := dl.Fetch(context.Background()); err != nil {
+				t.Fatalf("Fetch: %v", err)
+			}
+			checkOutput(t, dl, data)
+		})
+	}
+}
+
+func TestVerifyWriteMismatch(t *testing.T) {
+	b := []byte("written to disk")
+	sum := crc32.Checksum(b, crcTable)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(b, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyWrite(f, 10, int64(len(b)), sum); err != nil {
+		t.Errorf("verifyWrite of intact data: %v", err)
+	}
+	if err := verifyWrite(f, 10, int64(len(b)), sum+1); !errors.Is(err, errWriteMismatch) {
+		t.Errorf("verifyWrite with the wrong checksum: %v", err)
+	}
+
+	// Through part files, byte 110 is byte 10 of the file starting at 100
+	dl := &download{filename: "file.bin", workingDir: t.TempDir(), filesize: 200, progressFile: defaultProgressFile}
+	set, err := dl.openPartFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.close()
+	if _, err := set.WriteAt(make([]byte, 10), 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.WriteAt(b, 110); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyWrite(set, 110, int64(len(b)), sum); err != nil {
+		t.Errorf("verifyWrite through part files: %v", err)
+	}
+	if err := verifyWrite(set, 100, int64(len(b)), sum); !errors.Is(err, errWriteMismatch) {
+		t.Errorf("verifyWrite through part files at the wrong offset: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// version, commit, and date are set at build time by goreleaser through
+// -ldflags "-X main.version=...".
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// versionInfo is what dl version reports, so bug reports and scripts can
+// tell which build and features they are dealing with.
+type versionInfo struct {
+	Version      string          `json:"version"`
+	Commit       string          `json:"commit"`
+	Date         string          `json:"date"`
+	Go           string          `json:"go"`
+	Platform     string          `json:"platform"`
+	Protocols    []string        `json:"protocols"`
+	TLS          tlsInfo         `json:"tls"`
+	Capabilities map[string]bool `json:"capabilities"`
+}
+
+type tlsInfo struct {
+	MinVersion string `json:"min_version"`
+	MaxVersion string `json:"max_version"`
+	// SessionResumption is whether connections after the first resume
+	// the TLS session, skipping a full handshake.
+	SessionResumption bool `json:"session_resumption"`
+	// HTTP2 is whether HTTP/2 is negotiated where servers offer it.
+	HTTP2 bool `json:"http2"`
+}
+
+// probeSize is the size of the file the capabilities are probed with.
+const probeSize = 1 << 20
+
+// probeFileSystem reports whether the file system of dir keeps files
+// sparse, taking no space for the parts not yet written, as files being
+// downloaded are, and supports fallocate to reserve space up front. Both
+// are false if dir can't be written to.
+func probeFileSystem(dir string) (sparse, canFallocate bool) {
+	f, err := os.CreateTemp(dir, ".dl-probe-*.tmp")
+	if err != nil {
+		return false, false
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if f.Truncate(probeSize) == nil {
+		if info, err := f.Stat(); err == nil {
+			allocated, ok := allocatedSize(info)
+			sparse = ok && allocated < probeSize
+		}
+	}
+	canFallocate = fallocate(f, probeSize) == nil
+	return sparse, canFallocate
+}
+
+// currentVersion describes this build, with the capabilities of the file
+// system of the current directory, where downloads go by default.
+func currentVersion() versionInfo {
+	sparse, canFallocate := probeFileSystem(".")
+	return versionInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		Go:        runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Protocols: []string{"http", "https", "file", "webdav"},
+		// The versions are Go's client defaults, which dl leaves alone;
+		// newHTTPClient adds the session cache. -multipath turns off
+		// HTTP/2, and -sni and -tls-keylog change the rest, for one run.
+		TLS: tlsInfo{
+			MinVersion:        tls.VersionName(tls.VersionTLS12),
+			MaxVersion:        tls.VersionName(tls.VersionTLS13),
+			SessionResumption: true,
+			HTTP2:             true,
+		},
+		Capabilities: map[string]bool{
+			"reflink":   reflinkSupported,
+			"sparse":    sparse,
+			"fallocate": canFallocate,
+		},
+	}
+}
+
+// runVersion prints the version, or everything in versionInfo as JSON
+// with -json.
+func runVersion(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "print build and capability details as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	info := currentVersion()
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	fmt.Printf("dl %s (commit %s, built %s) %s %s\n", info.Version, info.Commit, info.Date, info.Go, info.Platform)
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestProbeFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	sparse, canFallocate := probeFileSystem(dir)
+	t.Logf("sparse: %v, fallocate: %v", sparse, canFallocate)
+	if runtime.GOOS != "linux" && canFallocate {
+		t.Error("fallocate reported outside Linux")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("the probe left %d files behind", len(entries))
+	}
+
+	if sparse, canFallocate := probeFileSystem(filepath.Join(dir, "missing")); sparse || canFallocate {
+		t.Error("capabilities reported for a directory that doesn't exist")
+	}
+}
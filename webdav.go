@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// propfindBody asks a WebDAV server for the properties dl needs.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <d:getetag/>
+    <d:getcontenttype/>
+  </d:prop>
+</d:propfind>`
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	Propstat []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"DAV: prop"`
+	Status string  `xml:"DAV: status"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+	ETag          string `xml:"DAV: getetag"`
+	ContentType   string `xml:"DAV: getcontenttype"`
+}
+
+// davEntry is a file or collection listed by PROPFIND.
+type davEntry struct {
+	uri          string
+	collection   bool
+	size         uint64
+	lastModified string
+	etag         string
+	contentType  string
+}
+
+// source is a file to download, with the name to save it under when
+// that is known up front.
+type source struct {
+	uri      string
+	filename string
+	// modTime, if set, is given to the downloaded file, as listed by
+	// dl mirror.
+	modTime time.Time
+}
+
+// propfind lists the properties of uri and, with depth 1, of its members.
+func (dl *download) propfind(uri, depth string) ([]davEntry, error) {
+	req, err := http.NewRequestWithContext(context.Background(), "PROPFIND", uri, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PROPFIND request: %w", err)
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	dl.setHeaders(req)
+
+	resp, err := dl.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("PROPFIND request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("non-207 status (%d) for PROPFIND %s", resp.StatusCode, uri)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response: %w", err)
+	}
+
+	base := resp.Request.URL
+	entries := make([]davEntry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := base.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			size, _ := strconv.ParseUint(ps.Prop.ContentLength, 10, 64)
+			entries = append(entries, davEntry{
+				uri:          href.String(),
+				collection:   ps.Prop.ResourceType.Collection != nil,
+				size:         size,
+				lastModified: ps.Prop.LastModified,
+				etag:         ps.Prop.ETag,
+				contentType:  ps.Prop.ContentType,
+			})
+			break
+		}
+	}
+	return entries, nil
+}
+
+// fetchWebDAVMetadata fills in the metadata of a WebDAV file from
+// PROPFIND, which unlike HEAD also reports the modification time.
+func (dl *download) fetchWebDAVMetadata() error {
+	entries, err := dl.propfind(dl.uri, "0")
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no properties returned for %s", dl.uri)
+	}
+	e := entries[0]
+	if e.collection {
+		return fmt.Errorf("%s is a collection", dl.uri)
+	}
+
+	dl.filesize = e.size
+	dl.etag = e.etag
+	dl.lastModified = e.lastModified
+	dl.contentType = e.contentType
+	if t, err := http.ParseTime(e.lastModified); err == nil {
+		dl.modTime = t
+	}
+	dl.filename = dl.filenameFromURI()
+
+	// PROPFIND doesn't say whether ranges work, so ask
+	req, err := http.NewRequest("HEAD", dl.uri, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HEAD request: %w", err)
+	}
+	dl.setHeaders(req)
+	resp, err := dl.do(req)
+	if err != nil {
+		return fmt.Errorf("HEAD request failed: %w", err)
+	}
+	resp.Body.Close()
+	dl.supportsRange = strings.ToLower(resp.Header.Get("Accept-Ranges")) == "bytes"
+	return nil
+}
+
+// listWebDAV returns the files to download for uri: the file itself, or
+// every file in the collection and its sub-collections, named by their
+// path within a local directory named after the collection.
+func (dl *download) listWebDAV(uri string) ([]source, error) {
+	entries, err := dl.propfind(uri, "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || !entries[0].collection {
+		return []source{{uri: uri}}, nil
+	}
+
+	root, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	rootName := path.Base(strings.TrimSuffix(root.Path, "/") + "/")
+	var sources []source
+	err = dl.walkWebDAV(uri, func(e davEntry, rel string) {
+		sources = append(sources, source{uri: e.uri, filename: path.Join(rootName, rel)})
+	})
+	return sources, err
+}
+
+// walkWebDAV calls visit for every file in the collection at uri and its
+// sub-collections, with its path within the collection.
+func (dl *download) walkWebDAV(uri string, visit func(e davEntry, rel string)) error {
+	root, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	rootPath := strings.TrimSuffix(root.Path, "/") + "/"
+
+	visited := map[string]bool{rootPath: true}
+	queue := []string{root.String()}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		members, err := dl.propfind(dir, "1")
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			u, err := url.Parse(m.uri)
+			if err != nil {
+				continue
+			}
+			p := u.Path
+			if m.collection {
+				p = strings.TrimSuffix(p, "/") + "/"
+			}
+			// Skip the collection itself, anything already seen, and
+			// anything the server claims lives outside the collection
+			if visited[p] || !strings.HasPrefix(p, rootPath) {
+				continue
+			}
+			visited[p] = true
+
+			if m.collection {
+				queue = append(queue, u.String())
+				continue
+			}
+			rel := strings.TrimPrefix(p, rootPath)
+			if rel == "" || strings.Contains("/"+rel+"/", "/../") {
+				continue
+			}
+			m.uri = u.String()
+			visit(m, rel)
+		}
+	}
+	return nil
+}
+
+// applyModTime sets the output file's modification time to the remote
+// one, when known.
+func (dl *download) applyModTime() error {
+	if dl.modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(dl.outputPath(), time.Now(), dl.modTime)
+}
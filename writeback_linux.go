@@ -0,0 +1,18 @@
+//go:build !arm
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// syncFileRangeWrite is SYNC_FILE_RANGE_WRITE.
+const syncFileRangeWrite = 2
+
+// startWriteback starts writing the dirty pages of f to the device
+// without waiting for them, so they don't pile up and get flushed in
+// one large burst.
+func startWriteback(f *os.File) {
+	_ = syscall.SyncFileRange(int(f.Fd()), 0, 0, syncFileRangeWrite)
+}
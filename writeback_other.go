@@ -0,0 +1,9 @@
+//go:build !linux || arm
+
+package main
+
+import "os"
+
+// startWriteback is only supported on Linux; elsewhere the system
+// decides when written data goes to the device.
+func startWriteback(f *os.File) {}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// orderedWriter holds what the parts of a download receive and writes it
+// out a batch at a time, in ascending order of offset, for
+// -reorder-window. Shingled (SMR) drives, and many USB drives, slow to a
+// crawl under the scattered writes of parts filling the file side by
+// side; the same data sorted and joined into long runs goes out at close
+// to their sequential speed. A batch is written in the background while
+// the next fills, so what is held in memory stays within the window.
+type orderedWriter struct {
+	out io.WriterAt
+	// batch is how much is held before it is written.
+	batch int64
+
+	mu sync.Mutex
+	// pending are the writes held so far, and byEnd finds the one that
+	// ends where a write starts, which the write is added to.
+	pending []*heldWrite
+	byEnd   map[int64]*heldWrite
+	size    int64
+	// flushing are the writes being written, and done is closed once
+	// they are; both are nil in between.
+	flushing []*heldWrite
+	done     chan struct{}
+	// lost are the ranges that failed to be written, and err why.
+	lost []byteRange
+	err  error
+}
+
+// heldWrite is data waiting to be written at off.
+type heldWrite struct {
+	off  int64
+	data []byte
+}
+
+func newOrderedWriter(out io.WriterAt, window int64) *orderedWriter {
+	return &orderedWriter{out: out, batch: max(window/2, 1), byEnd: make(map[int64]*heldWrite)}
+}
+
+// WriteAt holds a copy of b to be written at off, first waiting for the
+// batch before to be written if this one is full. An error writing an
+// earlier batch is returned instead.
+func (w *orderedWriter) WriteAt(b []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	// Parts write their range in order, so most writes extend one held
+	if h := w.byEnd[off]; h != nil {
+		delete(w.byEnd, off)
+		h.data = append(h.data, b...)
+		w.byEnd[h.off+int64(len(h.data))] = h
+	} else {
+		h = &heldWrite{off: off, data: append([]byte(nil), b...)}
+		w.pending = append(w.pending, h)
+		w.byEnd[off+int64(len(b))] = h
+	}
+	w.size += int64(len(b))
+	if w.size >= w.batch {
+		w.startFlush(false)
+	}
+	return len(b), nil
+}
+
+// startFlush starts writing what is held, once the batch before is done,
+// unless it has fallen below a batch by then and force isn't set. w.mu is
+// held.
+func (w *orderedWriter) startFlush(force bool) {
+	for w.done != nil {
+		done := w.done
+		w.mu.Unlock()
+		<-done
+		w.mu.Lock()
+	}
+	if len(w.pending) == 0 || !force && w.size < w.batch {
+		return
+	}
+
+	batch := w.pending
+	w.pending, w.byEnd, w.size = nil, make(map[int64]*heldWrite), 0
+	w.flushing, w.done = batch, make(chan struct{})
+	go func(done chan struct{}) {
+		sort.Slice(batch, func(i, j int) bool { return batch[i].off < batch[j].off })
+		var err error
+		for _, h := range batch {
+			if _, err = w.out.WriteAt(h.data, h.off); err != nil {
+				break
+			}
+		}
+
+		w.mu.Lock()
+		if err != nil {
+			w.lost = append(w.lost, heldRanges(batch)...)
+			if w.err == nil {
+				w.err = err
+			}
+		}
+		w.flushing, w.done = nil, nil
+		w.mu.Unlock()
+		close(done)
+	}(w.done)
+}
+
+// Flush writes everything held, returning the first error writing any of
+// it.
+func (w *orderedWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.startFlush(true)
+	for w.done != nil {
+		done := w.done
+		w.mu.Unlock()
+		<-done
+		w.mu.Lock()
+	}
+	return w.err
+}
+
+// unwritten returns the ranges accepted but not on disk: those held or
+// being written, and those that failed to be written.
+func (w *orderedWriter) unwritten() []byteRange {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ranges := append(heldRanges(w.pending), heldRanges(w.flushing)...)
+	return mergeRanges(append(ranges, w.lost...))
+}
+
+// heldRanges returns the ranges of the file writes cover.
+func heldRanges(writes []*heldWrite) []byteRange {
+	var ranges []byteRange
+	for _, h := range writes {
+		if len(h.data) > 0 {
+			ranges = append(ranges, byteRange{Start: uint64(h.off), End: uint64(h.off) + uint64(len(h.data)) - 1})
+		}
+	}
+	return ranges
+}
+
+// subtractRanges returns the parts of ranges not in minus, both merged.
+func subtractRanges(ranges, minus []byteRange) []byteRange {
+	var out []byteRange
+	for _, r := range ranges {
+		for _, m := range minus {
+			if m.End < r.Start || m.Start > r.End {
+				continue
+			}
+			if m.Start > r.Start {
+				out = append(out, byteRange{Start: r.Start, End: m.Start - 1})
+			}
+			if m.End >= r.End {
+				r.Start = r.End + 1
+				break
+			}
+			r.Start = m.End + 1
+		}
+		if r.Start <= r.End {
+			out = append(out, r)
+		}
+	}
+	return out
+}